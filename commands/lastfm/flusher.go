@@ -0,0 +1,150 @@
+package lastfm
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	dbUtils "github.com/kitesi/music/db"
+)
+
+// the longest the flusher waits between attempts while a target is
+// unreachable
+const MAX_FLUSH_BACKOFF = time.Hour
+
+/*
+   Retries the plays that failed to scrobble (not fulfilled for a target) in
+   the background while watching. It runs on its own goroutine so a slow or
+   unreachable target never holds up tracking the players.
+
+   After a failed attempt the wait doubles (starting at the flush interval)
+   up to MAX_FLUSH_BACKOFF. A successful live scrobble wakes it up right away,
+   since that means the targets are likely reachable again.
+*/
+
+type flusher struct {
+	db         *sql.DB
+	scrobblers []Scrobbler
+	rules      scrobbleRules
+	interval   time.Duration
+	stdOut     *log.Logger
+	stdErr     *log.Logger
+
+	wake chan struct{}
+}
+
+func newFlusher(db *sql.DB, scrobblers []Scrobbler, rules scrobbleRules, interval time.Duration, stdOut *log.Logger, stdErr *log.Logger) *flusher {
+	return &flusher{
+		db:         db,
+		scrobblers: scrobblers,
+		rules:      rules,
+		interval:   interval,
+		stdOut:     stdOut,
+		stdErr:     stdErr,
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// never blocks, a pending wake up is enough
+func (f *flusher) notify() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// tries every target even if one fails, the first error is returned
+func (f *flusher) flush() error {
+	var firstErr error
+
+	for _, scrobbler := range f.scrobblers {
+		if err := f.flushTarget(scrobbler); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// submits every unfulfilled play for the target, a batch at a time
+func (f *flusher) flushTarget(scrobbler Scrobbler) error {
+	plays, err := dbUtils.GetUnfulfilledPlays(f.db, scrobbler.Name())
+
+	if err != nil {
+		return err
+	}
+
+	pending, dropped, err := rewritePlays(f.db, f.rules, plays)
+
+	if err != nil {
+		return err
+	}
+
+	if err := dbUtils.SetPlaysIgnored(f.db, scrobbler.Name(), toIgnoredPlays(dropped)); err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	f.stdOut.Printf("retrying %d failed scrobble(s) to %s", len(pending), scrobbler.Name())
+
+	for cursor := 0; cursor < len(pending); cursor += scrobbler.BatchSize() {
+		batch := pending[cursor:min(cursor+scrobbler.BatchSize(), len(pending))]
+		accepted, ignored, err := scrobbler.Submit(batch)
+
+		if err != nil {
+			return err
+		}
+
+		for _, scrobble := range ignored {
+			f.stdErr.Printf("└── %s ignored %s - %s - %s", scrobbler.Name(), scrobble.play.Artist, scrobble.play.Title, scrobble.message)
+		}
+
+		if err := dbUtils.UpdateUnfulfilledPlays(f.db, scrobbler.Name(), accepted); err != nil {
+			return err
+		}
+
+		// so they aren't sent again
+		if err := dbUtils.SetPlaysIgnored(f.db, scrobbler.Name(), toIgnoredPlays(ignored)); err != nil {
+			return err
+		}
+
+		f.stdOut.Printf("└── accepted: %d, ignored: %d", len(accepted), len(ignored))
+	}
+
+	return nil
+}
+
+// flushes right away (for plays left over from earlier runs), then every
+// interval until stop is closed
+func (f *flusher) run(stop <-chan struct{}) {
+	wait := time.Duration(0)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-f.wake:
+			wait = f.interval
+		case <-time.After(wait):
+		}
+
+		err := f.flush()
+		wait = nextFlushWait(wait, f.interval, err != nil)
+
+		if err != nil {
+			f.stdErr.Printf("could not retry failed scrobbles, trying again in %s - %s", wait, err.Error())
+		}
+	}
+}
+
+// doubles the wait after every failed flush, a successful one resets it
+func nextFlushWait(wait time.Duration, interval time.Duration, failed bool) time.Duration {
+	if !failed {
+		return interval
+	}
+
+	return min(max(wait*2, interval), MAX_FLUSH_BACKOFF)
+}
@@ -2,22 +2,18 @@ package lastfm
 
 import (
 	"bufio"
+	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"net/url"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 
 	dbUtils "github.com/kitesi/music/db"
 	"github.com/kitesi/music/utils"
 	"github.com/spf13/cobra"
 )
 
-const MAX_SCROBBLES = 50
-
 func ImportSetup() *cobra.Command {
 	args := LastfmImportArgs{}
 
@@ -41,7 +37,7 @@ func ImportSetup() *cobra.Command {
 				return
 			}
 
-			if err := importRunner(logDbFile, &args); err != nil {
+			if err := importRunner(logDbFile, &args, config.LastFm); err != nil {
 				if args.debug {
 					fmt.Fprintf(os.Stderr, "error: %+v\n", err)
 				} else {
@@ -52,120 +48,194 @@ func ImportSetup() *cobra.Command {
 	}
 
 	lastfmCommand.Flags().BoolVarP(&args.debug, "debug", "d", config.Debug, "set debug mode")
+	lastfmCommand.Flags().BoolVarP(&args.yes, "yes", "y", false, "scrobble every batch without asking")
+	lastfmCommand.Flags().BoolVarP(&args.json, "json", "j", false, "print the results as json, implies --yes")
+	lastfmCommand.Flags().StringSliceVar(&args.targets, "targets", config.LastFm.Targets, "where to scrobble to, any of \"lastfm\", \"listenbrainz\" and \"maloja\"")
 	return lastfmCommand
 }
 
-func importRunner(filename string, _ *LastfmImportArgs) error {
-	credentials, err := setupOrGetCredentials()
+type importIgnored struct {
+	ID        int64     `json:"id"`
+	Artist    string    `json:"artist"`
+	Album     string    `json:"album"`
+	Title     string    `json:"title"`
+	StartTime time.Time `json:"startTime"`
+	Code      string    `json:"code"`
+	Message   string    `json:"message"`
+}
 
-	if err != nil {
-		return err
-	}
+type importResult struct {
+	Target   string          `json:"target"`
+	Accepted int             `json:"accepted"`
+	Ignored  []importIgnored `json:"ignored"`
+	// plays left unfulfilled because a batch was declined
+	Skipped int `json:"skipped"`
+}
 
-	apiKey, _ := credentials.Get("api_key")
-	apiSecret, _ := credentials.Get("api_secret")
-	sessionKey, _ := credentials.Get("session_key")
+func (r *importResult) addIgnored(scrobbles []ignoredScrobble) {
+	for _, scrobble := range scrobbles {
+		r.Ignored = append(r.Ignored, importIgnored{
+			ID:        scrobble.play.ID,
+			Artist:    scrobble.play.Artist,
+			Album:     scrobble.play.Album,
+			Title:     scrobble.play.Title,
+			StartTime: scrobble.play.StartTime,
+			Code:      scrobble.code,
+			Message:   scrobble.message,
+		})
+	}
+}
 
-	_, err = os.Stat(filename)
+func importRunner(filename string, args *LastfmImportArgs, config utils.LastfmConfig) error {
+	_, err := os.Stat(filename)
 
 	if os.IsNotExist(err) {
 		return fmt.Errorf("file %s does not exist", filename)
 	}
 
-	db, err := dbUtils.OpenDB(filename)
-	songsToScrobble, err := dbUtils.GetUnfulfilledPlays(db)
+	scrobblers, err := newScrobblers(args.targets, config)
 
 	if err != nil {
 		return err
 	}
 
-	defer db.Close()
-
-	cursor := 0
+	db, err := dbUtils.OpenDB(filename)
 
-	if len(songsToScrobble) > MAX_SCROBBLES {
-		fmt.Printf("There are more than %d songs to scrobble. This program will scrobble %d songs at a time.\n", MAX_SCROBBLES, MAX_SCROBBLES)
+	if err != nil {
+		return err
 	}
 
-	if len(songsToScrobble) == 0 {
-		fmt.Println("No songs to scrobble.")
-		return nil
+	defer db.Close()
+
+	if err := dbUtils.RunMigrations(db); err != nil {
+		return fmt.Errorf("could not run migrations on log db file: %s", err.Error())
 	}
 
-	for cursor < len(songsToScrobble) {
-		endPosition := cursor + MAX_SCROBBLES
+	rules, err := getScrobbleRules(config)
 
-		if endPosition > len(songsToScrobble) {
-			endPosition = len(songsToScrobble)
-		}
+	if err != nil {
+		return err
+	}
 
-		amountOfScrobbles := endPosition - cursor
-		fmt.Printf("The following songs will be scrobbled (%d):\n", amountOfScrobbles)
-
-		params := url.Values{}
-		params.Set("method", "track.scrobble")
-		params.Set("api_key", apiKey)
-		params.Set("sk", sessionKey)
-
-		for i, song := range songsToScrobble[cursor:endPosition] {
-			timeStr := strconv.FormatInt(song.StartTime.Unix(), 10)
-			fmt.Println(i+1, song.Album, song.Artist, song.Title, song.StartTime)
-			params.Set(fmt.Sprintf("album[%d]", i), song.Album)
-			params.Set(fmt.Sprintf("artist[%d]", i), song.Artist)
-			params.Set(fmt.Sprintf("track[%d]", i), song.Title)
-			params.Set(fmt.Sprintf("timestamp[%d]", i), timeStr)
-		}
+	results := []importResult{}
 
-		// ask for confirmation
-		fmt.Print("Do you want to continue? (y/n): ")
-		reader := bufio.NewReader(os.Stdin)
-		text, _ := reader.ReadString('\n')
+	for _, scrobbler := range scrobblers {
+		result, err := importTarget(db, scrobbler, rules, args)
 
-		if strings.TrimSpace(text) != "y" {
-			break
+		if err != nil {
+			return fmt.Errorf("%s - %s", scrobbler.Name(), err.Error())
 		}
 
-		params.Set("api_sig", generateSignature(params, apiSecret))
-		params.Set("format", "json")
+		results = append(results, result)
+	}
 
-		resp, err := http.PostForm(API_END_POINT, params)
+	if args.json {
+		output, err := json.MarshalIndent(results, "", "  ")
 
 		if err != nil {
 			return err
 		}
 
-		if resp.StatusCode > 299 {
-			return fmt.Errorf(resp.Status)
+		fmt.Println(string(output))
+	}
+
+	return nil
+}
+
+func importTarget(db *sql.DB, scrobbler Scrobbler, rules scrobbleRules, args *LastfmImportArgs) (importResult, error) {
+	result := importResult{Target: scrobbler.Name(), Ignored: []importIgnored{}}
+	plays, err := dbUtils.GetUnfulfilledPlays(db, scrobbler.Name())
+
+	if err != nil {
+		return result, err
+	}
+
+	// the rules may have changed since the plays were logged
+	songsToScrobble, dropped, err := rewritePlays(db, rules, plays)
+
+	if err != nil {
+		return result, err
+	}
+
+	if err := dbUtils.SetPlaysIgnored(db, scrobbler.Name(), toIgnoredPlays(dropped)); err != nil {
+		return result, err
+	}
+
+	result.addIgnored(dropped)
+
+	if len(dropped) > 0 && !args.json {
+		fmt.Printf("%d songs were dropped by the rewrite rules.\n", len(dropped))
+	}
+
+	// the json output is meant for scripts, so there's no one to ask
+	confirm := !args.yes && !args.json
+	batchSize := scrobbler.BatchSize()
+
+	if !args.json {
+		fmt.Printf("Scrobbling to %s:\n", scrobbler.Name())
+	}
+
+	if len(songsToScrobble) > batchSize && confirm {
+		fmt.Printf("There are more than %d songs to scrobble. This program will scrobble %d songs at a time.\n", batchSize, batchSize)
+	}
+
+	if len(songsToScrobble) == 0 && !args.json {
+		fmt.Println("No songs to scrobble.")
+		return result, nil
+	}
+
+	for cursor := 0; cursor < len(songsToScrobble); cursor += batchSize {
+		batch := songsToScrobble[cursor:min(cursor+batchSize, len(songsToScrobble))]
+
+		if confirm {
+			fmt.Printf("The following songs will be scrobbled (%d):\n", len(batch))
+
+			for i, song := range batch {
+				fmt.Println(i+1, song.Album, song.Artist, song.Title, song.StartTime)
+			}
+
+			fmt.Print("Do you want to continue? (y/n): ")
+			reader := bufio.NewReader(os.Stdin)
+			text, _ := reader.ReadString('\n')
+
+			if strings.TrimSpace(text) != "y" {
+				result.Skipped = len(songsToScrobble) - cursor
+				break
+			}
 		}
 
-		defer resp.Body.Close()
-		body, err := io.ReadAll(resp.Body)
+		accepted, ignored, err := scrobbler.Submit(batch)
 
 		if err != nil {
-			return err
+			return result, err
 		}
 
-		fmt.Println(resp.StatusCode, string(body))
-		fmt.Println("Received response code:", resp.StatusCode)
+		if err := dbUtils.UpdateUnfulfilledPlays(db, scrobbler.Name(), accepted); err != nil {
+			return result, err
+		}
 
-		var resultJson PostMultipleScrobbleResponse
-		err = json.Unmarshal(body, &resultJson)
+		if err := dbUtils.SetPlaysIgnored(db, scrobbler.Name(), toIgnoredPlays(ignored)); err != nil {
+			return result, err
+		}
 
-		if err != nil {
-			return err
+		result.Accepted += len(accepted)
+		result.addIgnored(ignored)
+
+		if args.json {
+			continue
 		}
 
-		fmt.Printf("Scrobbles accepted: %d, ignored: %d\n", resultJson.Scrobbles.Attr.Accepted, resultJson.Scrobbles.Attr.Ignored)
+		fmt.Printf("Scrobbles accepted: %d, ignored: %d\n", len(accepted), len(ignored))
 
-		if resultJson.Scrobbles.Attr.Accepted == amountOfScrobbles {
-			fmt.Println("All scrobbles accepted, updating local database...")
-			dbUtils.UpdateUnfulfilledPlays(db, songsToScrobble[cursor:endPosition])
-		} else {
-			fmt.Println("Not all scrobbles were accepted, not updating local database.")
+		for _, scrobble := range ignored {
+			fmt.Printf("  ignored %s - %s (%s)\n", scrobble.play.Artist, scrobble.play.Title, scrobble.message)
 		}
 
-		cursor += amountOfScrobbles
+		// only happens if the results don't line up with what was sent
+		if unknown := len(batch) - len(accepted) - len(ignored); unknown > 0 {
+			fmt.Printf("Could not tell which scrobbles were accepted, leaving %d unfulfilled.\n", unknown)
+		}
 	}
 
-	return nil
+	return result, nil
 }
@@ -0,0 +1,124 @@
+package lastfm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/kitesi/music/simpleconfig"
+)
+
+func updateNowPlaying(credentials simpleconfig.Config, album string, artist string, track string, duration float64) (UpdateNowPlayingResponse, error) {
+	apiKey, _ := credentials.Get("api_key")
+	apiSecret, _ := credentials.Get("api_secret")
+	sessionKey, _ := credentials.Get("session_key")
+
+	params := url.Values{}
+	params.Set("method", "track.updateNowPlaying")
+	params.Set("api_key", apiKey)
+	params.Set("album", album)
+	params.Set("artist", artist)
+	params.Set("track", track)
+	params.Set("sk", sessionKey)
+
+	if duration > 0 {
+		params.Set("duration", fmt.Sprint(int(duration)))
+	}
+
+	params.Set("api_sig", generateSignature(params, apiSecret))
+	params.Set("format", "json")
+
+	resp, err := scrobbleClient.PostForm(API_END_POINT, params)
+
+	if err != nil {
+		return UpdateNowPlayingResponse{}, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		return UpdateNowPlayingResponse{}, errors.New(resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return UpdateNowPlayingResponse{}, err
+	}
+
+	var errorJson LastfmErrorResponse
+
+	if err := json.Unmarshal(body, &errorJson); err == nil && errorJson.Error != 0 {
+		return UpdateNowPlayingResponse{}, fmt.Errorf("(%d) %s", errorJson.Error, errorJson.Message)
+	}
+
+	resultJson := UpdateNowPlayingResponse{}
+
+	if err := json.Unmarshal(body, &resultJson); err != nil {
+		return UpdateNowPlayingResponse{}, err
+	}
+
+	return resultJson, nil
+}
+
+type nowPlayingTrack struct {
+	player   string
+	album    string
+	artist   string
+	track    string
+	duration float64
+}
+
+/*
+   Skipping through tracks shouldn't send an update for each of them, so at
+   most one update is sent every --now-playing-interval. A track that comes in
+   sooner waits (replacing any other waiting track) and is sent on a later
+   tick, unless it's already over by then.
+*/
+
+type nowPlaying struct {
+	credentials simpleconfig.Config
+	interval    time.Duration
+	stdErr      *log.Logger
+
+	lastUpdate time.Time
+	pending    *nowPlayingTrack
+}
+
+func (n *nowPlaying) queue(track nowPlayingTrack, now time.Time) {
+	n.pending = &track
+	n.send(now)
+}
+
+// drops the waiting update if it's for a track the player just finished
+func (n *nowPlaying) cancel(player string) {
+	if n.pending != nil && n.pending.player == player {
+		n.pending = nil
+	}
+}
+
+// sends the waiting update if the interval has passed
+func (n *nowPlaying) send(now time.Time) {
+	if n.pending == nil || now.Sub(n.lastUpdate) < n.interval {
+		return
+	}
+
+	track := *n.pending
+	n.pending = nil
+	n.lastUpdate = now
+
+	// it's only cosmetic, so it doesn't hold up the watcher
+	go func() {
+		response, err := updateNowPlaying(n.credentials, track.album, track.artist, track.track, track.duration)
+
+		if err != nil {
+			n.stdErr.Printf("└── could not update now playing - %s", err.Error())
+		} else if code := response.NowPlaying.IgnoredMessage.Code; code != "" && code != "0" {
+			n.stdErr.Printf("└── last.fm ignored the now playing update - %s", response.NowPlaying.IgnoredMessage.Text)
+		}
+	}()
+}
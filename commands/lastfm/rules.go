@@ -0,0 +1,325 @@
+package lastfm
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	dbUtils "github.com/kitesi/music/db"
+	"github.com/kitesi/music/utils"
+	"github.com/spf13/cobra"
+)
+
+func RulesSetup() *cobra.Command {
+	rulesCommand := &cobra.Command{
+		Use:   "rules",
+		Short: "Scrobble rewrite rules",
+		Long:  "Preview the rules that rewrite the artist, title and album before scrobbling",
+	}
+
+	args := LastfmRulesTestArgs{}
+
+	testCommand := &cobra.Command{
+		Use:   "test <artist> <title>",
+		Short: "Show what the rules do to a track",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, positional []string) {
+			if err := rulesTestRunner(&args, positional[0], positional[1]); err != nil {
+				if args.debug {
+					fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+				} else {
+					fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				}
+			}
+		},
+	}
+
+	config, err := utils.GetConfig()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+	}
+
+	testCommand.Flags().StringVarP(&args.album, "album", "a", "", "the track's album")
+	testCommand.Flags().StringVar(&args.rulesFile, "rules-file", config.LastFm.RulesFile, "rules file to use instead of the default one")
+	testCommand.Flags().BoolVarP(&args.debug, "debug", "d", config.Debug, "set debug mode")
+
+	rulesCommand.AddCommand(testCommand)
+	return rulesCommand
+}
+
+func rulesTestRunner(args *LastfmRulesTestArgs, artist string, title string) error {
+	rulesPath, err := getRulesPath(utils.LastfmConfig{RulesFile: args.rulesFile})
+
+	if err != nil {
+		return err
+	}
+
+	rules, err := getScrobbleRules(utils.LastfmConfig{RulesFile: args.rulesFile})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d rule(s) from %s\n", len(rules), rulesPath)
+
+	metadata, dropped, trace := rules.apply(scrobbleMetadata{Artist: artist, Title: title, Album: args.album})
+
+	for _, line := range trace {
+		fmt.Println("  " + line)
+	}
+
+	if dropped {
+		fmt.Println("dropped, it won't be scrobbled")
+		return nil
+	}
+
+	fmt.Printf("artist: %s\ntitle:  %s\nalbum:  %s\n", metadata.Artist, metadata.Title, metadata.Album)
+	return nil
+}
+
+const (
+	RULE_REPLACE = "replace"
+	RULE_COPY    = "copy"
+	RULE_ALIAS   = "alias"
+	RULE_DROP    = "drop"
+)
+
+// the code plays dropped by a rule are ignored with
+const IGNORED_CODE_RULE = "rule"
+
+/*
+   Rules rewrite a track's artist, title and album before it's scrobbled.
+   They run in order, each one seeing what the ones before it did:
+
+   - replace: regex find/replace on field
+   - copy: field is set to from, or to find/replace on from if find matches
+   - alias: field (the artist by default) is set to value if it's one of
+     names, ignoring case
+   - drop: the track isn't scrobbled if find matches field
+
+   Every rule can be limited to artists matching the artist regex. Fields are
+   trimmed after every rule, so removing a suffix doesn't leave a space.
+*/
+
+type scrobbleRule struct {
+	Type    string
+	Field   string
+	From    string
+	Find    string
+	Replace string
+	Names   []string
+	Value   string
+	Artist  string
+
+	find   *regexp.Regexp
+	artist *regexp.Regexp
+}
+
+type scrobbleRules []scrobbleRule
+
+type scrobbleMetadata struct {
+	Artist string
+	Title  string
+	Album  string
+}
+
+func (m *scrobbleMetadata) field(name string) *string {
+	switch name {
+	case "artist":
+		return &m.Artist
+	case "title":
+		return &m.Title
+	case "album":
+		return &m.Album
+	}
+
+	return nil
+}
+
+func getRulesPath(config utils.LastfmConfig) (string, error) {
+	if config.RulesFile != "" {
+		return config.RulesFile, nil
+	}
+
+	configPath, err := utils.GetConfigPath()
+
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(filepath.Dir(configPath), "scrobble-rules.json"), nil
+}
+
+// no rules file means no rules
+func getScrobbleRules(config utils.LastfmConfig) (scrobbleRules, error) {
+	rulesPath, err := getRulesPath(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(rulesPath)
+
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var rules scrobbleRules
+
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("could not read rules file (%s): %s", rulesPath, err.Error())
+	}
+
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("rule %d in %s: %s", i+1, rulesPath, err.Error())
+		}
+	}
+
+	return rules, nil
+}
+
+func (r *scrobbleRule) compile() error {
+	if r.Type == RULE_ALIAS && r.Field == "" {
+		r.Field = "artist"
+	}
+
+	if (&scrobbleMetadata{}).field(r.Field) == nil {
+		return fmt.Errorf("invalid field '%s', expected value of 'artist'|'title'|'album'", r.Field)
+	}
+
+	switch r.Type {
+	case RULE_REPLACE, RULE_DROP:
+		if r.Find == "" {
+			return fmt.Errorf("%s rules need find", r.Type)
+		}
+	case RULE_COPY:
+		if (&scrobbleMetadata{}).field(r.From) == nil {
+			return fmt.Errorf("invalid from '%s', expected value of 'artist'|'title'|'album'", r.From)
+		}
+	case RULE_ALIAS:
+		if len(r.Names) == 0 || r.Value == "" {
+			return fmt.Errorf("alias rules need names and value")
+		}
+	default:
+		return fmt.Errorf("invalid type '%s', expected value of 'replace'|'copy'|'alias'|'drop'", r.Type)
+	}
+
+	var err error
+
+	if r.Find != "" {
+		if r.find, err = regexp.Compile(r.Find); err != nil {
+			return err
+		}
+	}
+
+	if r.Artist != "" {
+		if r.artist, err = regexp.Compile("(?i)" + r.Artist); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// returns whether the rule changed (or dropped) anything
+func (r *scrobbleRule) apply(metadata *scrobbleMetadata) (bool, bool) {
+	if r.artist != nil && !r.artist.MatchString(metadata.Artist) {
+		return false, false
+	}
+
+	field := metadata.field(r.Field)
+	value := *field
+
+	switch r.Type {
+	case RULE_REPLACE:
+		value = r.find.ReplaceAllString(value, r.Replace)
+	case RULE_COPY:
+		from := *metadata.field(r.From)
+
+		if r.find == nil {
+			value = from
+		} else if r.find.MatchString(from) {
+			value = r.find.ReplaceAllString(from, r.Replace)
+		}
+	case RULE_ALIAS:
+		for _, name := range r.Names {
+			if strings.EqualFold(value, name) {
+				value = r.Value
+				break
+			}
+		}
+	case RULE_DROP:
+		return r.find.MatchString(value), true
+	}
+
+	value = strings.TrimSpace(value)
+	changed := value != *field
+	*field = value
+	return changed, false
+}
+
+// the rewritten metadata, whether a drop rule matched, and what each rule
+// that did something changed
+func (rules scrobbleRules) apply(metadata scrobbleMetadata) (scrobbleMetadata, bool, []string) {
+	trace := []string{}
+
+	for i := range rules {
+		rule := &rules[i]
+		before := *metadata.field(rule.Field)
+		changed, isDrop := rule.apply(&metadata)
+
+		if !changed {
+			continue
+		}
+
+		if isDrop {
+			trace = append(trace, fmt.Sprintf("rule %d (drop): %s %q matched %q", i+1, rule.Field, before, rule.Find))
+			return metadata, true, trace
+		}
+
+		trace = append(trace, fmt.Sprintf("rule %d (%s): %s %q -> %q", i+1, rule.Type, rule.Field, before, *metadata.field(rule.Field)))
+	}
+
+	return metadata, false, trace
+}
+
+// rewrites plays logged before (or without) the current rules, the changes
+// are saved to the db. Dropped plays are returned on their own.
+func rewritePlays(db *sql.DB, rules scrobbleRules, plays []dbUtils.Play) ([]dbUtils.Play, []ignoredScrobble, error) {
+	kept := []dbUtils.Play{}
+	dropped := []ignoredScrobble{}
+
+	for _, play := range plays {
+		metadata, drop, _ := rules.apply(scrobbleMetadata{Artist: play.OriginalArtist, Title: play.OriginalTitle, Album: play.OriginalAlbum})
+
+		if drop {
+			dropped = append(dropped, ignoredScrobble{play: play, code: IGNORED_CODE_RULE, message: "dropped by a rewrite rule"})
+			continue
+		}
+
+		if metadata.Artist != play.Artist || metadata.Title != play.Title || metadata.Album != play.Album {
+			play.Artist = metadata.Artist
+			play.Title = metadata.Title
+			play.Album = metadata.Album
+
+			if err := dbUtils.UpdatePlayMetadata(db, play); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		kept = append(kept, play)
+	}
+
+	return kept, dropped, nil
+}
@@ -0,0 +1,159 @@
+package lastfm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	dbUtils "github.com/kitesi/music/db"
+	"github.com/kitesi/music/simpleconfig"
+)
+
+const MAX_SCROBBLES = 50
+
+type lastfmScrobbler struct {
+	credentials simpleconfig.Config
+	endpoint    string
+}
+
+func newLastfmScrobbler() (*lastfmScrobbler, error) {
+	credentials, err := setupOrGetCredentials()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &lastfmScrobbler{credentials: credentials, endpoint: API_END_POINT}, nil
+}
+
+func (s *lastfmScrobbler) Name() string {
+	return TARGET_LASTFM
+}
+
+func (s *lastfmScrobbler) BatchSize() int {
+	return MAX_SCROBBLES
+}
+
+func (s *lastfmScrobbler) Submit(plays []dbUtils.Play) ([]dbUtils.Play, []ignoredScrobble, error) {
+	recent, tooOld := splitTooOld(plays, time.Now())
+
+	if len(recent) == 0 {
+		return nil, tooOld, nil
+	}
+
+	response, err := s.scrobbleMultiple(recent)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accepted, ignored := splitScrobbleResults(recent, response)
+	return accepted, append(tooOld, ignored...), nil
+}
+
+// last.fm ignores scrobbles older than this
+const MAX_SCROBBLE_AGE = 14 * 24 * time.Hour
+
+// the code last.fm uses for "timestamp too old"
+const IGNORED_CODE_TOO_OLD = "3"
+
+// plays last.fm would reject for being too old aren't worth sending
+func splitTooOld(plays []dbUtils.Play, now time.Time) ([]dbUtils.Play, []ignoredScrobble) {
+	recent := []dbUtils.Play{}
+	tooOld := []ignoredScrobble{}
+
+	for _, play := range plays {
+		if now.Sub(play.StartTime) > MAX_SCROBBLE_AGE {
+			tooOld = append(tooOld, ignoredScrobble{play: play, code: IGNORED_CODE_TOO_OLD, message: "Timestamp too old (over 14 days)"})
+		} else {
+			recent = append(recent, play)
+		}
+	}
+
+	return recent, tooOld
+}
+
+// submits up to MAX_SCROBBLES plays in one request
+func (s *lastfmScrobbler) scrobbleMultiple(plays []dbUtils.Play) (PostMultipleScrobbleResponse, error) {
+	apiKey, _ := s.credentials.Get("api_key")
+	apiSecret, _ := s.credentials.Get("api_secret")
+	sessionKey, _ := s.credentials.Get("session_key")
+
+	params := url.Values{}
+	params.Set("method", "track.scrobble")
+	params.Set("api_key", apiKey)
+	params.Set("sk", sessionKey)
+
+	for i, play := range plays {
+		params.Set(fmt.Sprintf("album[%d]", i), play.Album)
+		params.Set(fmt.Sprintf("artist[%d]", i), play.Artist)
+		params.Set(fmt.Sprintf("track[%d]", i), play.Title)
+		params.Set(fmt.Sprintf("timestamp[%d]", i), strconv.FormatInt(play.StartTime.Unix(), 10))
+	}
+
+	params.Set("api_sig", generateSignature(params, apiSecret))
+	params.Set("format", "json")
+
+	resp, err := scrobbleClient.PostForm(s.endpoint, params)
+
+	if err != nil {
+		return PostMultipleScrobbleResponse{}, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		return PostMultipleScrobbleResponse{}, errors.New(resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return PostMultipleScrobbleResponse{}, err
+	}
+
+	var errorJson LastfmErrorResponse
+
+	if err := json.Unmarshal(body, &errorJson); err == nil && errorJson.Error != 0 {
+		return PostMultipleScrobbleResponse{}, fmt.Errorf("(%d) %s", errorJson.Error, errorJson.Message)
+	}
+
+	var resultJson PostMultipleScrobbleResponse
+
+	if err := json.Unmarshal(body, &resultJson); err != nil {
+		return PostMultipleScrobbleResponse{}, err
+	}
+
+	return resultJson, nil
+}
+
+// the results are in the same order as the submitted plays, if they don't
+// line up only the overall counts can be trusted
+func splitScrobbleResults(plays []dbUtils.Play, response PostMultipleScrobbleResponse) ([]dbUtils.Play, []ignoredScrobble) {
+	results := response.Scrobbles.Scrobble
+
+	if len(results) != len(plays) {
+		if response.Scrobbles.Attr.Accepted == len(plays) {
+			return plays, nil
+		}
+
+		return nil, nil
+	}
+
+	accepted := []dbUtils.Play{}
+	ignored := []ignoredScrobble{}
+
+	for i, result := range results {
+		if result.IgnoredMessage.Code == "" || result.IgnoredMessage.Code == "0" {
+			accepted = append(accepted, plays[i])
+		} else {
+			ignored = append(ignored, ignoredScrobble{play: plays[i], code: result.IgnoredMessage.Code, message: result.IgnoredMessage.Text})
+		}
+	}
+
+	return accepted, ignored
+}
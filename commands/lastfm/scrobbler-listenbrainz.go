@@ -0,0 +1,161 @@
+package lastfm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	dbUtils "github.com/kitesi/music/db"
+)
+
+// see https://listenbrainz.readthedocs.io/en/latest/users/api/core.html#post--1-submit-listens,
+// the api takes up to 1000 listens at once but there's no need for requests
+// that big
+const LISTENBRAINZ_MAX_LISTENS = 100
+
+type listenBrainzScrobbler struct {
+	url   string
+	token string
+}
+
+type listenBrainzListen struct {
+	ListenedAt    int64 `json:"listened_at"`
+	TrackMetadata struct {
+		ArtistName     string         `json:"artist_name"`
+		TrackName      string         `json:"track_name"`
+		ReleaseName    string         `json:"release_name,omitempty"`
+		AdditionalInfo map[string]any `json:"additional_info,omitempty"`
+	} `json:"track_metadata"`
+}
+
+type listenBrainzSubmission struct {
+	// "single" for one listen, "import" for more
+	ListenType string               `json:"listen_type"`
+	Payload    []listenBrainzListen `json:"payload"`
+}
+
+type listenBrainzResponse struct {
+	Status string `json:"status"`
+	Code   int    `json:"code"`
+	Error  string `json:"error"`
+}
+
+func (s *listenBrainzScrobbler) Name() string {
+	return TARGET_LISTENBRAINZ
+}
+
+func (s *listenBrainzScrobbler) BatchSize() int {
+	return LISTENBRAINZ_MAX_LISTENS
+}
+
+func (s *listenBrainzScrobbler) Submit(plays []dbUtils.Play) ([]dbUtils.Play, []ignoredScrobble, error) {
+	status, message, err := s.submitListens(plays)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if status == http.StatusOK {
+		return plays, nil, nil
+	}
+
+	// listenbrainz rejects the whole request if one listen is invalid, so
+	// it's only known which one it was if there's just one
+	if status == http.StatusBadRequest {
+		if len(plays) == 1 {
+			return nil, []ignoredScrobble{{play: plays[0], code: fmt.Sprint(status), message: message}}, nil
+		}
+
+		return s.submitOneByOne(plays)
+	}
+
+	return nil, nil, fmt.Errorf("listenbrainz - %s", message)
+}
+
+// so one bad listen in a batch doesn't hold back the rest forever
+func (s *listenBrainzScrobbler) submitOneByOne(plays []dbUtils.Play) ([]dbUtils.Play, []ignoredScrobble, error) {
+	accepted := []dbUtils.Play{}
+	ignored := []ignoredScrobble{}
+
+	for _, play := range plays {
+		playAccepted, playIgnored, err := s.Submit([]dbUtils.Play{play})
+
+		if err != nil {
+			if len(accepted) == 0 && len(ignored) == 0 {
+				return nil, nil, err
+			}
+
+			// the rest are left to retry later
+			break
+		}
+
+		accepted = append(accepted, playAccepted...)
+		ignored = append(ignored, playIgnored...)
+	}
+
+	return accepted, ignored, nil
+}
+
+// the status code and the error listenbrainz gave (or the status if it gave
+// none)
+func (s *listenBrainzScrobbler) submitListens(plays []dbUtils.Play) (int, string, error) {
+	submission := listenBrainzSubmission{ListenType: "import", Payload: []listenBrainzListen{}}
+
+	if len(plays) == 1 {
+		submission.ListenType = "single"
+	}
+
+	for _, play := range plays {
+		listen := listenBrainzListen{ListenedAt: play.StartTime.Unix()}
+		listen.TrackMetadata.ArtistName = play.Artist
+		listen.TrackMetadata.TrackName = play.Title
+		listen.TrackMetadata.ReleaseName = play.Album
+		listen.TrackMetadata.AdditionalInfo = map[string]any{"submission_client": "music"}
+
+		if play.Duration > 0 {
+			listen.TrackMetadata.AdditionalInfo["duration"] = play.Duration
+		}
+
+		submission.Payload = append(submission.Payload, listen)
+	}
+
+	body, err := json.Marshal(submission)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(s.url, "/")+"/1/submit-listens", bytes.NewReader(body))
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	req.Header.Set("Authorization", "Token "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := scrobbleClient.Do(req)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	var resultJson listenBrainzResponse
+	json.Unmarshal(responseBody, &resultJson)
+
+	if resultJson.Error != "" {
+		return resp.StatusCode, resultJson.Error, nil
+	}
+
+	return resp.StatusCode, resp.Status, nil
+}
@@ -0,0 +1,104 @@
+package lastfm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	dbUtils "github.com/kitesi/music/db"
+)
+
+// see https://github.com/krateng/maloja/blob/master/API.md, maloja only takes
+// one scrobble per request
+type malojaScrobbler struct {
+	url    string
+	apiKey string
+}
+
+type malojaScrobble struct {
+	Key    string `json:"key"`
+	Artist string `json:"artist"`
+	Title  string `json:"title"`
+	Album  string `json:"album,omitempty"`
+	Length int    `json:"length,omitempty"`
+	Time   int64  `json:"time"`
+}
+
+type malojaResponse struct {
+	Status string `json:"status"`
+	Error  struct {
+		Type string `json:"type"`
+		Desc string `json:"desc"`
+	} `json:"error"`
+}
+
+func (s *malojaScrobbler) Name() string {
+	return TARGET_MALOJA
+}
+
+func (s *malojaScrobbler) BatchSize() int {
+	return 1
+}
+
+func (s *malojaScrobbler) Submit(plays []dbUtils.Play) ([]dbUtils.Play, []ignoredScrobble, error) {
+	if len(plays) != 1 {
+		return nil, nil, fmt.Errorf("maloja - can only submit one scrobble at a time")
+	}
+
+	play := plays[0]
+	body, err := json.Marshal(malojaScrobble{
+		Key:    s.apiKey,
+		Artist: play.Artist,
+		Title:  play.Title,
+		Album:  play.Album,
+		Length: play.Duration,
+		Time:   play.StartTime.Unix(),
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := scrobbleClient.Post(strings.TrimSuffix(s.url, "/")+"/apis/mlj_1/newscrobble", "application/json", bytes.NewReader(body))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var resultJson malojaResponse
+	json.Unmarshal(responseBody, &resultJson)
+
+	if resp.StatusCode < 300 && resultJson.Status != "failure" {
+		return plays, nil, nil
+	}
+
+	message := resultJson.Error.Desc
+
+	if message == "" {
+		message = resp.Status
+	}
+
+	// a bad api key or a server error can be retried, anything else is about
+	// the scrobble itself
+	if resp.StatusCode == http.StatusBadRequest {
+		code := resultJson.Error.Type
+
+		if code == "" {
+			code = fmt.Sprint(resp.StatusCode)
+		}
+
+		return nil, []ignoredScrobble{{play: play, code: code, message: message}}, nil
+	}
+
+	return nil, nil, fmt.Errorf("maloja - %s", message)
+}
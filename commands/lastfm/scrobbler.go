@@ -0,0 +1,108 @@
+package lastfm
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	dbUtils "github.com/kitesi/music/db"
+	"github.com/kitesi/music/utils"
+)
+
+const (
+	TARGET_LASTFM       = "lastfm"
+	TARGET_LISTENBRAINZ = "listenbrainz"
+	TARGET_MALOJA       = "maloja"
+)
+
+// a service plays are scrobbled to
+type Scrobbler interface {
+	// what the plays' state for this target is stored as in the db
+	Name() string
+	// the most plays Submit takes at once
+	BatchSize() int
+	// plays that are neither accepted nor ignored (e.g. the response couldn't
+	// be matched up) are left to retry later. An error means none of them
+	// were submitted.
+	Submit(plays []dbUtils.Play) ([]dbUtils.Play, []ignoredScrobble, error)
+}
+
+// how long a target gets to answer, after that the plays are left for the
+// flusher to retry
+const SCROBBLE_TIMEOUT = 30 * time.Second
+
+// shared by every target, http.DefaultClient would wait forever on a server
+// that never answers
+var scrobbleClient = &http.Client{Timeout: SCROBBLE_TIMEOUT}
+
+type ignoredScrobble struct {
+	play    dbUtils.Play
+	code    string
+	message string
+}
+
+func toIgnoredPlays(scrobbles []ignoredScrobble) []dbUtils.IgnoredPlay {
+	plays := make([]dbUtils.IgnoredPlay, len(scrobbles))
+
+	for i, scrobble := range scrobbles {
+		plays[i] = dbUtils.IgnoredPlay{ID: scrobble.play.ID, Code: scrobble.code, Message: scrobble.message}
+	}
+
+	return plays
+}
+
+// lastfm asks for (and saves) its session the first time it's used
+func newScrobblers(targets []string, config utils.LastfmConfig) ([]Scrobbler, error) {
+	scrobblers := []Scrobbler{}
+	seen := map[string]bool{}
+
+	for _, target := range targets {
+		if seen[target] {
+			return nil, fmt.Errorf("target %s is listed more than once", target)
+		}
+
+		seen[target] = true
+
+		switch target {
+		case TARGET_LASTFM:
+			scrobbler, err := newLastfmScrobbler()
+
+			if err != nil {
+				return nil, err
+			}
+
+			scrobblers = append(scrobblers, scrobbler)
+		case TARGET_LISTENBRAINZ:
+			if config.ListenBrainz.Token == "" {
+				return nil, fmt.Errorf("listenbrainz needs a token, set lastfm.listenBrainz.token in the config")
+			}
+
+			scrobblers = append(scrobblers, &listenBrainzScrobbler{url: config.ListenBrainz.Url, token: config.ListenBrainz.Token})
+		case TARGET_MALOJA:
+			if config.Maloja.Url == "" || config.Maloja.ApiKey == "" {
+				return nil, fmt.Errorf("maloja needs a url and an api key, set lastfm.maloja in the config")
+			}
+
+			scrobblers = append(scrobblers, &malojaScrobbler{url: config.Maloja.Url, apiKey: config.Maloja.ApiKey})
+		default:
+			return nil, fmt.Errorf("invalid target %s, expected value of 'lastfm'|'listenbrainz'|'maloja'", target)
+		}
+	}
+
+	if len(scrobblers) == 0 {
+		return nil, fmt.Errorf("no targets to scrobble to")
+	}
+
+	return scrobblers, nil
+}
+
+// the lastfm scrobbler if it's one of the targets
+func getLastfmScrobbler(scrobblers []Scrobbler) *lastfmScrobbler {
+	for _, scrobbler := range scrobblers {
+		if lastfm, ok := scrobbler.(*lastfmScrobbler); ok {
+			return lastfm
+		}
+	}
+
+	return nil
+}
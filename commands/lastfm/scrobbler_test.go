@@ -0,0 +1,447 @@
+package lastfm
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dbUtils "github.com/kitesi/music/db"
+	"github.com/kitesi/music/simpleconfig"
+)
+
+// a scrobbling server that answers with whatever respond returns and keeps
+// the request bodies
+type fakeTarget struct {
+	mu      sync.Mutex
+	respond func(r *http.Request, body string) (int, string)
+	bodies  []string
+}
+
+func startFakeTarget(t *testing.T, respond func(r *http.Request, body string) (int, string)) (*fakeTarget, string) {
+	t.Helper()
+	target := &fakeTarget{respond: respond}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		body, _ := io.ReadAll(r.Body)
+
+		target.mu.Lock()
+		target.bodies = append(target.bodies, string(body))
+		respond := target.respond
+		target.mu.Unlock()
+
+		status, response := respond(r, string(body))
+		w.WriteHeader(status)
+		io.WriteString(w, response)
+	}))
+
+	t.Cleanup(server.Close)
+	return target, server.URL
+}
+
+func (f *fakeTarget) requests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.bodies)
+}
+
+func (f *fakeTarget) setRespond(respond func(r *http.Request, body string) (int, string)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.respond = respond
+}
+
+func always(status int, response string) func(r *http.Request, body string) (int, string) {
+	return func(r *http.Request, body string) (int, string) {
+		return status, response
+	}
+}
+
+func testPlays(titles ...string) []dbUtils.Play {
+	plays := []dbUtils.Play{}
+
+	for i, title := range titles {
+		plays = append(plays, dbUtils.Play{
+			ID:        int64(i + 1),
+			Artist:    "Nujabes",
+			Album:     "Modal Soul",
+			Title:     title,
+			Duration:  215,
+			StartTime: time.Now().Add(-time.Hour).Truncate(time.Second),
+		})
+	}
+
+	return plays
+}
+
+func titlesOf(plays []dbUtils.Play) string {
+	titles := []string{}
+
+	for _, play := range plays {
+		titles = append(titles, play.Title)
+	}
+
+	return strings.Join(titles, ",")
+}
+
+func ignoredTitlesOf(scrobbles []ignoredScrobble) string {
+	titles := []string{}
+
+	for _, scrobble := range scrobbles {
+		titles = append(titles, scrobble.play.Title+"="+scrobble.code)
+	}
+
+	return strings.Join(titles, ",")
+}
+
+type scrobblerTest struct {
+	name    string
+	respond func(r *http.Request, body string) (int, string)
+	plays   []string
+	// comma separated titles, ignored ones with their code
+	wantAccepted string
+	wantIgnored  string
+	wantErr      bool
+	wantRequests int
+}
+
+func runScrobblerTests(t *testing.T, tests []scrobblerTest, newScrobbler func(t *testing.T, url string) Scrobbler) {
+	t.Helper()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, url := startFakeTarget(t, test.respond)
+			accepted, ignored, err := newScrobbler(t, url).Submit(testPlays(test.plays...))
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Submit returned error %v, want error %t", err, test.wantErr)
+			}
+
+			if got := titlesOf(accepted); got != test.wantAccepted {
+				t.Errorf("accepted %q, want %q", got, test.wantAccepted)
+			}
+
+			if got := ignoredTitlesOf(ignored); got != test.wantIgnored {
+				t.Errorf("ignored %q, want %q", got, test.wantIgnored)
+			}
+
+			// the scrobblers never retry on their own, that's up to the flusher
+			if got := target.requests(); got != test.wantRequests {
+				t.Errorf("sent %d requests, want %d", got, test.wantRequests)
+			}
+		})
+	}
+}
+
+func newTestLastfmScrobbler(t *testing.T, url string) Scrobbler {
+	t.Helper()
+	credentialsPath := filepath.Join(t.TempDir(), "credentials")
+
+	if err := os.WriteFile(credentialsPath, []byte("api_key=key\napi_secret=secret\nsession_key=session\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	credentials, err := simpleconfig.NewConfig(credentialsPath, []string{"api_key", "api_secret", "session_key", "username"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &lastfmScrobbler{credentials: credentials, endpoint: url}
+}
+
+func TestLastfmScrobbler(t *testing.T) {
+	runScrobblerTests(t, []scrobblerTest{
+		{
+			name: "accepted and ignored",
+			respond: func(r *http.Request, body string) (int, string) {
+				if r.FormValue("method") != "track.scrobble" || r.FormValue("sk") != "session" || r.FormValue("track[1]") != "Feather" || r.FormValue("api_sig") == "" {
+					return http.StatusBadRequest, `{"error":6,"message":"Invalid parameters"}`
+				}
+
+				return http.StatusOK, `{"scrobbles":{"scrobble":[
+					{"ignoredMessage":{"code":"0","#text":""}},
+					{"ignoredMessage":{"code":"1","#text":"Artist was ignored"}}
+				],"@attr":{"accepted":1,"ignored":1}}}`
+			},
+			plays:        []string{"Luv(sic)", "Feather"},
+			wantAccepted: "Luv(sic)",
+			wantIgnored:  "Feather=1",
+			wantRequests: 1,
+		},
+		{
+			name:         "a single result",
+			respond:      always(http.StatusOK, `{"scrobbles":{"scrobble":{"ignoredMessage":{"code":"0","#text":""}},"@attr":{"accepted":1,"ignored":0}}}`),
+			plays:        []string{"Luv(sic)"},
+			wantAccepted: "Luv(sic)",
+			wantRequests: 1,
+		},
+		{
+			name:         "an error in the body",
+			respond:      always(http.StatusOK, `{"error":11,"message":"Service Offline"}`),
+			plays:        []string{"Luv(sic)"},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			// last.fm only answers 4xx for the session or the api key, never
+			// for a scrobble, so they're kept for later
+			name:         "client error",
+			respond:      always(http.StatusForbidden, `{"error":9,"message":"Invalid session key"}`),
+			plays:        []string{"Luv(sic)", "Feather"},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:         "server error",
+			respond:      always(http.StatusServiceUnavailable, ""),
+			plays:        []string{"Luv(sic)"},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}, newTestLastfmScrobbler)
+}
+
+func TestLastfmScrobblerSkipsOldPlays(t *testing.T) {
+	target, url := startFakeTarget(t, always(http.StatusOK, ""))
+	plays := testPlays("Luv(sic)")
+	plays[0].StartTime = time.Now().Add(-MAX_SCROBBLE_AGE - time.Hour)
+
+	accepted, ignored, err := newTestLastfmScrobbler(t, url).Submit(plays)
+
+	if err != nil || len(accepted) != 0 || ignoredTitlesOf(ignored) != "Luv(sic)="+IGNORED_CODE_TOO_OLD {
+		t.Errorf("Submit = %v, %v, %v, want the play ignored as too old", accepted, ignored, err)
+	}
+
+	if target.requests() != 0 {
+		t.Errorf("a play that's too old was sent to last.fm")
+	}
+}
+
+// rejects the whole request if any listen is titled "bad"
+func listenBrainzRespond(r *http.Request, body string) (int, string) {
+	if r.Header.Get("Authorization") != "Token token" {
+		return http.StatusUnauthorized, `{"code":401,"error":"Invalid authorization token."}`
+	}
+
+	var submission listenBrainzSubmission
+
+	if err := json.Unmarshal([]byte(body), &submission); err != nil {
+		return http.StatusBadRequest, `{"code":400,"error":"Invalid JSON document submitted."}`
+	}
+
+	if (submission.ListenType == "single") != (len(submission.Payload) == 1) {
+		return http.StatusBadRequest, `{"code":400,"error":"wrong listen type"}`
+	}
+
+	for _, listen := range submission.Payload {
+		if listen.TrackMetadata.TrackName == "bad" {
+			return http.StatusBadRequest, `{"code":400,"error":"bad listen"}`
+		}
+	}
+
+	return http.StatusOK, `{"status":"ok"}`
+}
+
+func TestListenBrainzScrobbler(t *testing.T) {
+	runScrobblerTests(t, []scrobblerTest{
+		{
+			name:         "single",
+			respond:      listenBrainzRespond,
+			plays:        []string{"Luv(sic)"},
+			wantAccepted: "Luv(sic)",
+			wantRequests: 1,
+		},
+		{
+			name:         "import",
+			respond:      listenBrainzRespond,
+			plays:        []string{"Luv(sic)", "Feather"},
+			wantAccepted: "Luv(sic),Feather",
+			wantRequests: 1,
+		},
+		{
+			name:         "a bad listen",
+			respond:      listenBrainzRespond,
+			plays:        []string{"bad"},
+			wantIgnored:  "bad=400",
+			wantRequests: 1,
+		},
+		{
+			// the batch, then each listen on its own to find the bad one
+			name:         "a bad listen in a batch",
+			respond:      listenBrainzRespond,
+			plays:        []string{"Luv(sic)", "bad", "Feather"},
+			wantAccepted: "Luv(sic),Feather",
+			wantIgnored:  "bad=400",
+			wantRequests: 4,
+		},
+		{
+			name:         "unauthorized",
+			respond:      always(http.StatusUnauthorized, `{"code":401,"error":"Invalid authorization token."}`),
+			plays:        []string{"Luv(sic)"},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:         "server error",
+			respond:      always(http.StatusInternalServerError, ""),
+			plays:        []string{"Luv(sic)", "Feather"},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}, func(t *testing.T, url string) Scrobbler {
+		return &listenBrainzScrobbler{url: url + "/", token: "token"}
+	})
+}
+
+func TestMalojaScrobbler(t *testing.T) {
+	runScrobblerTests(t, []scrobblerTest{
+		{
+			name: "accepted",
+			respond: func(r *http.Request, body string) (int, string) {
+				var scrobble malojaScrobble
+
+				if r.URL.Path != "/apis/mlj_1/newscrobble" || json.Unmarshal([]byte(body), &scrobble) != nil || scrobble.Key != "key" || scrobble.Length != 215 {
+					return http.StatusNotFound, ""
+				}
+
+				return http.StatusOK, `{"status":"success"}`
+			},
+			plays:        []string{"Luv(sic)"},
+			wantAccepted: "Luv(sic)",
+			wantRequests: 1,
+		},
+		{
+			name:         "rejected scrobble",
+			respond:      always(http.StatusBadRequest, `{"status":"failure","error":{"type":"missing_scrobble_data","desc":"no title"}}`),
+			plays:        []string{"Luv(sic)"},
+			wantIgnored:  "Luv(sic)=missing_scrobble_data",
+			wantRequests: 1,
+		},
+		{
+			name:         "failure with a success status",
+			respond:      always(http.StatusOK, `{"status":"failure","error":{"type":"x","desc":"y"}}`),
+			plays:        []string{"Luv(sic)"},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:         "bad api key",
+			respond:      always(http.StatusForbidden, `{"status":"failure","error":{"type":"authentication_fail","desc":"bad key"}}`),
+			plays:        []string{"Luv(sic)"},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:         "server error",
+			respond:      always(http.StatusBadGateway, ""),
+			plays:        []string{"Luv(sic)"},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}, func(t *testing.T, url string) Scrobbler {
+		return &malojaScrobbler{url: url, apiKey: "key"}
+	})
+}
+
+func TestNextFlushWait(t *testing.T) {
+	interval := time.Minute
+	wait := time.Duration(0)
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour}
+
+	for i, wantWait := range want {
+		wait = nextFlushWait(wait, interval, true)
+
+		if wait != wantWait {
+			t.Fatalf("wait after %d failures = %s, want %s", i+1, wait, wantWait)
+		}
+	}
+
+	if wait = nextFlushWait(wait, interval, false); wait != interval {
+		t.Errorf("wait after a success = %s, want %s", wait, interval)
+	}
+}
+
+func TestFlusherRetries(t *testing.T) {
+	db, err := dbUtils.OpenDB(filepath.Join(t.TempDir(), "plays.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	if err := dbUtils.RunMigrations(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, play := range testPlays("Luv(sic)", "bad") {
+		err := dbUtils.InsertIntoPlays(db, dbUtils.InsertIntoPlaysParams{
+			Scrobbable:     true,
+			Album:          play.Album,
+			Artist:         play.Artist,
+			Title:          play.Title,
+			StartTime:      play.StartTime,
+			OriginalAlbum:  play.Album,
+			OriginalArtist: play.Artist,
+			OriginalTitle:  play.Title,
+			Targets:        []dbUtils.PlayTarget{{Target: TARGET_LISTENBRAINZ}},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target, url := startFakeTarget(t, always(http.StatusServiceUnavailable, ""))
+	logger := log.New(io.Discard, "", 0)
+	f := newFlusher(db, []Scrobbler{&listenBrainzScrobbler{url: url, token: "token"}}, nil, time.Minute, logger, logger)
+
+	unfulfilled := func() string {
+		plays, err := dbUtils.GetUnfulfilledPlays(db, TARGET_LISTENBRAINZ)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return titlesOf(plays)
+	}
+
+	// a server error keeps every play for the next attempt
+	if err := f.flush(); err == nil {
+		t.Errorf("flush should fail while the server errors")
+	}
+
+	if got := unfulfilled(); got != "Luv(sic),bad" {
+		t.Errorf("unfulfilled after a server error = %q, want both plays", got)
+	}
+
+	target.setRespond(listenBrainzRespond)
+
+	if err := f.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := unfulfilled(); got != "" {
+		t.Errorf("unfulfilled after the server came back = %q, want none", got)
+	}
+
+	// the rejected play isn't sent again
+	requests := target.requests()
+
+	if err := f.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if target.requests() != requests {
+		t.Errorf("flush sent %d more requests with nothing left to scrobble", target.requests()-requests)
+	}
+}
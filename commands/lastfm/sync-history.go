@@ -0,0 +1,339 @@
+package lastfm
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	dbUtils "github.com/kitesi/music/db"
+	"github.com/kitesi/music/library"
+	"github.com/kitesi/music/utils"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// the most user.getRecentTracks returns per page
+	SYNC_HISTORY_PAGE_SIZE = 200
+	// stay well under lastfm's rate limit
+	SYNC_HISTORY_PAGE_DELAY = 250 * time.Millisecond
+	SYNC_HISTORY_SOURCE     = "lastfm-import"
+)
+
+func SyncHistorySetup() *cobra.Command {
+	args := LastfmSyncHistoryArgs{}
+
+	config, err := utils.GetConfig()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+	}
+
+	lastfmCommand := &cobra.Command{
+		Use:   "sync-history [log-db-file]",
+		Short: "Import your lastfm history into a database file",
+		Long:  "Import every scrobble on lastfm that isn't in the database file yet. It can be stopped at any point, running it again continues where it was.",
+		Args:  cobra.RangeArgs(0, 1),
+		Run: func(cmd *cobra.Command, positional []string) {
+			logDbFile := config.LastFm.LogDbFile
+			if len(positional) == 1 {
+				logDbFile = positional[0]
+			}
+
+			if logDbFile == "" {
+				fmt.Fprintln(os.Stderr, "error: log db file not provided and not set in config")
+				return
+			}
+
+			if err := syncHistoryRunner(logDbFile, &args); err != nil {
+				if args.debug {
+					fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+				} else {
+					fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				}
+			}
+		},
+	}
+
+	lastfmCommand.Flags().StringVarP(&args.username, "username", "u", "", "lastfm user to import, instead of the one in the credentials file")
+	lastfmCommand.Flags().BoolVar(&args.restart, "restart", false, "go through the whole history again instead of only what's new")
+	lastfmCommand.Flags().StringVarP(&args.musicPath, "music-path", "m", config.MusicPath, "the music path to look up how long the songs are in")
+	lastfmCommand.Flags().BoolVarP(&args.debug, "debug", "d", config.Debug, "set debug mode")
+	return lastfmCommand
+}
+
+func getRecentTracksPage(apiKey string, apiSecret string, username string, from int64, to int64, page int) (GetRecentTracksResponse, error) {
+	params := url.Values{}
+	params.Set("method", "user.getRecentTracks")
+	params.Set("user", username)
+	params.Set("api_key", apiKey)
+	params.Set("limit", fmt.Sprint(SYNC_HISTORY_PAGE_SIZE))
+	params.Set("page", fmt.Sprint(page))
+	params.Set("to", fmt.Sprint(to))
+
+	if from > 0 {
+		params.Set("from", fmt.Sprint(from))
+	}
+
+	params.Set("api_sig", generateSignature(params, apiSecret))
+	params.Set("format", "json")
+
+	resp, err := scrobbleClient.PostForm(API_END_POINT, params)
+
+	if err != nil {
+		return GetRecentTracksResponse{}, err
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return GetRecentTracksResponse{}, err
+	}
+
+	var errorJson LastfmErrorResponse
+
+	if err := json.Unmarshal(body, &errorJson); err == nil && errorJson.Error != 0 {
+		return GetRecentTracksResponse{}, fmt.Errorf("(%d) %s", errorJson.Error, errorJson.Message)
+	}
+
+	if resp.StatusCode > 299 {
+		return GetRecentTracksResponse{}, errors.New(resp.Status)
+	}
+
+	var resultJson GetRecentTracksResponse
+
+	if err := json.Unmarshal(body, &resultJson); err != nil {
+		return GetRecentTracksResponse{}, err
+	}
+
+	return resultJson, nil
+}
+
+// plays are the same if the artist, title (ignoring case) and the second they
+// started at are
+func syncHistoryKey(artist string, title string, startTime time.Time) string {
+	return songKey(artist, title) + "\x00" + fmt.Sprint(startTime.Unix())
+}
+
+func songKey(artist string, title string) string {
+	return strings.ToLower(artist) + "\x00" + strings.ToLower(title)
+}
+
+// how long the songs in the library are in seconds, by artist and title
+func getSongDurations(musicPath string) (map[string]int, error) {
+	durations := map[string]int{}
+
+	if musicPath == "" {
+		return durations, nil
+	}
+
+	songs, err := library.GetSongs(musicPath)
+
+	if err != nil {
+		return durations, err
+	}
+
+	for _, song := range songs {
+		if song.Artist != "" && song.Title != "" && song.Duration > 0 {
+			durations[songKey(song.Artist, song.Title)] = int(song.Duration)
+		}
+	}
+
+	return durations, nil
+}
+
+// adds the page's scrobbles that aren't in the db yet, returns how many
+// were added and how many were already there. Lastfm doesn't say how long a
+// play was, so songs that are in the library count as listened to in full.
+func syncHistoryPage(db *sql.DB, response GetRecentTracksResponse, known map[string]bool, durations map[string]int) (int, int, error) {
+	added := 0
+	existing := 0
+
+	for _, track := range response.RecentTracks.Track {
+		if track.Attr.NowPlaying == "true" || track.Date.Uts == "" {
+			continue
+		}
+
+		uts, err := strconv.ParseInt(track.Date.Uts, 10, 64)
+
+		if err != nil {
+			return added, existing, fmt.Errorf("invalid timestamp for %s - %s: %s", track.Artist.Text, track.Name, track.Date.Uts)
+		}
+
+		startTime := time.Unix(uts, 0)
+		key := syncHistoryKey(track.Artist.Text, track.Name, startTime)
+
+		if known[key] {
+			existing++
+			continue
+		}
+
+		duration := durations[songKey(track.Artist.Text, track.Name)]
+
+		// it's on lastfm already, and the other targets only get plays
+		// from while they were enabled
+		err = dbUtils.InsertIntoPlays(db, dbUtils.InsertIntoPlaysParams{
+			Scrobbable:     true,
+			Album:          track.Album.Text,
+			Artist:         track.Artist.Text,
+			Title:          track.Name,
+			Duration:       duration,
+			ListenTime:     duration,
+			WallTime:       duration,
+			MaxPosition:    duration,
+			UniqueCoverage: duration,
+			StartTime:      startTime,
+			Source:         SYNC_HISTORY_SOURCE,
+			OriginalAlbum:  track.Album.Text,
+			OriginalArtist: track.Artist.Text,
+			OriginalTitle:  track.Name,
+			Targets:        []dbUtils.PlayTarget{{Target: TARGET_LASTFM, Fulfilled: true}},
+		})
+
+		if err != nil {
+			return added, existing, err
+		}
+
+		known[key] = true
+		added++
+	}
+
+	return added, existing, nil
+}
+
+/*
+   The history is paged through newest first in a fixed window (pass_from to
+   pass_to), so scrobbles made while it runs don't shift the pages. The page
+   it's on is saved after each one, and once the window is done everything up
+   to pass_to is synced and the next run only asks for what came after it.
+   A page that got cut off halfway is just asked for again, the plays already
+   in the db are skipped.
+*/
+
+func syncHistoryRunner(filename string, args *LastfmSyncHistoryArgs) error {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return fmt.Errorf("file %s does not exist", filename)
+	}
+
+	credentials, err := setupOrGetCredentials()
+
+	if err != nil {
+		return err
+	}
+
+	username := args.username
+
+	if username == "" {
+		username, _ = credentials.Get("username")
+	}
+
+	if username == "" {
+		return fmt.Errorf("username is required - not provided in credentials file or as a flag")
+	}
+
+	apiKey, _ := credentials.Get("api_key")
+	apiSecret, _ := credentials.Get("api_secret")
+
+	db, err := dbUtils.OpenDB(filename)
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	if err := dbUtils.RunMigrations(db); err != nil {
+		return fmt.Errorf("could not run migrations on log db file: %s", err.Error())
+	}
+
+	state, err := dbUtils.GetSyncHistoryState(db, username)
+
+	if err != nil {
+		return err
+	}
+
+	if args.restart {
+		state = dbUtils.SyncHistoryState{Username: username}
+	}
+
+	if state.NextPage == 0 {
+		state.PassFrom = state.SyncedTo
+		state.PassTo = time.Now().Unix()
+		state.NextPage = 1
+
+		if err := dbUtils.SaveSyncHistoryState(db, state); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("continuing the last sync from page %d\n", state.NextPage)
+	}
+
+	plays, err := dbUtils.GetPlays(db)
+
+	if err != nil {
+		return err
+	}
+
+	durations, err := getSongDurations(args.musicPath)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not read the library, imported plays won't have a duration: %s\n", err)
+	}
+
+	known := map[string]bool{}
+
+	for _, play := range plays {
+		known[syncHistoryKey(play.Artist, play.Title, play.StartTime)] = true
+	}
+
+	totalAdded := 0
+
+	for {
+		response, err := getRecentTracksPage(apiKey, apiSecret, username, state.PassFrom, state.PassTo, state.NextPage)
+
+		if err != nil {
+			return fmt.Errorf("could not get page %d: %s", state.NextPage, err.Error())
+		}
+
+		added, existing, err := syncHistoryPage(db, response, known, durations)
+		totalAdded += added
+
+		if err != nil {
+			return err
+		}
+
+		totalPages, _ := strconv.Atoi(response.RecentTracks.Attr.TotalPages)
+		fmt.Printf("page %d of %d: %d new, %d already in the db\n", state.NextPage, max(totalPages, 1), added, existing)
+
+		if state.NextPage >= totalPages || len(response.RecentTracks.Track) == 0 {
+			break
+		}
+
+		state.NextPage++
+
+		if err := dbUtils.SaveSyncHistoryState(db, state); err != nil {
+			return err
+		}
+
+		time.Sleep(SYNC_HISTORY_PAGE_DELAY)
+	}
+
+	state.SyncedTo = state.PassTo
+	state.PassFrom = 0
+	state.PassTo = 0
+	state.NextPage = 0
+
+	if err := dbUtils.SaveSyncHistoryState(db, state); err != nil {
+		return err
+	}
+
+	fmt.Printf("added %d plays, synced up to %s\n", totalAdded, time.Unix(state.SyncedTo, 0).Format(time.DateTime))
+	return nil
+}
@@ -0,0 +1,110 @@
+package lastfm
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	dbUtils "github.com/kitesi/music/db"
+)
+
+func TestRecentTracksUnmarshal(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		names []string
+	}{
+		{"list", `{"recenttracks":{"track":[{"name":"Geyser"},{"name":"Happy"}]}}`, []string{"Geyser", "Happy"}},
+		{"single track", `{"recenttracks":{"track":{"name":"Geyser"}}}`, []string{"Geyser"}},
+		{"empty", `{"recenttracks":{"track":[]}}`, []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var response GetRecentTracksResponse
+
+			if err := json.Unmarshal([]byte(test.json), &response); err != nil {
+				t.Fatal(err)
+			}
+
+			tracks := response.RecentTracks.Track
+
+			if len(tracks) != len(test.names) {
+				t.Fatalf("got %d tracks, want %d", len(tracks), len(test.names))
+			}
+
+			for i, name := range test.names {
+				if tracks[i].Name != name {
+					t.Errorf("track %d is %q, want %q", i, tracks[i].Name, name)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncHistoryPage(t *testing.T) {
+	db, err := dbUtils.OpenDB(filepath.Join(t.TempDir(), "plays.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	if err := dbUtils.RunMigrations(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var response GetRecentTracksResponse
+
+	err = json.Unmarshal([]byte(`{"recenttracks":{"track":[
+		{"artist":{"#text":"Mitski"},"name":"Geyser","@attr":{"nowplaying":"true"}},
+		{"artist":{"#text":"MITSKI"},"name":"geyser","date":{"uts":"1700000200"}},
+		{"artist":{"#text":"Nujabes"},"name":"Not In The Library","date":{"uts":"1700000100"}},
+		{"artist":{"#text":"Mitski"},"name":"Geyser","date":{"uts":"1700000000"}}
+	]}}`), &response)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	durations := map[string]int{songKey("Mitski", "Geyser"): 143}
+	known := map[string]bool{}
+
+	// the track playing right now is skipped, the others are new
+	added, existing, err := syncHistoryPage(db, response, known, durations)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if added != 3 || existing != 0 {
+		t.Errorf("added %d and found %d, want 3 and 0", added, existing)
+	}
+
+	if added, existing, _ = syncHistoryPage(db, response, known, durations); added != 0 || existing != 3 {
+		t.Errorf("the second time added %d and found %d, want 0 and 3", added, existing)
+	}
+
+	plays, err := dbUtils.GetPlays(db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"geyser": 143, "Geyser": 143, "Not In The Library": 0}
+
+	for _, play := range plays {
+		if play.Source != SYNC_HISTORY_SOURCE {
+			t.Errorf("%s has source %q", play.Title, play.Source)
+		}
+
+		if play.Duration != want[play.Title] || play.ListenTime != want[play.Title] || play.UniqueCoverage != want[play.Title] {
+			t.Errorf("%s has duration %d, listen time %d and coverage %d, want %d", play.Title, play.Duration, play.ListenTime, play.UniqueCoverage, want[play.Title])
+		}
+	}
+
+	if len(plays) != 3 {
+		t.Errorf("got %d plays, want 3", len(plays))
+	}
+}
@@ -1,6 +1,7 @@
 package lastfm
 
 import (
+	"encoding/json"
 	"sort"
 	"time"
 )
@@ -23,82 +24,133 @@ type GetSessionResponse struct {
 	Error   int
 }
 
-type PostScrobbleResponse struct {
-	Scrobbles struct {
-		Scrobble struct {
-			Artist struct {
-				Text      string `json:"#text"`
-				Corrected string
-			}
-			Album struct {
-				Text      string `json:"#text"`
-				Corrected string
-			}
-			Track struct {
-				Text      string `json:"#text"`
-				Corrected string
-			}
-			AlbumArtist struct {
-				Text      string `json:"#text"`
-				Corrected string
-			}
-			IgnoredMessage struct {
-				Code string
-				Text string `json:"#text"`
-			}
-			Timestamp string
+// what last.fm sends instead of the usual response when a request fails
+type LastfmErrorResponse struct {
+	Error   int
+	Message string
+}
+
+type UpdateNowPlayingResponse struct {
+	NowPlaying struct {
+		IgnoredMessage struct {
+			Code string
+			Text string `json:"#text"`
 		}
-		Attr struct {
-			Ignored  int
-			Accepted int
-		} `json:"@attr"`
 	}
 }
 
+type ScrobbleResult struct {
+	Artist struct {
+		Text      string `json:"#text"`
+		Corrected string
+	}
+	Album struct {
+		Text      string `json:"#text"`
+		Corrected string
+	}
+	Track struct {
+		Text      string `json:"#text"`
+		Corrected string
+	}
+	AlbumArtist struct {
+		Text      string `json:"#text"`
+		Corrected string
+	}
+	IgnoredMessage struct {
+		Code string
+		Text string `json:"#text"`
+	}
+	Timestamp string
+}
+
+// last.fm sends a single object instead of a list when only one track was
+// scrobbled
+type ScrobbleResults []ScrobbleResult
+
+func (r *ScrobbleResults) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		var result ScrobbleResult
+
+		if err := json.Unmarshal(data, &result); err != nil {
+			return err
+		}
+
+		*r = ScrobbleResults{result}
+		return nil
+	}
+
+	var results []ScrobbleResult
+
+	if err := json.Unmarshal(data, &results); err != nil {
+		return err
+	}
+
+	*r = results
+	return nil
+}
+
 type PostMultipleScrobbleResponse struct {
 	Scrobbles struct {
-		Scrobble []struct {
-			Artist struct {
-				Text      string `json:"#text"`
-				Corrected string
-			}
-			Album struct {
-				Text      string `json:"#text"`
-				Corrected string
-			}
-			Track struct {
-				Text      string `json:"#text"`
-				Corrected string
-			}
-			AlbumArtist struct {
-				Text      string `json:"#text"`
-				Corrected string
-			}
-			IgnoredMessage struct {
-				Code string
-				Text string `json:"#text"`
-			}
-			Timestamp string
-		}
-		Attr struct {
+		Scrobble ScrobbleResults
+		Attr     struct {
 			Ignored  int
 			Accepted int
 		} `json:"@attr"`
 	}
 }
 
+type RecentTrack struct {
+	Artist struct {
+		Text string `json:"#text"`
+	}
+	Album struct {
+		Text string `json:"#text"`
+	}
+	Name string
+	Date struct {
+		Uts  string `json:"uts"`
+		Text string `json:"#text"`
+	}
+	// the track playing right now has no date
+	Attr struct {
+		NowPlaying string `json:"nowplaying"`
+	} `json:"@attr"`
+}
+
+// same as ScrobbleResults, a page with one track has it as a single object
+type RecentTracks []RecentTrack
+
+func (r *RecentTracks) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		var track RecentTrack
+
+		if err := json.Unmarshal(data, &track); err != nil {
+			return err
+		}
+
+		*r = RecentTracks{track}
+		return nil
+	}
+
+	var tracks []RecentTrack
+
+	if err := json.Unmarshal(data, &tracks); err != nil {
+		return err
+	}
+
+	*r = tracks
+	return nil
+}
+
 type GetRecentTracksResponse struct {
 	RecentTracks struct {
-		Track []struct {
-			Artist struct {
-				Text string `json:"#text"`
-			}
-			Name string
-			Date struct {
-				Uts  string `json:"uts"`
-				Text string `json:"#text"`
-			}
-		}
+		Track RecentTracks
+		// numbers as strings
+		Attr struct {
+			Page       string `json:"page"`
+			TotalPages string `json:"totalPages"`
+			Total      string `json:"total"`
+		} `json:"@attr"`
 	}
 }
 
@@ -130,6 +182,7 @@ type CurrentTrackInfo struct {
 	Artist   string
 	Album    string
 	Duration float64
+	TrackId  string
 
 	StartTime  time.Time
 	LastUpdate time.Time
@@ -203,12 +256,17 @@ func (cti *CurrentTrackInfo) UniqueCoverageAndMaxPosition() (float64, float64) {
 }
 
 type LastfmWatchArgs struct {
-	interval       int
-	minTrackLength int
-	minListenTime  int
-	debug          bool
-	logDbFile      string
-	source         string
+	interval           int
+	flushInterval      int
+	nowPlaying         bool
+	nowPlayingInterval int
+	minTrackLength     int
+	minListenTime      int
+	debug              bool
+	logDbFile          string
+	source             string
+	players            []string
+	targets            []string
 }
 
 type LastfmSuggestArgs struct {
@@ -227,6 +285,22 @@ type LastfmRecentArgs struct {
 	json     bool
 }
 
+type LastfmRulesTestArgs struct {
+	debug     bool
+	album     string
+	rulesFile string
+}
+
+type LastfmSyncHistoryArgs struct {
+	debug     bool
+	username  string
+	restart   bool
+	musicPath string
+}
+
 type LastfmImportArgs struct {
-	debug bool
+	debug   bool
+	yes     bool
+	json    bool
+	targets []string
 }
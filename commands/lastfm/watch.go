@@ -3,7 +3,6 @@ package lastfm
 import (
 	"crypto/md5"
 	"database/sql"
-	"math"
 	"syscall"
 
 	"encoding/hex"
@@ -19,13 +18,12 @@ import (
 	"os/signal"
 	"path"
 	"sort"
-	"strconv"
-	"strings"
 	"time"
 
 	// import Config from here as SimpleConfig
 
 	dbUtils "github.com/kitesi/music/db"
+	"github.com/kitesi/music/mpris"
 	"github.com/kitesi/music/simpleconfig"
 	"github.com/kitesi/music/utils"
 	"github.com/spf13/cobra"
@@ -41,7 +39,7 @@ func WatchSetup() *cobra.Command {
 	lastfmCommand := &cobra.Command{
 		Use:   "watch",
 		Short: "Scrobble tracks to last.fm",
-		Long:  "Watch for tracks playing in VLC and scrobble them to last.fm",
+		Long:  "Watch for tracks playing in mpris players (VLC by default) and scrobble them to last.fm, ListenBrainz or Maloja",
 		Args:  cobra.ExactArgs(0),
 		Run: func(cmd *cobra.Command, positional []string) {
 			if err := watchRunner(&args); err != nil {
@@ -60,11 +58,16 @@ func WatchSetup() *cobra.Command {
 		fmt.Fprintf(os.Stderr, "error: %+v\n", err)
 	}
 
-	lastfmCommand.Flags().IntVarP(&args.interval, "interval", "i", config.LastFm.Interval, "interval in seconds to check for new tracks")
+	lastfmCommand.Flags().IntVarP(&args.interval, "interval", "i", config.LastFm.Interval, "interval in seconds to check the position (and for new tracks if the player can't send events)")
+	lastfmCommand.Flags().IntVar(&args.flushInterval, "flush-interval", config.LastFm.FlushInterval, "interval in seconds to retry scrobbles that failed to send (needs --log-db-file), 0 to disable")
+	lastfmCommand.Flags().BoolVar(&args.nowPlaying, "now-playing", config.LastFm.NowPlaying, "send the current track to last.fm as now playing")
+	lastfmCommand.Flags().IntVar(&args.nowPlayingInterval, "now-playing-interval", config.LastFm.NowPlayingInterval, "the least seconds between now playing updates")
 	lastfmCommand.Flags().StringVar(&args.logDbFile, "log-db-file", config.LastFm.LogDbFile, "sqlite database file to log scrobbles to")
 	lastfmCommand.Flags().IntVar(&args.minTrackLength, "min-track-length", config.LastFm.MinTrackLength, "the minimum track length to scrobble")
 	lastfmCommand.Flags().IntVar(&args.minListenTime, "min-listen-length", config.LastFm.MinListenTime, "the minimum listem time to scrobble (as a shorter alternative to half way through the track)")
-	lastfmCommand.Flags().StringVar(&args.source, "source", config.LastFm.Source, "source to log scrobbles as (e.g. pc, web, vlc, etc.)")
+	lastfmCommand.Flags().StringVar(&args.source, "source", config.LastFm.Source, "source to log scrobbles as (e.g. pc, web, etc.), the player is appended to it")
+	lastfmCommand.Flags().StringSliceVar(&args.targets, "targets", config.LastFm.Targets, "where to scrobble to, any of \"lastfm\", \"listenbrainz\" and \"maloja\"")
+	lastfmCommand.Flags().StringSliceVar(&args.players, "players", config.LastFm.Players, "mpris players to watch, or \"any\" for every player")
 	lastfmCommand.Flags().BoolVar(&args.debug, "debug", config.Debug, "set debug mode")
 
 	return lastfmCommand
@@ -174,50 +177,7 @@ func getSession(apiKey string, apiSecret string, token string) (Session, error)
 	return resultJson.Session, nil
 }
 
-func scrobble(credentials simpleconfig.Config, album string, artist string, track string, timestamp int64) (PostScrobbleResponse, error) {
-	apiKey, _ := credentials.Get("api_key")
-	apiSecret, _ := credentials.Get("api_secret")
-	sessionKey, _ := credentials.Get("session_key")
-
-	params := url.Values{}
-	params.Set("method", "track.scrobble")
-	params.Set("api_key", apiKey)
-	params.Set("album", album)
-	params.Set("artist", artist)
-	params.Set("track", track)
-	params.Set("timestamp", fmt.Sprint(timestamp))
-	params.Set("sk", sessionKey)
-	params.Set("api_sig", generateSignature(params, apiSecret))
-	params.Set("format", "json")
-
-	resp, err := http.PostForm(API_END_POINT, params)
-
-	if err != nil {
-		return PostScrobbleResponse{}, err
-	}
-
-	if resp.StatusCode > 299 {
-		return PostScrobbleResponse{}, errors.New(resp.Status)
-	}
-
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-
-	if err != nil {
-		return PostScrobbleResponse{}, err
-	}
-
-	resultJson := PostScrobbleResponse{}
-	err = json.Unmarshal(body, &resultJson)
-
-	if err != nil {
-		return PostScrobbleResponse{}, err
-	}
-
-	return resultJson, nil
-}
-
-// playerctl is only on linux so we can just use xdg-open
+// mpris is only on linux so we can just use xdg-open
 func open(url string) error {
 	return exec.Command("xdg-open", url).Run()
 }
@@ -284,30 +244,19 @@ func setupOrGetCredentials() (simpleconfig.Config, error) {
 	return credentials, nil
 }
 
-func getCurrentPosition() (float64, error) {
-	positionCmd := exec.Command("playerctl", "-p", "vlc", "position")
-	positionOutput, err := positionCmd.Output()
-
-	if err != nil || string(positionOutput) == "No player could handle this command" {
-		return 0.0, errors.New("playerctl - no player could handle this command")
-	}
-
-	position, err := strconv.ParseFloat(strings.TrimSpace(string(positionOutput)), 64)
-
-	if err != nil {
-		return 0.0, errors.New("playerctl - could not parse position")
-	}
-
-	return position, nil
-}
-
 const SEEK_TOLERANCE_SECONDS = 8
 const SESSION_RESET_THRESHOLD_SECONDS = 90
 const DRIFT_TOLERANCE_SECONDS = 1.5
 
-func attemptScrobble(db *sql.DB, credentials simpleconfig.Config, currentTrack *CurrentTrackInfo, args *LastfmWatchArgs, stdOut *log.Logger, stdErr *log.Logger) {
+// how far off the position after a loop can be from the expected one, players
+// can take a moment to start the track again
+const LOOP_TOLERANCE_SECONDS = 3
+
+// returns whether any target was reached, i.e. the track was scrobbled (or
+// ignored) there
+func attemptScrobble(db *sql.DB, scrobblers []Scrobbler, rules scrobbleRules, currentTrack *CurrentTrackInfo, args *LastfmWatchArgs, source string, stdOut *log.Logger, stdErr *log.Logger) bool {
 	if currentTrack.Duration == -1.0 {
-		return
+		return false
 	}
 
 	passingReason := ""
@@ -328,12 +277,16 @@ func attemptScrobble(db *sql.DB, credentials simpleconfig.Config, currentTrack *
 	currentTrack.WallTime = realTimePassed
 	listenStats := fmt.Sprintf("unique coverage for %.2f, listen time: %.2f, wall time: %.2f, half len: %.2f, min: %d", uniqueCoverage, currentTrack.ListenTime, currentTrack.WallTime, currentTrack.Duration/2.0, args.minListenTime)
 
+	metadata, dropped, _ := rules.apply(scrobbleMetadata{Artist: currentTrack.Artist, Title: currentTrack.Track, Album: currentTrack.Album})
+
 	insertParams := dbUtils.InsertIntoPlaysParams{
-		Fulfilled:      false,
 		Scrobbable:     false,
-		Title:          currentTrack.Track,
-		Artist:         currentTrack.Artist,
-		Album:          currentTrack.Album,
+		Title:          metadata.Title,
+		Artist:         metadata.Artist,
+		Album:          metadata.Album,
+		OriginalTitle:  currentTrack.Track,
+		OriginalArtist: currentTrack.Artist,
+		OriginalAlbum:  currentTrack.Album,
 		ListenTime:     int(currentTrack.ListenTime),
 		WallTime:       int(currentTrack.WallTime),
 		SeekCount:      currentTrack.SeekCount,
@@ -341,145 +294,79 @@ func attemptScrobble(db *sql.DB, credentials simpleconfig.Config, currentTrack *
 		UniqueCoverage: int(uniqueCoverage),
 		Duration:       int(currentTrack.Duration),
 		StartTime:      currentTrack.StartTime,
-		Source:         args.source,
+		Source:         source,
 	}
 
+	reached := false
+
 	if passingReason == "" {
 		stdOut.Printf("└── not scrobbling because it did not pass either listen condition (%s) or it was too short", listenStats)
+	} else if dropped {
+		insertParams.Scrobbable = true
+		stdOut.Printf("└── not scrobbling because a rewrite rule dropped it (%s)", listenStats)
+
+		for _, scrobbler := range scrobblers {
+			insertParams.Targets = append(insertParams.Targets, dbUtils.PlayTarget{
+				Target:         scrobbler.Name(),
+				IgnoredCode:    IGNORED_CODE_RULE,
+				IgnoredMessage: "dropped by a rewrite rule",
+			})
+		}
 	} else {
 		insertParams.Scrobbable = true
-
 		stdOut.Printf("└── scrobbling because %s (%s)", passingReason, listenStats)
-		scrobbleResponse, err := scrobble(credentials, currentTrack.Album, currentTrack.Artist, currentTrack.Track, currentTrack.StartTime.Unix())
 
-		if err != nil {
-			stdErr.Printf("└── last.fm api error - %s", err.Error())
-		} else {
-			insertParams.Fulfilled = true
-			if scrobbleResponse.Scrobbles.Attr.Ignored == 1 {
-				stdErr.Printf("└── last.fm ignored this scrobble - %s", scrobbleResponse.Scrobbles.Scrobble.IgnoredMessage.Text)
-			}
+		if metadata.Artist != currentTrack.Artist || metadata.Title != currentTrack.Track || metadata.Album != currentTrack.Album {
+			stdOut.Printf("└── rewritten to %s - %s - %s", metadata.Artist, metadata.Title, metadata.Album)
 		}
-	}
 
-	if db != nil {
-		if err := dbUtils.InsertIntoPlays(db, insertParams); err != nil {
-			stdErr.Printf("└── could not log scrobble to db - %s", err.Error())
-		}
-	}
-}
-
-func watchForTracks(db *sql.DB, credentials simpleconfig.Config, currentTrack *CurrentTrackInfo, args *LastfmWatchArgs, stdOut *log.Logger, stdErr *log.Logger) {
-	waitTime := time.Duration(args.interval) * time.Second
-
-	for {
-		position, err := getCurrentPosition()
-
-		// if we can't get the position, attempt to scrobble the current track and reset
-		if err != nil {
-			if currentTrack.Track != "" {
-				currentTrack.CloseOpenRange(currentTrack.LastPosition)
-				if currentTrack.Duration != -1.0 {
-					attemptScrobble(db, credentials, currentTrack, args, stdOut, stdErr)
-				}
-				currentTrack.Track = ""
-				currentTrack.Artist = ""
-				currentTrack.Album = ""
-				currentTrack.ResetMetrics()
-			}
-
-			stdErr.Println(err)
-			time.Sleep(waitTime)
-			continue
-		}
-
-		songMetadata, err := utils.GetCurrentPlayingSong()
-		now := time.Now()
-
-		if err != nil {
-			stdErr.Println(err)
-			time.Sleep(waitTime)
-			continue
+		play := dbUtils.Play{
+			Album:     metadata.Album,
+			Artist:    metadata.Artist,
+			Title:     metadata.Title,
+			Duration:  int(currentTrack.Duration),
+			StartTime: currentTrack.StartTime,
 		}
 
-		album := songMetadata.Album
-		artist := songMetadata.Artist
-		track := songMetadata.Track
-
-		// we've found a new song
-		if artist != currentTrack.Artist || track != currentTrack.Track || album != currentTrack.Album {
-			if currentTrack.Track != "" {
-				currentTrack.CloseOpenRange(currentTrack.LastPosition)
-				attemptScrobble(db, credentials, currentTrack, args, stdOut, stdErr)
-			}
-
-			currentTrack.Track = track
-			currentTrack.Artist = artist
-			currentTrack.Album = album
-
-			currentTrack.ResetMetrics()
-			currentTrack.StartTime = now
-
-			stdOut.Printf("new song detected - %s - %s", artist, track)
-			length, err := strconv.ParseFloat(songMetadata.Length, 64)
+		for _, scrobbler := range scrobblers {
+			target := dbUtils.PlayTarget{Target: scrobbler.Name()}
+			accepted, ignored, err := scrobbler.Submit([]dbUtils.Play{play})
 
 			if err != nil {
-				stdErr.Printf("└── playerctl - could not parse length of")
-				currentTrack.Duration = -1.0
+				stdErr.Printf("└── %s api error - %s", scrobbler.Name(), err.Error())
 			} else {
-				currentTrack.Duration = length
-			}
-		} else {
-			deltaPos := position - currentTrack.LastPosition
-			absDeltaPos := math.Abs(deltaPos)
-			deltaTime := time.Since(currentTrack.LastUpdate).Seconds()
-			expectedPos := currentTrack.LastPosition + deltaTime
-			naturalPlayback := currentTrack.Duration > 0 && deltaPos > 0 && math.Abs(position-expectedPos) < DRIFT_TOLERANCE_SECONDS
-
-			event := "pause"
-
-			if naturalPlayback {
-				event = "natural"
-			} else if absDeltaPos > SESSION_RESET_THRESHOLD_SECONDS { // too much of a jump, reset session
-				event = "reset"
-			} else if absDeltaPos > SEEK_TOLERANCE_SECONDS { // medium seek, intentional repositioning
-				event = "seek"
-			}
+				reached = true
+				target.Fulfilled = len(accepted) == 1
 
-			switch event {
-			case "natural":
-				if !currentTrack.RangeOpen {
-					currentTrack.OpenRangeStart = currentTrack.LastPosition
-					currentTrack.RangeOpen = true
+				if len(ignored) == 1 {
+					stdErr.Printf("└── %s ignored this scrobble - %s", scrobbler.Name(), ignored[0].message)
+					target.IgnoredCode = ignored[0].code
+					target.IgnoredMessage = ignored[0].message
 				}
-				currentTrack.ListenTime += deltaTime
-			case "seek":
-				currentTrack.CloseOpenRange(currentTrack.LastPosition)
-				currentTrack.SeekCount++
-				stdOut.Printf("└── playerctl - position seeked")
-			case "reset":
-				currentTrack.CloseOpenRange(currentTrack.LastPosition)
-				attemptScrobble(db, credentials, currentTrack, args, stdOut, stdErr)
-				currentTrack.ResetMetrics()
-				currentTrack.StartTime = now
-			case "pause":
-				currentTrack.CloseOpenRange(currentTrack.LastPosition)
 			}
+
+			insertParams.Targets = append(insertParams.Targets, target)
 		}
+	}
 
-		currentTrack.LastPosition = position
-		currentTrack.LastUpdate = now
-		time.Sleep(waitTime)
+	if db != nil {
+		if err := dbUtils.InsertIntoPlays(db, insertParams); err != nil {
+			stdErr.Printf("└── could not log scrobble to db - %s", err.Error())
+		}
 	}
+
+	return reached
 }
 
 func watchRunner(args *LastfmWatchArgs) error {
-	_, err := exec.LookPath("playerctl")
+	client, err := mpris.Connect()
 
 	if err != nil {
-		return errors.New("playerctl is not installed, this program only works on linux")
+		return errors.New("could not connect to the session bus (mpris), this program only works on linux: " + err.Error())
 	}
 
+	defer client.Close()
+
 	gracefulExit := make(chan os.Signal, 1)
 	signal.Notify(gracefulExit, syscall.SIGINT, syscall.SIGTERM)
 
@@ -505,7 +392,20 @@ func watchRunner(args *LastfmWatchArgs) error {
 		}
 	}
 
-	credentials, err := setupOrGetCredentials()
+	config, err := utils.GetConfig()
+
+	if err != nil {
+		return err
+	}
+
+	scrobblers, err := newScrobblers(args.targets, config.LastFm)
+
+	if err != nil {
+		return err
+	}
+
+	// changes to the rules need a restart
+	rules, err := getScrobbleRules(config.LastFm)
 
 	if err != nil {
 		return err
@@ -517,28 +417,53 @@ func watchRunner(args *LastfmWatchArgs) error {
 		return errors.New("could not create lock file")
 	}
 
-	currentTrack := CurrentTrackInfo{}
 	stdOutLog := log.New(os.Stdout, "info : ", log.LstdFlags)
 	stdErrLog := log.New(os.Stderr, "error: ", log.LstdFlags)
 
-	go func() {
-		<-gracefulExit
-		lockFile.Close()
-		os.Remove(lockFileName)
-
-		if currentTrack.Track != "" {
-			if err != nil {
-				stdErrLog.Println("could not get position when gracefully exiting")
-			} else {
-				attemptScrobble(db, credentials, &currentTrack, args, stdOutLog, stdErrLog)
-			}
-		} else {
-			stdOutLog.Println("did not find any track when gracefully exiting")
+	defer os.Remove(lockFileName)
+	defer lockFile.Close()
+
+	w := watcher{
+		client:     client,
+		db:         db,
+		scrobblers: scrobblers,
+		rules:      rules,
+		args:       args,
+		stdOut:     stdOutLog,
+		stdErr:     stdErrLog,
+	}
+
+	// now playing is only a lastfm thing
+	if lastfm := getLastfmScrobbler(scrobblers); args.nowPlaying && lastfm != nil {
+		w.nowPlaying = &nowPlaying{
+			credentials: lastfm.credentials,
+			interval:    time.Duration(args.nowPlayingInterval) * time.Second,
+			stdErr:      stdErrLog,
 		}
+	}
+
+	var flusherDone chan struct{}
+	stopFlusher := make(chan struct{})
 
-		os.Exit(0)
-	}()
+	if db != nil && args.flushInterval > 0 {
+		w.flusher = newFlusher(db, scrobblers, rules, time.Duration(args.flushInterval)*time.Second, stdOutLog, stdErrLog)
+		flusherDone = make(chan struct{})
+
+		go func() {
+			defer close(flusherDone)
+			w.flusher.run(stopFlusher)
+		}()
+	}
+
+	// returns once the current track is scrobbled after SIGINT or SIGTERM
+	w.run(gracefulExit)
+
+	// let a flush in progress finish before the db is closed
+	close(stopFlusher)
+
+	if flusherDone != nil {
+		<-flusherDone
+	}
 
-	watchForTracks(db, credentials, &currentTrack, args, stdOutLog, stdErrLog)
 	return nil
 }
@@ -0,0 +1,476 @@
+package lastfm
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kitesi/music/mpris"
+	"github.com/kitesi/music/utils"
+)
+
+/*
+   The watcher is driven by mpris events (track changed, seeked, paused and
+   played, player quit). Every event first accounts for the listening done up
+   to that moment, so a track change or a short skip is attributed to the
+   right track instead of whatever is playing at the next poll.
+
+   mpris doesn't send the position while playing, so it's still checked every
+   interval to catch seeks from players that don't send Seeked. Players that
+   sent no event since the last interval also have their metadata checked,
+   since some never send any, and if the subscription fails everything is
+   polled every interval.
+*/
+
+type watcher struct {
+	client     *mpris.Client
+	db         *sql.DB
+	scrobblers []Scrobbler
+	rules      scrobbleRules
+	args       *LastfmWatchArgs
+	stdOut     *log.Logger
+	stdErr     *log.Logger
+	// nil without a log db
+	flusher *flusher
+	// nil if now playing updates are turned off
+	nowPlaying *nowPlaying
+
+	// keyed by the full mpris name, e.g. "chromium.instance1234"
+	playerWatchers map[string]*playerWatcher
+}
+
+// the track state of a single player, each one is scrobbled on its own
+type playerWatcher struct {
+	*watcher
+
+	player       string
+	currentTrack CurrentTrackInfo
+	// only known from events, while polling it is inferred from the position
+	playing bool
+	// got an event since the last poll
+	sawEvent bool
+}
+
+// where the player should be now, assuming it kept playing since the last
+// update
+func (w *playerWatcher) estimatePosition(now time.Time) float64 {
+	track := &w.currentTrack
+
+	if !w.playing || track.LastUpdate.IsZero() {
+		return track.LastPosition
+	}
+
+	position := track.LastPosition + now.Sub(track.LastUpdate).Seconds()
+
+	if track.Duration > 0 && position > track.Duration {
+		return track.Duration
+	}
+
+	return position
+}
+
+// attempts to scrobble the current track and forgets about it
+func (w *playerWatcher) finishTrack(position float64) {
+	track := &w.currentTrack
+
+	if track.Track == "" {
+		return
+	}
+
+	track.CloseOpenRange(position)
+
+	if w.nowPlaying != nil {
+		w.nowPlaying.cancel(w.player)
+	}
+
+	if track.Duration != -1.0 {
+		w.scrobble()
+	}
+
+	track.Track = ""
+	track.Artist = ""
+	track.Album = ""
+	track.TrackId = ""
+	track.ResetMetrics()
+}
+
+func (w *playerWatcher) startTrack(songMetadata utils.SongMetadata, position float64, now time.Time) {
+	track := &w.currentTrack
+
+	track.Track = songMetadata.Track
+	track.Artist = songMetadata.Artist
+	track.Album = songMetadata.Album
+	track.TrackId = songMetadata.TrackId
+
+	track.ResetMetrics()
+	track.StartTime = now
+	track.Duration = songMetadata.Length
+	track.LastPosition = position
+	track.LastUpdate = now
+
+	w.stdOut.Printf("new song detected (%s) - %s - %s", w.player, track.Artist, track.Track)
+
+	if w.nowPlaying == nil {
+		return
+	}
+
+	metadata, dropped, _ := w.rules.apply(scrobbleMetadata{Artist: track.Artist, Title: track.Track, Album: track.Album})
+
+	if !dropped {
+		w.nowPlaying.queue(nowPlayingTrack{
+			player:   w.player,
+			album:    metadata.Album,
+			artist:   metadata.Artist,
+			track:    metadata.Title,
+			duration: track.Duration,
+		}, now)
+	}
+}
+
+// a new track id means a new playlist entry, even if it's the same song again
+func (w *playerWatcher) isCurrentTrack(songMetadata utils.SongMetadata) bool {
+	track := &w.currentTrack
+
+	if songMetadata.TrackId != "" && track.TrackId != "" && songMetadata.TrackId != track.TrackId {
+		return false
+	}
+
+	return songMetadata.Artist == track.Artist && songMetadata.Track == track.Track && songMetadata.Album == track.Album
+}
+
+// accounts for the time between the last update and now, given the position
+// the player is at now
+func (w *playerWatcher) advance(position float64, now time.Time) {
+	track := &w.currentTrack
+	deltaPos := position - track.LastPosition
+	absDeltaPos := math.Abs(deltaPos)
+	deltaTime := now.Sub(track.LastUpdate).Seconds()
+	expectedPos := track.LastPosition + deltaTime
+	naturalPlayback := track.Duration > 0 && deltaPos > 0 && math.Abs(position-expectedPos) < DRIFT_TOLERANCE_SECONDS
+	// it should have gone past the end by as much as it's into the track now,
+	// i.e. the player is repeating the track
+	looped := track.Duration > 0 && deltaPos < 0 && expectedPos >= track.Duration && math.Abs(expectedPos-track.Duration-position) < LOOP_TOLERANCE_SECONDS
+
+	event := "pause"
+
+	if naturalPlayback {
+		event = "natural"
+	} else if looped {
+		event = "loop"
+	} else if absDeltaPos > SESSION_RESET_THRESHOLD_SECONDS { // too much of a jump, reset session
+		event = "reset"
+	} else if absDeltaPos > SEEK_TOLERANCE_SECONDS { // medium seek, intentional repositioning
+		event = "seek"
+	}
+
+	switch event {
+	case "loop":
+		wrappedAt := now.Add(-time.Duration(position * float64(time.Second)))
+		// the rest of the track played before it started over
+		w.advance(track.Duration, wrappedAt)
+		w.stdOut.Printf("└── mpris - track looped")
+		w.resetSession(track.Duration, wrappedAt)
+		track.LastPosition = 0
+		track.LastUpdate = wrappedAt
+		w.advance(position, now)
+		return
+	case "natural":
+		if !track.RangeOpen {
+			track.OpenRangeStart = track.LastPosition
+			track.RangeOpen = true
+		}
+		track.ListenTime += deltaTime
+	case "seek":
+		track.CloseOpenRange(track.LastPosition)
+		track.SeekCount++
+		w.stdOut.Printf("└── mpris - position seeked")
+	case "reset":
+		w.resetSession(track.LastPosition, now)
+	case "pause":
+		track.CloseOpenRange(track.LastPosition)
+	}
+
+	track.LastPosition = position
+	track.LastUpdate = now
+}
+
+// reaching last.fm means failed scrobbles can likely be sent now too
+func (w *playerWatcher) scrobble() {
+	if attemptScrobble(w.db, w.scrobblers, w.rules, &w.currentTrack, w.args, w.source(), w.stdOut, w.stdErr) && w.flusher != nil {
+		w.flusher.notify()
+	}
+}
+
+// the same track started over (or jumped far enough to count as a new
+// listen), so the old session is scrobbled on its own
+func (w *playerWatcher) resetSession(position float64, now time.Time) {
+	track := &w.currentTrack
+	duration := track.Duration
+
+	track.CloseOpenRange(position)
+	w.scrobble()
+	track.ResetMetrics()
+	track.StartTime = now
+	track.Duration = duration
+}
+
+// gets everything from the player, used at startup, while polling and to
+// correct the position between events
+func (w *playerWatcher) poll(now time.Time, withMetadata bool) {
+	position, err := w.client.Position(w.player)
+
+	// if we can't get the position, attempt to scrobble the current track and reset
+	if err != nil {
+		w.finishTrack(w.currentTrack.LastPosition)
+		w.playing = false
+		w.stdErr.Println(err)
+		return
+	}
+
+	if !withMetadata && w.currentTrack.Track != "" {
+		w.advance(position, now)
+		return
+	}
+
+	metadata, err := w.client.Metadata(w.player)
+
+	if err != nil {
+		w.stdErr.Println(err)
+		return
+	}
+
+	songMetadata, err := utils.ToSongMetadata(metadata)
+
+	if err != nil {
+		w.stdErr.Println(err)
+		return
+	}
+
+	if w.isCurrentTrack(songMetadata) {
+		w.advance(position, now)
+		return
+	}
+
+	w.finishTrack(w.currentTrack.LastPosition)
+	w.startTrack(songMetadata, position, now)
+
+	if status, err := w.client.PlaybackStatus(w.player); err == nil {
+		w.playing = status == mpris.STATUS_PLAYING
+	}
+}
+
+func (w *playerWatcher) handleEvent(event mpris.Event) {
+	now := event.Time
+
+	switch event.Kind {
+	case mpris.EVENT_METADATA:
+		songMetadata, err := utils.ToSongMetadata(event.Metadata)
+
+		if err != nil {
+			w.stdErr.Println(err)
+			return
+		}
+
+		if w.isCurrentTrack(songMetadata) {
+			return
+		}
+
+		// the old track played up until now
+		if w.currentTrack.Track != "" {
+			w.advance(w.estimatePosition(now), now)
+		}
+
+		w.finishTrack(w.currentTrack.LastPosition)
+
+		position, err := w.client.Position(w.player)
+
+		if err != nil {
+			position = 0
+		}
+
+		w.startTrack(songMetadata, position, now)
+	case mpris.EVENT_SEEKED:
+		if w.currentTrack.Track == "" {
+			return
+		}
+
+		w.advance(w.estimatePosition(now), now)
+		w.advance(event.Position, now)
+	case mpris.EVENT_PLAYBACK_STATUS:
+		if w.currentTrack.Track == "" {
+			w.playing = event.PlaybackStatus == mpris.STATUS_PLAYING
+			w.poll(now, true)
+			return
+		}
+
+		position, err := w.client.Position(w.player)
+
+		// stopping usually resets the position to 0
+		if err != nil || event.PlaybackStatus == mpris.STATUS_STOPPED {
+			position = w.estimatePosition(now)
+		}
+
+		// count what was played before pausing, resuming just starts over
+		// from the current position
+		if w.playing {
+			w.advance(position, now)
+		} else {
+			w.currentTrack.LastPosition = position
+			w.currentTrack.LastUpdate = now
+		}
+
+		w.playing = event.PlaybackStatus == mpris.STATUS_PLAYING
+
+		if !w.playing {
+			w.currentTrack.CloseOpenRange(w.currentTrack.LastPosition)
+		}
+	case mpris.EVENT_PLAYER_APPEARED:
+		w.poll(now, true)
+	case mpris.EVENT_PLAYER_VANISHED:
+		if w.currentTrack.Track != "" {
+			w.advance(w.estimatePosition(now), now)
+		}
+
+		w.finishTrack(w.currentTrack.LastPosition)
+		w.playing = false
+	}
+}
+
+// "chromium.instance1234" is logged as "chromium", or as "pc/chromium" with
+// --source pc
+func (w *playerWatcher) source() string {
+	name, _, _ := strings.Cut(w.player, ".")
+
+	if w.args.source == "" {
+		return name
+	}
+
+	return w.args.source + "/" + name
+}
+
+// whether the player is one of --players, "vlc" also matches instances like
+// "vlc.instance1234"
+func (w *watcher) isWatched(player string) bool {
+	for _, name := range w.args.players {
+		if name == "any" || player == name || strings.HasPrefix(player, name+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the watcher for player, nil if it isn't watched
+func (w *watcher) getPlayerWatcher(player string) *playerWatcher {
+	if !w.isWatched(player) {
+		return nil
+	}
+
+	pw, ok := w.playerWatchers[player]
+
+	if !ok {
+		pw = &playerWatcher{watcher: w, player: player}
+		w.playerWatchers[player] = pw
+	}
+
+	return pw
+}
+
+// polls every watched player, players that quit without an event (or while
+// polling) have their track scrobbled and are forgotten. The metadata is only
+// skipped for players that sent an event since the last poll, unless
+// withMetadata is set.
+func (w *watcher) pollPlayers(now time.Time, withMetadata bool) {
+	players, err := w.client.Players()
+
+	if err != nil {
+		w.stdErr.Println(err)
+		return
+	}
+
+	running := map[string]bool{}
+
+	for _, player := range players {
+		running[player] = true
+
+		if pw := w.getPlayerWatcher(player); pw != nil {
+			pw.poll(now, withMetadata || !pw.sawEvent)
+			pw.sawEvent = false
+		}
+	}
+
+	for player, pw := range w.playerWatchers {
+		if !running[player] {
+			pw.finishTrack(pw.currentTrack.LastPosition)
+			delete(w.playerWatchers, player)
+		}
+	}
+}
+
+func (w *watcher) run(exit <-chan os.Signal) {
+	waitTime := time.Duration(w.args.interval) * time.Second
+	ticker := time.NewTicker(waitTime)
+	defer ticker.Stop()
+
+	w.playerWatchers = map[string]*playerWatcher{}
+	events, err := w.client.Subscribe()
+
+	if err != nil {
+		w.stdErr.Printf("could not subscribe to mpris events, falling back to polling - %s", err.Error())
+		events = nil
+	}
+
+	w.pollPlayers(time.Now(), true)
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				w.stdErr.Println("mpris events stopped, falling back to polling")
+				events = nil
+				continue
+			}
+
+			pw := w.getPlayerWatcher(event.Player)
+
+			if pw == nil {
+				continue
+			}
+
+			pw.sawEvent = true
+			pw.handleEvent(event)
+
+			if event.Kind == mpris.EVENT_PLAYER_VANISHED {
+				delete(w.playerWatchers, event.Player)
+			}
+		case now := <-ticker.C:
+			// without events the metadata has to be checked every time, with
+			// them it's only checked for players that were quiet
+			w.pollPlayers(now, events == nil)
+
+			if w.nowPlaying != nil {
+				w.nowPlaying.send(now)
+			}
+		case <-exit:
+			now := time.Now()
+			foundTrack := false
+
+			for _, pw := range w.playerWatchers {
+				if pw.currentTrack.Track != "" {
+					foundTrack = true
+					pw.advance(pw.estimatePosition(now), now)
+					pw.finishTrack(pw.currentTrack.LastPosition)
+				}
+			}
+
+			if !foundTrack {
+				w.stdOut.Println("did not find any track when gracefully exiting")
+			}
+
+			return
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package lastfm
+
+import (
+	"io"
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	dbUtils "github.com/kitesi/music/db"
+	"github.com/kitesi/music/utils"
+)
+
+const TEST_TRACK_LENGTH = 200
+
+// what the player reports after some time passed
+type watcherStep struct {
+	after    float64
+	position float64
+	trackId  string
+}
+
+// the track playing on normally from one position to another, reported every
+// 10 seconds
+func playing(trackId string, from float64, to float64) []watcherStep {
+	steps := []watcherStep{}
+
+	for position := from + 10; position <= to; position += 10 {
+		steps = append(steps, watcherStep{after: 10, position: position, trackId: trackId})
+	}
+
+	return steps
+}
+
+func steps(groups ...[]watcherStep) []watcherStep {
+	all := []watcherStep{}
+
+	for _, group := range groups {
+		all = append(all, group...)
+	}
+
+	return all
+}
+
+func TestWatcherAdvance(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []watcherStep
+		// the unique coverage of each play logged, how many of them were
+		// scrobbable and the seeks in all of them
+		coverage   []int
+		scrobbable int
+		seeks      int
+	}{
+		{
+			name:     "natural",
+			steps:    steps([]watcherStep{{position: 0, trackId: "1"}}, playing("1", 0, 190)),
+			coverage: []int{190}, scrobbable: 1,
+		},
+		{
+			name: "pause",
+			steps: steps(
+				[]watcherStep{{position: 0, trackId: "1"}}, playing("1", 0, 50),
+				[]watcherStep{{after: 60, position: 50, trackId: "1"}}, playing("1", 50, 190),
+			),
+			coverage: []int{190}, scrobbable: 1,
+		},
+		{
+			name: "loop",
+			steps: steps(
+				[]watcherStep{{position: 0, trackId: "1"}}, playing("1", 0, 190),
+				// went past the end and 5 seconds into the next round
+				[]watcherStep{{after: 15, position: 5, trackId: "1"}}, playing("1", 5, 155),
+			),
+			coverage: []int{200, 155}, scrobbable: 2,
+		},
+		{
+			name: "loop that was only just started",
+			steps: steps(
+				[]watcherStep{{position: 0, trackId: "1"}}, playing("1", 0, 190),
+				[]watcherStep{{after: 15, position: 5, trackId: "1"}},
+			),
+			coverage: []int{200, 5}, scrobbable: 1,
+		},
+		{
+			name: "reset",
+			steps: steps(
+				[]watcherStep{{position: 0, trackId: "1"}}, playing("1", 0, 150),
+				// back to the start, long before the end
+				[]watcherStep{{after: 10, position: 0, trackId: "1"}}, playing("1", 0, 120),
+			),
+			coverage: []int{150, 120}, scrobbable: 2,
+		},
+		{
+			name: "seek forward",
+			steps: steps(
+				[]watcherStep{{position: 0, trackId: "1"}}, playing("1", 0, 60),
+				[]watcherStep{{after: 10, position: 100, trackId: "1"}}, playing("1", 100, 190),
+			),
+			coverage: []int{150}, scrobbable: 1, seeks: 1,
+		},
+		{
+			name: "seek back",
+			steps: steps(
+				[]watcherStep{{position: 0, trackId: "1"}}, playing("1", 0, 60),
+				[]watcherStep{{after: 10, position: 30, trackId: "1"}}, playing("1", 30, 60),
+			),
+			coverage: []int{60}, scrobbable: 0, seeks: 1,
+		},
+		{
+			name: "new track id",
+			steps: steps(
+				[]watcherStep{{position: 0, trackId: "1"}}, playing("1", 0, 190),
+				// the same song queued again
+				[]watcherStep{{after: 10, position: 0, trackId: "2"}}, playing("2", 0, 50),
+			),
+			coverage: []int{190, 50}, scrobbable: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, err := dbUtils.OpenDB(filepath.Join(t.TempDir(), "plays.db"))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Cleanup(func() { db.Close() })
+
+			if err := dbUtils.RunMigrations(db); err != nil {
+				t.Fatal(err)
+			}
+
+			logger := log.New(io.Discard, "", 0)
+			w := &playerWatcher{
+				watcher: &watcher{
+					db:     db,
+					args:   &LastfmWatchArgs{minTrackLength: 30, minListenTime: 240},
+					stdOut: logger,
+					stdErr: logger,
+				},
+				player:  "vlc",
+				playing: true,
+			}
+
+			now := time.Now()
+
+			// the same as polling with the metadata
+			for _, step := range test.steps {
+				now = now.Add(time.Duration(step.after * float64(time.Second)))
+				songMetadata := utils.SongMetadata{Artist: "Nujabes", Track: "Luv(sic)", Length: TEST_TRACK_LENGTH, TrackId: step.trackId}
+
+				if w.currentTrack.Track != "" && w.isCurrentTrack(songMetadata) {
+					w.advance(step.position, now)
+				} else {
+					w.finishTrack(w.currentTrack.LastPosition)
+					w.startTrack(songMetadata, step.position, now)
+				}
+			}
+
+			w.finishTrack(w.currentTrack.LastPosition)
+			plays, err := dbUtils.GetPlays(db)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			coverage := []int{}
+			scrobbable := 0
+			seeks := 0
+
+			for _, play := range plays {
+				coverage = append(coverage, play.UniqueCoverage)
+				seeks += play.SeekCount
+
+				if play.Scrobbable {
+					scrobbable++
+				}
+			}
+
+			if !reflect.DeepEqual(coverage, test.coverage) || scrobbable != test.scrobbable || seeks != test.seeks {
+				t.Errorf("got plays covering %v (%d scrobbable, %d seeks), want %v (%d scrobbable, %d seeks)", coverage, scrobbable, seeks, test.coverage, test.scrobbable, test.seeks)
+			}
+		})
+	}
+}
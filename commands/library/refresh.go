@@ -0,0 +1,66 @@
+package library
+
+import (
+	"fmt"
+	"os"
+
+	lib "github.com/kitesi/music/library"
+	"github.com/kitesi/music/utils"
+	"github.com/spf13/cobra"
+)
+
+type LibraryRefreshArgs struct {
+	debug     bool
+	full      bool
+	musicPath string
+}
+
+func RefreshSetup() *cobra.Command {
+	args := LibraryRefreshArgs{}
+
+	config, err := utils.GetConfig()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+	}
+
+	refreshCmd := &cobra.Command{
+		Use:   "refresh",
+		Short: "Refresh the library index",
+		Long:  "Refresh the library index. Only files whose size or modification time changed are re-read, unless --full is given.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, positional []string) {
+			if err := refreshRunner(&args, config); err != nil {
+				if args.debug {
+					fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+				} else {
+					fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				}
+			}
+		},
+	}
+
+	refreshCmd.Flags().BoolVar(&args.full, "full", false, "re-read every file, not just the changed ones")
+	refreshCmd.Flags().BoolVar(&args.debug, "debug", config.Debug, "enable debug mode")
+	refreshCmd.Flags().StringVarP(&args.musicPath, "music-path", "m", config.MusicPath, "the music path to use")
+
+	return refreshCmd
+}
+
+func refreshRunner(args *LibraryRefreshArgs, config utils.Config) error {
+	library, err := lib.Open(config)
+
+	if err != nil {
+		return err
+	}
+
+	defer library.Close()
+	stats, err := library.Refresh(args.musicPath, args.full)
+
+	if err != nil {
+		return fmt.Errorf("could not refresh library: %w", err)
+	}
+
+	fmt.Printf("added: %d, updated: %d, removed: %d, unchanged: %d\n", stats.Added, stats.Updated, stats.Removed, stats.Unchanged)
+	return nil
+}
@@ -48,7 +48,7 @@ func Setup() *cobra.Command {
 }
 
 func lyricsRunner(args *LyricsArgs) error {
-	songMetadata, err := utils.GetCurrentPlayingSong()
+	songMetadata, err := utils.GetCurrentPlayingSong("vlc")
 
 	if err != nil {
 		return err
@@ -3,73 +3,69 @@ package play
 import (
 	"strings"
 
+	"github.com/kitesi/music/commands/tags"
+	"github.com/kitesi/music/library"
 	"github.com/kitesi/music/utils"
 )
 
-func doesSongPass(args *PlayArgs, savedTags map[string][]string, terms []string, songPath string) bool {
-	if len(terms) == 0 && len(args.tags) == 0 {
-		return true
+// how well a single term matches the song from 0 to 1, the string that's
+// tested is the lowercase path minus the music path unless the term has a
+// field prefix
+func scoreTerm(args *PlayArgs, song library.Song, term literalNode) float64 {
+	m := args.matcher.forLiteral(term)
+
+	if !term.quoted {
+		if field, value, ok := parseFieldTerm(term.value); ok {
+			// lowercasing can change the length, so cut the raw term itself
+			_, rawValue, _ := strings.Cut(term.raw, ":")
+			return scoreFieldTerm(args, m, song, field, value, rawValue)
+		}
 	}
 
-	passedOneTerm := len(terms) == 0
-	passedTagRequirement := len(args.tags) == 0
+	relativeSongPath := strings.Replace(strings.ToLower(song.Path), strings.ToLower(args.musicPath)+"/", "", 1)
+	return m.score(term.value, term.raw, relativeSongPath)
+}
+
+func doesSongPass(args *PlayArgs, savedTags map[string][]string, termQuery query, tagQuery query, song library.Song) bool {
+	if termQuery.isEmpty() && tagQuery.isEmpty() {
+		return true
+	}
 
-	relativeSongPath := strings.Replace(songPath, strings.ToLower(args.musicPath)+"/", "", 1)
+	songPath := strings.ToLower(song.Path)
 
-	var validateTerm = func(term string) bool {
-		return strings.Contains(relativeSongPath, term)
+	var validateTerm = func(term literalNode) bool {
+		return scoreTerm(args, song, term) >= args.matcher.forLiteral(term).threshold()
 	}
 
-	var validateTag = func(tag string) bool {
+	var validateTag = func(tag literalNode) bool {
 		isSong := func(s string) bool {
 			return strings.ToLower(s) == songPath
 		}
 
-		for k, v := range savedTags {
-			if strings.Contains(k, tag) && utils.Some(v, isSong) {
-				return true
+		// a nested tag (genre/jazz) matches itself and its descendants,
+		// anything else matches tags that contain it
+		matchesTag := func(name string) bool {
+			if strings.Contains(tag.value, "/") {
+				return tags.IsTagOrDescendant(name, tag.value)
 			}
-		}
 
-		return false
-	}
-
-	for _, term := range terms {
-		if validateQuery(term, validateTerm) {
-			if strings.HasPrefix(term, "!") {
-				return false
-			}
-
-			passedOneTerm = true
+			return strings.Contains(name, tag.value)
 		}
-	}
 
-	for _, tag := range args.tags {
-		if validateQuery(tag, validateTag) {
-			if strings.HasPrefix(tag, "!") {
-				return false
+		for k, v := range savedTags {
+			if matchesTag(k) && utils.Some(v, isSong) {
+				return true
 			}
-
-			passedTagRequirement = true
 		}
-	}
 
-	if !passedOneTerm && utils.Every(terms, func(term string) bool {
-		return strings.HasPrefix(term, "!")
-	}) {
-		passedOneTerm = true
+		return false
 	}
 
-	return passedOneTerm && passedTagRequirement
+	return termQuery.matches(validateTerm) && tagQuery.matches(validateTag)
 }
 
-func validateQuery(query string, validator func(string) bool) bool {
-	query = strings.TrimPrefix(strings.ToLower(query), "!")
-	requiredSections := strings.Split(query, "#")
-
-	return utils.Every(requiredSections, func(section string) bool {
-		return utils.Some(strings.Split(section, ","), func(word string) bool {
-			return validator(word)
-		})
+func scoreSong(args *PlayArgs, termQuery query, song library.Song) float64 {
+	return termQuery.score(func(term literalNode) float64 {
+		return scoreTerm(args, song, term)
 	})
 }
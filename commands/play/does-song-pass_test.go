@@ -0,0 +1,60 @@
+package play
+
+import (
+	"testing"
+
+	"github.com/kitesi/music/library"
+)
+
+func testSongPasses(t *testing.T, matchMode string, terms []string, song library.Song) bool {
+	t.Helper()
+
+	termQuery, err := parseQuery(terms, matchMode == MATCH_REGEX)
+
+	if err != nil {
+		t.Fatalf("parseQuery(%q) returned error: %s", terms, err)
+	}
+
+	args := &PlayArgs{musicPath: "/music", matchMode: matchMode}
+	args.matcher, err = newMatcher(matchMode, termQuery)
+
+	if err != nil {
+		t.Fatalf("newMatcher(%s, %q) returned error: %s", matchMode, terms, err)
+	}
+
+	return doesSongPass(args, map[string][]string{}, termQuery, query{}, song)
+}
+
+func TestDoesSongPass(t *testing.T) {
+	tests := []struct {
+		name      string
+		matchMode string
+		terms     []string
+		song      library.Song
+		want      bool
+	}{
+		{"substring", MATCH_SUBSTRING, []string{"mitski"}, library.Song{Path: "/music/Mitski/Geyser.mp3"}, true},
+		{"fuzzy typo", MATCH_FUZZY, []string{"mitksi"}, library.Song{Path: "/music/Mitski/Geyser.mp3"}, true},
+		{"fuzzy negation is exact", MATCH_FUZZY, []string{"!live"}, library.Song{Path: "/music/a/Love Song.mp3"}, true},
+		{"fuzzy negation still excludes", MATCH_FUZZY, []string{"!live"}, library.Song{Path: "/music/a/Song (Live).mp3"}, false},
+		{"regex negation is a regex", MATCH_REGEX, []string{"!l.ve"}, library.Song{Path: "/music/a/Live.mp3"}, false},
+		{"regex negation with anchors", MATCH_REGEX, []string{"!^mitski/"}, library.Song{Path: "/music/Mitski/Geyser.mp3"}, false},
+		{"regex negation keeps the rest", MATCH_REGEX, []string{"NOT ^mitski/"}, library.Song{Path: "/music/Nujabes/Luv.mp3"}, true},
+		{"regex field negation", MATCH_REGEX, []string{"!title:^live$"}, library.Song{Path: "/music/x.mp3", Title: "Live"}, false},
+		{"regex field negation only the whole title", MATCH_REGEX, []string{"!title:^live$"}, library.Song{Path: "/music/x.mp3", Title: "Live Forever"}, true},
+		{"regex with a comma", MATCH_REGEX, []string{"o{2,3}"}, library.Song{Path: "/music/a/Fooo.mp3"}, true},
+		{"regex with escaped parentheses", MATCH_REGEX, []string{`\(live\)`}, library.Song{Path: "/music/a/Song (Live).mp3"}, true},
+		{"regex with escaped parentheses needs them", MATCH_REGEX, []string{`\(live\)`}, library.Song{Path: "/music/a/Song Live.mp3"}, false},
+		// "İ" lowercases to the shorter "i", the value has to be cut from the raw term
+		{"regex field that lowercases shorter", MATCH_REGEX, []string{"ARTİST:^Mit"}, library.Song{Path: "/music/x.mp3", Artist: "Mitski"}, true},
+		{"fuzzy field negation is exact", MATCH_FUZZY, []string{"!title:live"}, library.Song{Path: "/music/x.mp3", Title: "Love"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := testSongPasses(t, test.matchMode, test.terms, test.song); got != test.want {
+				t.Errorf("%s %q on %+v = %t, want %t", test.matchMode, test.terms, test.song, got, test.want)
+			}
+		})
+	}
+}
@@ -92,7 +92,7 @@ func writeToScreen(query string, songs []string, musicPath string) error {
 	return nil
 }
 
-func liveQueryResults(musicPath string) error {
+func liveQueryResults(args *PlayArgs) error {
 	subPlayCmd, subPlayArgs := generateCommand()
 	subPlayTerms := []string{}
 
@@ -196,8 +196,13 @@ InfiniteLoop:
 				fmt.Printf("- %s\r\n", utils.GetBareSongName(s, subPlayArgs.musicPath))
 			}
 
-			runVLC(subPlayArgs, lastSongs)
-			return nil
+			player, err := newPlayer(subPlayArgs)
+
+			if err != nil {
+				return err
+			}
+
+			return runPlayer(subPlayArgs, player, lastSongs)
 		default:
 			asciiCode := int(b[0])
 
@@ -245,7 +250,17 @@ InfiniteLoop:
 		}
 
 		// live parsing of music-path is just not efficient
-		subPlayArgs.musicPath = musicPath
+		subPlayArgs.musicPath = args.musicPath
+
+		// --match and --player given before --live are the defaults, but can
+		// still be changed in the query
+		if !subPlayCmd.Flags().Changed("match") {
+			subPlayArgs.matchMode = args.matchMode
+		}
+
+		if !subPlayCmd.Flags().Changed("player") {
+			subPlayArgs.player = args.player
+		}
 		lastQuery = query
 
 		songs, err := getSongs(subPlayArgs, subPlayTerms)
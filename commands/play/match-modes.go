@@ -0,0 +1,154 @@
+package play
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/adrg/strutil"
+	"github.com/adrg/strutil/metrics"
+)
+
+const (
+	MATCH_SUBSTRING = "substring"
+	MATCH_FUZZY     = "fuzzy"
+	MATCH_REGEX     = "regex"
+
+	// minimum similarity (0 to 1) for a fuzzy term to match
+	FUZZY_THRESHOLD = 0.8
+)
+
+// decides whether a literal matches some text (a path or a field), based on
+// the --match mode
+type matcher struct {
+	mode    string
+	regexes map[string]*regexp.Regexp
+	metric  strutil.StringMetric
+}
+
+func newMatcher(mode string, q query) (*matcher, error) {
+	m := &matcher{mode: mode}
+
+	switch mode {
+	case MATCH_SUBSTRING:
+	case MATCH_FUZZY:
+		m.metric = metrics.NewJaroWinkler()
+	case MATCH_REGEX:
+		m.regexes = make(map[string]*regexp.Regexp)
+		var err error
+
+		// compile everything up front so an invalid pattern is an error
+		// instead of a term that never matches
+		q.walkLiterals(func(literal literalNode) {
+			if err != nil {
+				return
+			}
+
+			pattern := literal.raw
+
+			if field, value, ok := parseFieldTerm(literal.value); ok && !literal.quoted {
+				if _, isNumeric := numericQueryFields[field]; isNumeric {
+					return
+				}
+
+				_, pattern, _ = strings.Cut(literal.raw, ":")
+
+				if strings.HasPrefix(value, "=") {
+					return
+				}
+			}
+
+			regex, compileErr := regexp.Compile("(?i)" + pattern)
+
+			if compileErr != nil {
+				err = errors.New("invalid regex \"" + pattern + "\": " + compileErr.Error())
+				return
+			}
+
+			m.regexes[pattern] = regex
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("invalid --match, expected value of 'substring'|'fuzzy'|'regex'")
+	}
+
+	return m, nil
+}
+
+// negated fuzzy terms are plain substrings, a fuzzy "!live" shouldn't also
+// throw out "love" and "life"
+var negationMatcher = &matcher{mode: MATCH_SUBSTRING}
+
+// the matcher for a literal of the query
+func (m *matcher) forLiteral(literal literalNode) *matcher {
+	if literal.negated && m.mode == MATCH_FUZZY {
+		return negationMatcher
+	}
+
+	return m
+}
+
+// splits text into lowercase words, ignoring punctuation and path separators
+func splitWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// how well the term matches the text from 0 to 1. Substring and regex modes
+// only ever return 0 or 1. term is lowercase, rawTerm keeps the original case
+// for regexes.
+func (m *matcher) score(term string, rawTerm string, text string) float64 {
+	switch m.mode {
+	case MATCH_REGEX:
+		if regex, ok := m.regexes[rawTerm]; ok && regex.MatchString(text) {
+			return 1
+		}
+
+		return 0
+	case MATCH_FUZZY:
+		if strings.Contains(text, term) {
+			return 1
+		}
+
+		// compare against every run of words in the text that has as many
+		// words as the term, so "mitksi" can match "mitski/geyser.mp3"
+		termWords := splitWords(term)
+		textWords := splitWords(text)
+
+		if len(termWords) == 0 {
+			return 0
+		}
+
+		joinedTerm := strings.Join(termWords, " ")
+		best := 0.0
+
+		for i := 0; i+len(termWords) <= len(textWords); i++ {
+			similarity := strutil.Similarity(joinedTerm, strings.Join(textWords[i:i+len(termWords)], " "), m.metric)
+
+			if similarity > best {
+				best = similarity
+			}
+		}
+
+		return best
+	}
+
+	if strings.Contains(text, term) {
+		return 1
+	}
+
+	return 0
+}
+
+func (m *matcher) threshold() float64 {
+	if m.mode == MATCH_FUZZY {
+		return FUZZY_THRESHOLD
+	}
+
+	return 1
+}
@@ -2,27 +2,19 @@ package play
 
 import (
 	"fmt"
-	"io/fs"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"strconv"
 	"strings"
-	"syscall"
-	"time"
 
-	"github.com/djherbis/times"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 
 	"github.com/kitesi/music/commands/tags"
+	dbUtils "github.com/kitesi/music/db"
+	"github.com/kitesi/music/library"
 	"github.com/kitesi/music/utils"
 )
 
-type Song struct {
-	stat times.Timespec
-	path string
-}
-
 type PlayArgs struct {
 	dryRun           bool
 	dryPaths         bool
@@ -39,52 +31,71 @@ type PlayArgs struct {
 	tags             []string
 	addToTag         string
 	setToTag         string
+	saveSmartTag     string
+	player           string
 	vlcPath          string
 	sortType         string
 	musicPath        string
+	matchMode        string
 	limit            int
 	skip             int
+	// only loaded when a term uses the plays field
+	playCounts map[string]int
+	matcher    *matcher
+	// the tags --tags matches against, read from the tags directory if nil
+	storedTags map[string][]string
 }
 
-func addFlags(playCmd *cobra.Command, args *PlayArgs) {
+// the flags for finding songs and talking to the player, shared by play and
+// queue add
+func addQueryFlags(playCmd *cobra.Command, args *PlayArgs) {
 	config, err := utils.GetConfig()
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %+v\n", err)
 	}
 
-	playCmd.Flags().BoolVarP(&args.dryRun, "dry-run", "d", false, "dry run vlc")
-	playCmd.Flags().BoolVarP(&args.dryPaths, "dry-paths", "p", false, "only print out paths (absolute)")
-	playCmd.Flags().BoolVarP(&args.random, "random", "z", false, "play by random")
+	playCmd.Flags().BoolVarP(&args.dryRun, "dry-run", "d", false, "dry run the player")
 	playCmd.Flags().BoolVarP(&args.new, "new", "n", false, "play by new and skip old first")
 	playCmd.Flags().BoolVar(&args.playNewFirst, "play-new-first", false, "play by new")
 	playCmd.Flags().BoolVar(&args.skipOldFirst, "skip-old-first", false, "skip old first (when there is a limit)")
-	playCmd.Flags().BoolVarP(&args.persist, "persist", "", false, "persist the command instance")
-	playCmd.Flags().BoolVar(&args.appendToPlaylist, "append", false, "append to playlist rather than jumping")
-	playCmd.Flags().BoolVar(&args.live, "live", false, "go into live query results mode")
+	playCmd.Flags().BoolVarP(&args.persist, "persist", "", false, "persist the command instance (vlc and a newly started mpv)")
 	playCmd.Flags().BoolVarP(&args.edit, "edit", "e", false, "pipe to $EDITOR for song selection before playing")
 	playCmd.Flags().BoolVar(&args.debug, "debug", config.Debug, "enable debug mode")
-	playCmd.Flags().BoolVarP(&args.clear, "clear", "c", false, "clear any existing vlc instances, this uses the special file vlc://quit, so hacky and prone to race conditions")
 
-	playCmd.Flags().StringVarP(&args.addToTag, "add-to-tag", "a", "", "add returned songs to tag")
-	playCmd.Flags().StringVar(&args.setToTag, "set-to-tag", "", "set returned songs to tag")
-	playCmd.Flags().StringVar(&args.vlcPath, "vlc-path", "vlc", "path to vlc executable to use")
+	playCmd.Flags().StringVar(&args.player, "player", config.Player.Name, "player to use (vlc|mpv|mpd)")
+	playCmd.Flags().StringVar(&args.vlcPath, "vlc-path", config.Player.VlcPath, "path to vlc executable to use")
 	playCmd.Flags().StringVarP(&args.musicPath, "music-path", "m", config.MusicPath, "the music path to use")
 
 	playCmd.Flags().StringArrayVarP(&args.tags, "tags", "t", []string{}, "tags to match")
 
 	playCmd.Flags().StringVarP(&args.sortType, "sort-type", "s", "m", "timestamp to use when sorting by time (a|m|c)")
+	playCmd.Flags().StringVar(&args.matchMode, "match", MATCH_SUBSTRING, "how terms are matched, fuzzy sorts by similarity (substring|fuzzy|regex)")
 
 	playCmd.Flags().IntVarP(&args.limit, "limit", "l", -1, "limit the amount of songs played")
 	playCmd.Flags().IntVar(&args.skip, "skip", 0, "songs to skip from the start")
 }
 
+func addFlags(playCmd *cobra.Command, args *PlayArgs) {
+	addQueryFlags(playCmd, args)
+
+	playCmd.Flags().BoolVarP(&args.dryPaths, "dry-paths", "p", false, "only print out paths (absolute)")
+	playCmd.Flags().BoolVarP(&args.random, "random", "z", false, "play by random")
+	playCmd.Flags().BoolVar(&args.appendToPlaylist, "append", false, "append to playlist rather than jumping")
+	playCmd.Flags().BoolVar(&args.live, "live", false, "go into live query results mode")
+	playCmd.Flags().BoolVarP(&args.clear, "clear", "c", false, "clear the player's playlist first")
+
+	playCmd.Flags().StringVarP(&args.addToTag, "add-to-tag", "a", "", "add returned songs to tag")
+	playCmd.Flags().StringVar(&args.setToTag, "set-to-tag", "", "set returned songs to tag")
+	playCmd.Flags().StringVar(&args.saveSmartTag, "save-smart-tag", "", "save the query as a smart tag")
+}
+
 func generateCommand() (*cobra.Command, *PlayArgs) {
 	args := PlayArgs{}
 
 	playCmd := &cobra.Command{
 		Use:   "play [terms..]",
-		Short: "Play music with vlc",
+		Short: "Play music with vlc, mpv or mpd",
 	}
 
 	addFlags(playCmd, &args)
@@ -109,12 +120,26 @@ func Setup() *cobra.Command {
 
 func playRunner(args *PlayArgs, terms []string) error {
 	if args.live {
-		return liveQueryResults(args.musicPath)
+		return liveQueryResults(args)
+	}
+
+	if args.saveSmartTag != "" {
+		if err := tags.SaveSmartTag(args.musicPath, args.saveSmartTag, smartTagFromArgs(args, terms)); err != nil {
+			return err
+		}
+
+		fmt.Printf("Saved smart tag \"%s\"\n", args.saveSmartTag)
+	}
+
+	player, err := newPlayer(args)
+
+	if err != nil {
+		return err
 	}
 
 	if len(terms) == 0 && args.limit != 0 && !args.dryPaths && !args.playNewFirst && !args.new && !args.edit && len(args.tags) == 0 {
 		fmt.Println("Playing all songs")
-		return runVLC(args, []string{"--recursive=expand", args.musicPath})
+		return runPlayer(args, player, []string{args.musicPath})
 	}
 
 	songs, err := getSongs(args, terms)
@@ -129,13 +154,13 @@ func playRunner(args *PlayArgs, terms []string) error {
 	}
 
 	if args.addToTag != "" {
-		if err := tags.ChangeSongsInTag(args.musicPath, args.addToTag, songs, true); err != nil {
-			return nil
+		if err := tags.ChangeSongsInTag(args.musicPath, args.addToTag, songs, true, describeQuery(args, terms)); err != nil {
+			return err
 		}
 	}
 
 	if args.setToTag != "" {
-		if err := tags.ChangeSongsInTag(args.musicPath, args.setToTag, songs, false); err != nil {
+		if err := tags.ChangeSongsInTag(args.musicPath, args.setToTag, songs, false, describeQuery(args, terms)); err != nil {
 			return err
 		}
 	}
@@ -160,7 +185,7 @@ func playRunner(args *PlayArgs, terms []string) error {
 		}
 	}
 
-	return runVLC(args, songs)
+	return runPlayer(args, player, songs)
 }
 
 func getSongs(args *PlayArgs, terms []string) ([]string, error) {
@@ -168,60 +193,82 @@ func getSongs(args *PlayArgs, terms []string) ([]string, error) {
 		return nil, errors.New("invalid --sort-type, expected value of 'a'|'c'|'m'")
 	}
 
-	songs := []Song{}
-	canEndEarly := !args.new && !args.skipOldFirst && !args.playNewFirst
+	termQuery, err := parseQuery(terms, args.matchMode == MATCH_REGEX)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid terms")
+	}
 
-	storedTags, err := tags.GetStoredTags(args.musicPath)
+	tagQuery, err := parseQuery(args.tags, false)
 
 	if err != nil {
+		return nil, errors.Wrap(err, "invalid --tags")
+	}
+
+	if err := checkFieldTerms(termQuery); err != nil {
 		return nil, err
 	}
 
-	if args.limit > 0 && args.skip > 0 {
-		args.limit += args.skip
+	args.matcher, err = newMatcher(args.matchMode, termQuery)
+
+	if err != nil {
+		return nil, err
 	}
 
-	var walk = func(fileName string, dirEntry fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
+	if usesField(termQuery, "plays") {
+		playCounts, err := getPlayCounts()
 
-		if dirEntry.IsDir() {
-			return nil
+		if err != nil {
+			return nil, err
 		}
 
-		if canEndEarly && len(songs) == args.limit {
-			return nil
-		}
+		args.playCounts = playCounts
+	}
 
-		// ignore the playlists, tags and .thumbnails directories
-		if strings.Contains(fileName, "/playlists") || strings.Contains(fileName, "/tags") || strings.Contains(fileName, "/.thumbnails") {
-			return nil
-		}
+	songs := []library.Song{}
+	// fuzzy results are ranked, so every song has to be seen first
+	canEndEarly := !args.new && !args.skipOldFirst && !args.playNewFirst && args.matchMode != MATCH_FUZZY
 
-		if doesSongPass(args, storedTags, terms, strings.ToLower(fileName)) {
-			stat, err := times.Stat(fileName)
+	storedTags := args.storedTags
 
-			if err != nil {
-				return err
-			}
+	if storedTags == nil {
+		storedTags, err = tags.GetStoredTags(args.musicPath)
 
-			songs = append(songs, Song{stat, fileName})
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		return nil
+	if args.limit > 0 && args.skip > 0 {
+		args.limit += args.skip
 	}
 
-	err = filepath.WalkDir(args.musicPath, walk)
+	indexedSongs, err := library.GetSongs(args.musicPath)
 
 	if err != nil {
 		return nil, err
 	}
 
+	for _, song := range indexedSongs {
+		if canEndEarly && len(songs) == args.limit {
+			break
+		}
+
+		if doesSongPass(args, storedTags, termQuery, tagQuery, song) {
+			songs = append(songs, song)
+		}
+	}
+
 	if len(songs) == 0 {
 		return []string{}, nil
 	}
 
+	if args.matchMode == MATCH_FUZZY && !termQuery.isEmpty() {
+		sortByScore(songs, func(song library.Song) float64 {
+			return scoreSong(args, termQuery, song)
+		})
+	}
+
 	if args.new || args.skipOldFirst {
 		sortByNew(songs, args.sortType)
 	}
@@ -250,7 +297,7 @@ func getSongs(args *PlayArgs, terms []string) ([]string, error) {
 	flatSongs := make([]string, len(songs))
 
 	for i, s := range songs {
-		flatSongs[i] = s.path
+		flatSongs[i] = s.Path
 	}
 
 	if args.edit {
@@ -266,64 +313,68 @@ func getSongs(args *PlayArgs, terms []string) ([]string, error) {
 	return flatSongs, nil
 }
 
-func runVLC(args *PlayArgs, vlcArgs []string) error {
-	if args.dryRun {
-		return nil
-	}
-
-	if args.clear {
-		cmd := exec.Command("vlc", "vlc://quit")
-		err := cmd.Run()
+// the query as it would be typed, stored with the songs it adds to a tag
+func describeQuery(args *PlayArgs, terms []string) string {
+	parts := []string{"play"}
 
-		if err != nil {
-			return err
+	for _, term := range terms {
+		if strings.ContainsAny(term, " \t") {
+			term = strconv.Quote(term)
 		}
 
-		time.Sleep(50 * time.Millisecond)
+		parts = append(parts, term)
 	}
 
-	if args.new || args.playNewFirst {
-		vlcArgs = append(vlcArgs, "--no-random")
-	} else if args.random {
-		vlcArgs = append(vlcArgs, "--random")
+	for _, tag := range args.tags {
+		parts = append(parts, "-t", tag)
 	}
 
-	if args.appendToPlaylist {
-		vlcArgs = append(vlcArgs, "--playlist-enqueue")
-	} else {
-		vlcArgs = append(vlcArgs, "--no-playlist-enqueue")
+	return strings.Join(parts, " ")
+}
+
+// play counts come from the lastfm log db, so without one every song has
+// zero plays
+func getPlayCounts() (map[string]int, error) {
+	config, _ := utils.GetConfig()
+
+	if config.LastFm.LogDbFile == "" {
+		return map[string]int{}, nil
 	}
 
-	var err error
+	db, err := dbUtils.OpenDB(config.LastFm.LogDbFile)
 
-	if args.persist {
-		cmd := exec.Command(args.vlcPath, vlcArgs...)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open log db file")
+	}
 
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+	defer db.Close()
+	playCounts, err := dbUtils.GetPlayCounts(db)
 
-		if err != nil {
-			return err
-		}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get play counts")
+	}
 
-		err = cmd.Run()
-	} else {
-		cmd := exec.Command(args.vlcPath, vlcArgs...)
-		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return playCounts, nil
+}
 
-		err := cmd.Start()
+func runPlayer(args *PlayArgs, player Player, paths []string) error {
+	if args.dryRun {
+		return nil
+	}
 
-		if err != nil {
+	if args.clear {
+		if err := player.Clear(); err != nil {
 			return err
 		}
+	}
 
-		// Detach the terminal
-		_, err = syscall.Setsid()
+	options := loadOptions{playNow: !args.appendToPlaylist, random: RANDOM_UNCHANGED}
 
-		// ignore error
-		return nil
+	if args.new || args.playNewFirst {
+		options.random = RANDOM_OFF
+	} else if args.random {
+		options.random = RANDOM_ON
 	}
 
-	return err
+	return player.Load(paths, options)
 }
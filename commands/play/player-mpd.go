@@ -0,0 +1,334 @@
+package play
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const MPD_TIMEOUT = 5 * time.Second
+
+// talks to mpd over its text protocol. mpd's music_directory is expected to
+// be the same as the music path, since songs are added by their path
+// relative to it.
+type mpdPlayer struct {
+	address   string
+	password  string
+	musicPath string
+}
+
+type mpdConnection struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialMpd(address string, password string) (*mpdConnection, error) {
+	network := "tcp"
+
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+
+	conn, err := net.DialTimeout(network, address, MPD_TIMEOUT)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to mpd at "+address)
+	}
+
+	c := &mpdConnection{conn: conn, reader: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(MPD_TIMEOUT))
+	greeting, err := c.reader.ReadString('\n')
+
+	if err != nil || !strings.HasPrefix(greeting, "OK MPD") {
+		conn.Close()
+		return nil, errors.New("unexpected greeting from mpd at " + address)
+	}
+
+	if password != "" {
+		if _, err := c.command("password", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *mpdConnection) Close() error {
+	return c.conn.Close()
+}
+
+func quoteMpdArgument(arg string) string {
+	arg = strings.ReplaceAll(arg, "\\", "\\\\")
+	arg = strings.ReplaceAll(arg, "\"", "\\\"")
+	return "\"" + arg + "\""
+}
+
+type mpdField struct {
+	key   string
+	value string
+}
+
+// the "key: value" lines of a response, keys can repeat (e.g. one "file" per
+// song in playlistinfo)
+type mpdResponse []mpdField
+
+// the first value for key
+func (r mpdResponse) get(key string) string {
+	for _, field := range r {
+		if field.key == key {
+			return field.value
+		}
+	}
+
+	return ""
+}
+
+func (c *mpdConnection) command(name string, args ...string) (mpdResponse, error) {
+	line := name
+
+	for _, arg := range args {
+		line += " " + quoteMpdArgument(arg)
+	}
+
+	c.conn.SetDeadline(time.Now().Add(MPD_TIMEOUT))
+
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		return nil, errors.Wrap(err, "could not write to mpd")
+	}
+
+	response := mpdResponse{}
+
+	for {
+		responseLine, err := c.reader.ReadString('\n')
+
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read from mpd")
+		}
+
+		responseLine = strings.TrimSuffix(responseLine, "\n")
+
+		if responseLine == "OK" {
+			return response, nil
+		}
+
+		if strings.HasPrefix(responseLine, "ACK ") {
+			return nil, fmt.Errorf("mpd command %s failed: %s", name, responseLine)
+		}
+
+		if key, value, found := strings.Cut(responseLine, ": "); found {
+			response = append(response, mpdField{key, value})
+		}
+	}
+}
+
+// mpd wants paths relative to its music directory, anything outside of the
+// music path can only be added as a file uri (which mpd only allows over a
+// unix socket)
+func (p *mpdPlayer) getUri(path string) string {
+	relativePath, err := filepath.Rel(p.musicPath, path)
+
+	if err != nil || strings.HasPrefix(relativePath, "..") {
+		return "file://" + path
+	}
+
+	if relativePath == "." {
+		return "/"
+	}
+
+	return filepath.ToSlash(relativePath)
+}
+
+// the other way around from getUri
+func (p *mpdPlayer) songPath(uri string) string {
+	if path, isFile := strings.CutPrefix(uri, "file://"); isFile {
+		return path
+	}
+
+	return filepath.Join(p.musicPath, filepath.FromSlash(uri))
+}
+
+func (p *mpdPlayer) Clear() error {
+	return p.run("clear")
+}
+
+func (p *mpdPlayer) Load(paths []string, options loadOptions) error {
+	conn, err := dialMpd(p.address, p.password)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	if options.random != RANDOM_UNCHANGED {
+		random := "0"
+
+		if options.random == RANDOM_ON {
+			random = "1"
+		}
+
+		if _, err := conn.command("random", random); err != nil {
+			return err
+		}
+	}
+
+	status, err := conn.command("status")
+
+	if err != nil {
+		return err
+	}
+
+	playlistLength, _ := strconv.Atoi(status.get("playlistlength"))
+
+	for _, path := range paths {
+		if _, err := conn.command("add", p.getUri(path)); err != nil {
+			return err
+		}
+	}
+
+	if !options.playNow {
+		return nil
+	}
+
+	_, err = conn.command("play", strconv.Itoa(playlistLength))
+	return err
+}
+
+func (p *mpdPlayer) List() ([]queueEntry, error) {
+	conn, err := dialMpd(p.address, p.password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+	status, err := conn.command("status")
+
+	if err != nil {
+		return nil, err
+	}
+
+	playlist, err := conn.command("playlistinfo")
+
+	if err != nil {
+		return nil, err
+	}
+
+	// "song" is only there if something is playing or paused
+	currentPosition := -1
+
+	if status.get("song") != "" {
+		currentPosition, _ = strconv.Atoi(status.get("song"))
+	}
+
+	entries := []queueEntry{}
+
+	for _, field := range playlist {
+		if field.key != "file" {
+			continue
+		}
+
+		entries = append(entries, queueEntry{path: p.songPath(field.value), current: len(entries) == currentPosition})
+	}
+
+	return entries, nil
+}
+
+// runs a single command on a new connection
+func (p *mpdPlayer) run(name string, args ...string) error {
+	conn, err := dialMpd(p.address, p.password)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	_, err = conn.command(name, args...)
+	return err
+}
+
+func (p *mpdPlayer) Remove(position int) error {
+	return p.run("delete", strconv.Itoa(position))
+}
+
+func (p *mpdPlayer) Move(from int, to int) error {
+	return p.run("move", strconv.Itoa(from), strconv.Itoa(to))
+}
+
+func (p *mpdPlayer) Shuffle() error {
+	return p.run("shuffle")
+}
+
+func (p *mpdPlayer) Next() error {
+	return p.run("next")
+}
+
+func (p *mpdPlayer) Pause() error {
+	conn, err := dialMpd(p.address, p.password)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	status, err := conn.command("status")
+
+	if err != nil {
+		return err
+	}
+
+	switch status.get("state") {
+	case "play":
+		_, err = conn.command("pause", "1")
+	case "pause":
+		_, err = conn.command("pause", "0")
+	default:
+		_, err = conn.command("play")
+	}
+
+	return err
+}
+
+func (p *mpdPlayer) Status() (playerStatus, error) {
+	conn, err := dialMpd(p.address, p.password)
+
+	if err != nil {
+		return playerStatus{}, err
+	}
+
+	defer conn.Close()
+	status, err := conn.command("status")
+
+	if err != nil {
+		return playerStatus{}, err
+	}
+
+	result := playerStatus{state: PLAYER_STATE_STOPPED, random: status.get("random") == "1"}
+
+	switch status.get("state") {
+	case "play":
+		result.state = PLAYER_STATE_PLAYING
+	case "pause":
+		result.state = PLAYER_STATE_PAUSED
+	default:
+		return result, nil
+	}
+
+	result.position, _ = strconv.ParseFloat(status.get("elapsed"), 64)
+	result.duration, _ = strconv.ParseFloat(status.get("duration"), 64)
+	song, err := conn.command("currentsong")
+
+	if err != nil {
+		return result, err
+	}
+
+	result.path = p.songPath(song.get("file"))
+	return result, nil
+}
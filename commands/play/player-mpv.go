@@ -0,0 +1,289 @@
+package play
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/kitesi/music/utils"
+)
+
+const MPV_TIMEOUT = 2 * time.Second
+
+func getMpvSocket(config utils.Config) string {
+	if config.Player.MpvSocket != "" {
+		return config.Player.MpvSocket
+	}
+
+	return filepath.Join(os.TempDir(), "go-music-kitesi-mpv.sock")
+}
+
+// talks to a running mpv through its JSON IPC socket, if there isn't one mpv
+// is started with the songs and the socket so the next command can reuse it
+type mpvPlayer struct {
+	path    string
+	socket  string
+	persist bool
+}
+
+type mpvConnection struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	requestId int
+}
+
+type mpvResponse struct {
+	Error     string          `json:"error"`
+	Data      json.RawMessage `json:"data"`
+	RequestId int             `json:"request_id"`
+	Event     string          `json:"event"`
+}
+
+func dialMpv(socket string) (*mpvConnection, error) {
+	conn, err := net.DialTimeout("unix", socket, MPV_TIMEOUT)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &mpvConnection{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (c *mpvConnection) Close() error {
+	return c.conn.Close()
+}
+
+// sends a command and waits for its reply, skipping any events mpv sends in
+// the meantime
+func (c *mpvConnection) command(command ...any) (json.RawMessage, error) {
+	c.requestId++
+	request, err := json.Marshal(map[string]any{"command": command, "request_id": c.requestId})
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.conn.SetDeadline(time.Now().Add(MPV_TIMEOUT))
+
+	if _, err := c.conn.Write(append(request, '\n')); err != nil {
+		return nil, errors.Wrap(err, "could not write to mpv")
+	}
+
+	for {
+		line, err := c.reader.ReadBytes('\n')
+
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read from mpv")
+		}
+
+		var response mpvResponse
+
+		if err := json.Unmarshal(line, &response); err != nil {
+			return nil, errors.Wrap(err, "could not parse mpv response")
+		}
+
+		if response.Event != "" || response.RequestId != c.requestId {
+			continue
+		}
+
+		if response.Error != "success" {
+			return nil, fmt.Errorf("mpv command %v failed: %s", command[0], response.Error)
+		}
+
+		return response.Data, nil
+	}
+}
+
+func (p *mpvPlayer) Clear() error {
+	conn, err := dialMpv(p.socket)
+
+	// nothing running, so nothing to clear
+	if err != nil {
+		return nil
+	}
+
+	defer conn.Close()
+	_, err = conn.command("stop")
+	return err
+}
+
+func (p *mpvPlayer) Load(paths []string, options loadOptions) error {
+	// mpv has no shuffle mode that applies to songs added later, so the new
+	// songs are shuffled before they're added
+	if options.random == RANDOM_ON {
+		paths = append([]string{}, paths...)
+		rand.Shuffle(len(paths), func(i, j int) { paths[i], paths[j] = paths[j], paths[i] })
+	}
+
+	conn, err := dialMpv(p.socket)
+
+	if err != nil {
+		mpvArgs := []string{"--input-ipc-server=" + p.socket, "--no-video"}
+
+		// keep it around in the background so later commands can add to it
+		if !p.persist {
+			mpvArgs = append(mpvArgs, "--idle=yes", "--no-terminal")
+		}
+
+		return startPlayerProcess(p.path, append(mpvArgs, paths...), p.persist)
+	}
+
+	defer conn.Close()
+	data, err := conn.command("get_property", "playlist-count")
+
+	if err != nil {
+		return err
+	}
+
+	var playlistCount int
+
+	if err := json.Unmarshal(data, &playlistCount); err != nil {
+		return errors.Wrap(err, "could not parse mpv playlist-count")
+	}
+
+	for _, path := range paths {
+		if _, err := conn.command("loadfile", path, "append"); err != nil {
+			return err
+		}
+	}
+
+	if !options.playNow {
+		return nil
+	}
+
+	if _, err := conn.command("set_property", "playlist-pos", playlistCount); err != nil {
+		return err
+	}
+
+	_, err = conn.command("set_property", "pause", false)
+	return err
+}
+
+// runs a single command, unlike Load and Clear it's an error if mpv isn't
+// running
+func (p *mpvPlayer) run(command ...any) (json.RawMessage, error) {
+	conn, err := dialMpv(p.socket)
+
+	if err != nil {
+		return nil, errors.New("mpv isn't running (nothing is listening on " + p.socket + ")")
+	}
+
+	defer conn.Close()
+	return conn.command(command...)
+}
+
+func (p *mpvPlayer) List() ([]queueEntry, error) {
+	data, err := p.run("get_property", "playlist")
+
+	if err != nil {
+		return nil, err
+	}
+
+	var playlist []struct {
+		Filename string `json:"filename"`
+		Current  bool   `json:"current"`
+	}
+
+	if err := json.Unmarshal(data, &playlist); err != nil {
+		return nil, errors.Wrap(err, "could not parse mpv playlist")
+	}
+
+	entries := make([]queueEntry, len(playlist))
+
+	for i, entry := range playlist {
+		entries[i] = queueEntry{path: entry.Filename, current: entry.Current}
+	}
+
+	return entries, nil
+}
+
+func (p *mpvPlayer) Remove(position int) error {
+	_, err := p.run("playlist-remove", position)
+	return err
+}
+
+func (p *mpvPlayer) Move(from int, to int) error {
+	// mpv moves the song in front of the song at the second index
+	if to > from {
+		to++
+	}
+
+	_, err := p.run("playlist-move", from, to)
+	return err
+}
+
+func (p *mpvPlayer) Shuffle() error {
+	_, err := p.run("playlist-shuffle")
+	return err
+}
+
+func (p *mpvPlayer) Next() error {
+	_, err := p.run("playlist-next")
+	return err
+}
+
+func (p *mpvPlayer) Pause() error {
+	_, err := p.run("cycle", "pause")
+	return err
+}
+
+func (p *mpvPlayer) Status() (playerStatus, error) {
+	conn, err := dialMpv(p.socket)
+
+	if err != nil {
+		return playerStatus{}, errors.New("mpv isn't running (nothing is listening on " + p.socket + ")")
+	}
+
+	defer conn.Close()
+	status := playerStatus{state: PLAYER_STATE_STOPPED}
+	var idle, paused bool
+
+	if err := getMpvProperty(conn, "idle-active", &idle); err != nil {
+		return status, err
+	}
+
+	if idle {
+		return status, nil
+	}
+
+	if err := getMpvProperty(conn, "pause", &paused); err != nil {
+		return status, err
+	}
+
+	status.state = PLAYER_STATE_PLAYING
+
+	if paused {
+		status.state = PLAYER_STATE_PAUSED
+	}
+
+	if err := getMpvProperty(conn, "path", &status.path); err != nil {
+		return status, err
+	}
+
+	// unavailable while a song is still loading, they stay 0 then
+	getMpvProperty(conn, "time-pos", &status.position)
+	getMpvProperty(conn, "duration", &status.duration)
+	getMpvProperty(conn, "shuffle", &status.random)
+	return status, nil
+}
+
+func getMpvProperty(conn *mpvConnection, name string, out any) error {
+	data, err := conn.command("get_property", name)
+
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, out); err != nil {
+		return errors.Wrap(err, "could not parse mpv "+name)
+	}
+
+	return nil
+}
@@ -0,0 +1,372 @@
+package play
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/kitesi/music/utils"
+)
+
+const (
+	VLC_TIMEOUT = 2 * time.Second
+	// of the generated http password, which is twice as many hex characters
+	VLC_PASSWORD_BYTES = 16
+)
+
+// vlc is controlled through its http interface when one is reachable,
+// otherwise it's launched with the songs and the http interface turned on so
+// the next command can talk to it
+type vlcPlayer struct {
+	path         string
+	httpAddress  string
+	httpPassword string
+	persist      bool
+}
+
+type vlcStatus struct {
+	State       string `json:"state"`
+	Random      bool   `json:"random"`
+	Time        int    `json:"time"`
+	Length      int    `json:"length"`
+	CurrentPlid int    `json:"currentplid"`
+}
+
+// sends a request to one of vlc's /requests/ endpoints and decodes the
+// response into out. ok is false if nothing is listening, in which case err is
+// nil.
+func (p *vlcPlayer) request(endpoint string, params url.Values, out any) (ok bool, err error) {
+	if p.httpPassword == "" {
+		return false, nil
+	}
+
+	requestUrl := fmt.Sprintf("http://%s/requests/%s?%s", p.httpAddress, endpoint, params.Encode())
+	req, err := http.NewRequest("GET", requestUrl, nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	// vlc only uses the password, the user is always empty
+	req.SetBasicAuth("", p.httpPassword)
+	client := http.Client{Timeout: VLC_TIMEOUT}
+	resp, err := client.Do(req)
+
+	if err != nil {
+		var netErr *net.OpError
+
+		if errors.As(err, &netErr) && netErr.Op == "dial" {
+			return false, nil
+		}
+
+		return false, errors.Wrap(err, "could not reach vlc")
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return false, errors.New("vlc rejected the http password (player.vlcHttpPassword)")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New("vlc responded with " + resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return false, errors.Wrap(err, "could not parse vlc response")
+	}
+
+	return true, nil
+}
+
+// sends a command to status.json (an empty command only gets the status)
+func (p *vlcPlayer) command(command string, params url.Values) (status vlcStatus, ok bool, err error) {
+	if params == nil {
+		params = url.Values{}
+	}
+
+	if command != "" {
+		params.Set("command", command)
+	}
+
+	ok, err = p.request("status.json", params, &status)
+	return status, ok, err
+}
+
+func (p *vlcPlayer) unreachableError() error {
+	return errors.New("vlc's http interface isn't reachable at " + p.httpAddress + " (player.vlcHttpAddress)")
+}
+
+// like command, but it's an error if vlc can't be reached
+func (p *vlcPlayer) run(command string, params url.Values) error {
+	_, ok, err := p.command(command, params)
+
+	if err == nil && !ok {
+		return p.unreachableError()
+	}
+
+	return err
+}
+
+type vlcPlaylistNode struct {
+	Id       string            `json:"id"`
+	Name     string            `json:"name"`
+	Uri      string            `json:"uri"`
+	Current  string            `json:"current"`
+	Children []vlcPlaylistNode `json:"children"`
+}
+
+// the "Playlist" node, as opposed to the media library
+func (p *vlcPlayer) playlist() (vlcPlaylistNode, error) {
+	var root vlcPlaylistNode
+	ok, err := p.request("playlist.json", url.Values{}, &root)
+
+	if err != nil {
+		return root, err
+	}
+
+	if !ok {
+		return root, p.unreachableError()
+	}
+
+	for _, child := range root.Children {
+		if child.Name == "Playlist" {
+			return child, nil
+		}
+	}
+
+	if len(root.Children) == 0 {
+		return root, errors.New("unexpected playlist from vlc")
+	}
+
+	return root.Children[0], nil
+}
+
+func vlcUri(path string) string {
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+func (p *vlcPlayer) Clear() error {
+	_, ok, err := p.command("pl_empty", nil)
+
+	if err != nil || ok {
+		return err
+	}
+
+	// nothing is listening, so there's no vlc with a playlist to clear (one
+	// started by hand without the http interface still gets its playlist
+	// replaced by --no-playlist-enqueue when the songs are loaded)
+	return nil
+}
+
+func (p *vlcPlayer) List() ([]queueEntry, error) {
+	playlist, err := p.playlist()
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]queueEntry, len(playlist.Children))
+
+	for i, item := range playlist.Children {
+		path := item.Name
+
+		if uri, err := url.Parse(item.Uri); err == nil && uri.Scheme == "file" {
+			path = uri.Path
+		}
+
+		entries[i] = queueEntry{path: path, current: item.Current == "current"}
+	}
+
+	return entries, nil
+}
+
+func (p *vlcPlayer) Remove(position int) error {
+	playlist, err := p.playlist()
+
+	if err != nil {
+		return err
+	}
+
+	if position < 0 || position >= len(playlist.Children) {
+		return errors.New("position out of range")
+	}
+
+	return p.run("pl_delete", url.Values{"id": {playlist.Children[position].Id}})
+}
+
+func (p *vlcPlayer) Move(from int, to int) error {
+	playlist, err := p.playlist()
+
+	if err != nil {
+		return err
+	}
+
+	items := playlist.Children
+
+	if from < 0 || from >= len(items) || to < 0 || to >= len(items) {
+		return errors.New("position out of range")
+	}
+
+	// vlc puts the song after the target, or first if the target is the
+	// playlist itself
+	target := playlist.Id
+
+	if to > from {
+		target = items[to].Id
+	} else if to > 0 {
+		target = items[to-1].Id
+	}
+
+	return p.run("pl_move", url.Values{"psource": {items[from].Id}, "pid": {target}})
+}
+
+func (p *vlcPlayer) Shuffle() error {
+	return p.run("pl_sort", url.Values{"id": {"0"}, "val": {"random"}})
+}
+
+func (p *vlcPlayer) Next() error {
+	return p.run("pl_next", nil)
+}
+
+// pl_pause toggles, and starts playing when stopped
+func (p *vlcPlayer) Pause() error {
+	return p.run("pl_pause", nil)
+}
+
+func (p *vlcPlayer) Status() (playerStatus, error) {
+	status, ok, err := p.command("", nil)
+
+	if err != nil {
+		return playerStatus{}, err
+	}
+
+	if !ok {
+		return playerStatus{}, p.unreachableError()
+	}
+
+	// vlc's states are the same as ours
+	result := playerStatus{state: status.State, position: float64(status.Time), duration: float64(status.Length), random: status.Random}
+
+	if status.State == PLAYER_STATE_STOPPED {
+		return result, nil
+	}
+
+	entries, err := p.List()
+
+	if err != nil {
+		return result, err
+	}
+
+	for _, entry := range entries {
+		if entry.current {
+			result.path = entry.path
+		}
+	}
+
+	return result, nil
+}
+
+func (p *vlcPlayer) Load(paths []string, options loadOptions) error {
+	status, ok, err := p.command("", nil)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return p.launch(paths, options)
+	}
+
+	// pl_random toggles, so only send it if it needs to change
+	if options.random != RANDOM_UNCHANGED && status.Random != (options.random == RANDOM_ON) {
+		if _, _, err := p.command("pl_random", nil); err != nil {
+			return err
+		}
+	}
+
+	for i, path := range paths {
+		command := "in_enqueue"
+
+		// in_play adds the song and jumps to it
+		if i == 0 && options.playNow {
+			command = "in_play"
+		}
+
+		if _, _, err := p.command(command, url.Values{"input": {vlcUri(path)}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *vlcPlayer) launch(paths []string, options loadOptions) error {
+	vlcArgs := append([]string{"--recursive=expand"}, paths...)
+
+	if p.httpPassword != "" {
+		host, port, err := net.SplitHostPort(p.httpAddress)
+
+		if err != nil {
+			return errors.Wrap(err, "invalid player.vlcHttpAddress")
+		}
+
+		vlcArgs = append(vlcArgs, "--extraintf=http", "--http-host="+host, "--http-port="+port, "--http-password="+p.httpPassword)
+	}
+
+	if options.random == RANDOM_OFF {
+		vlcArgs = append(vlcArgs, "--no-random")
+	} else if options.random == RANDOM_ON {
+		vlcArgs = append(vlcArgs, "--random")
+	}
+
+	// if vlc is already running without the http interface, its one instance
+	// mode still picks up the songs
+	if options.playNow {
+		vlcArgs = append(vlcArgs, "--no-playlist-enqueue")
+	} else {
+		vlcArgs = append(vlcArgs, "--playlist-enqueue")
+	}
+
+	return startPlayerProcess(p.path, vlcArgs, p.persist)
+}
+
+// vlc only turns its http interface on with a password, so one is made up
+// and saved to the config the first time instead of shipping a default
+// everyone knows
+func getVlcHttpPassword(config utils.Config) (string, error) {
+	if config.Player.VlcHttpPassword != "" {
+		return config.Player.VlcHttpPassword, nil
+	}
+
+	password := ""
+
+	err := utils.UpdateConfig(func(config *utils.Config) error {
+		// another command may have saved one in the meantime
+		if config.Player.VlcHttpPassword == "" {
+			randomBytes := make([]byte, VLC_PASSWORD_BYTES)
+
+			if _, err := rand.Read(randomBytes); err != nil {
+				return err
+			}
+
+			config.Player.VlcHttpPassword = hex.EncodeToString(randomBytes)
+		}
+
+		password = config.Player.VlcHttpPassword
+		return nil
+	})
+
+	if err != nil {
+		return "", errors.Wrap(err, "could not save a vlc http password (player.vlcHttpPassword)")
+	}
+
+	return password, nil
+}
@@ -0,0 +1,348 @@
+package play
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kitesi/music/utils"
+)
+
+const TEST_VLC_PASSWORD = "secret"
+
+// answers /requests/status.json and /requests/playlist.json like vlc's http
+// interface and remembers the commands it got
+type fakeVlc struct {
+	mu       sync.Mutex
+	random   bool
+	paused   bool
+	commands []string
+	playlist vlcPlaylistNode
+}
+
+func (f *fakeVlc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, password, ok := r.BasicAuth(); !ok || password != TEST_VLC_PASSWORD {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/requests/status.json":
+		query := r.URL.Query()
+
+		if command := query.Get("command"); command != "" {
+			for _, key := range []string{"input", "id", "psource", "pid", "val"} {
+				if query.Has(key) {
+					command += " " + key + "=" + query.Get(key)
+				}
+			}
+
+			f.commands = append(f.commands, command)
+
+			switch query.Get("command") {
+			case "pl_random":
+				f.random = !f.random
+			case "pl_pause":
+				f.paused = !f.paused
+			}
+		}
+
+		state := PLAYER_STATE_PLAYING
+
+		if f.paused {
+			state = PLAYER_STATE_PAUSED
+		}
+
+		json.NewEncoder(w).Encode(vlcStatus{State: state, Random: f.random, Time: 62, Length: 215})
+	case "/requests/playlist.json":
+		json.NewEncoder(w).Encode(vlcPlaylistNode{Id: "1", Children: []vlcPlaylistNode{f.playlist, {Id: "2", Name: "Media Library"}}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeVlc) getCommands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.commands...)
+}
+
+func startFakeVlc(t *testing.T) (*fakeVlc, *vlcPlayer) {
+	t.Helper()
+
+	fake := &fakeVlc{
+		playlist: vlcPlaylistNode{Id: "3", Name: "Playlist", Children: []vlcPlaylistNode{
+			{Id: "4", Name: "a.mp3", Uri: "file:///music/a.mp3"},
+			{Id: "5", Name: "b b.mp3", Uri: "file:///music/b%20b.mp3", Current: "current"},
+			{Id: "6", Name: "stream", Uri: "http://example.com/stream"},
+		}},
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, &vlcPlayer{httpAddress: strings.TrimPrefix(server.URL, "http://"), httpPassword: TEST_VLC_PASSWORD}
+}
+
+func TestVlcLoad(t *testing.T) {
+	fake, player := startFakeVlc(t)
+
+	if err := player.Load([]string{"/music/a.mp3", "/music/b b.mp3"}, loadOptions{playNow: true, random: RANDOM_ON}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"pl_random",
+		"in_play input=file:///music/a.mp3",
+		"in_enqueue input=file:///music/b%20b.mp3",
+	}
+
+	if got := fake.getCommands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestVlcEnqueue(t *testing.T) {
+	fake, player := startFakeVlc(t)
+
+	// shuffle is already off, so it's left alone
+	if err := player.Load([]string{"/music/a.mp3", "/music/c.mp3"}, loadOptions{random: RANDOM_OFF}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"in_enqueue input=file:///music/a.mp3",
+		"in_enqueue input=file:///music/c.mp3",
+	}
+
+	if got := fake.getCommands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestVlcPlaylist(t *testing.T) {
+	fake, player := startFakeVlc(t)
+	entries, err := player.List()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantEntries := []queueEntry{{path: "/music/a.mp3"}, {path: "/music/b b.mp3", current: true}, {path: "stream"}}
+
+	if !reflect.DeepEqual(entries, wantEntries) {
+		t.Errorf("List() = %+v, want %+v", entries, wantEntries)
+	}
+
+	if err := player.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := player.Move(0, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := player.Move(2, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := player.Remove(3); err == nil {
+		t.Errorf("Remove(3) should be out of range")
+	}
+
+	want := []string{"pl_delete id=5", "pl_move psource=4 pid=6", "pl_move psource=6 pid=3"}
+
+	if got := fake.getCommands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestVlcPauseAndStatus(t *testing.T) {
+	fake, player := startFakeVlc(t)
+	status, err := player.Status()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := playerStatus{state: PLAYER_STATE_PLAYING, path: "/music/b b.mp3", position: 62, duration: 215}
+
+	if status != want {
+		t.Errorf("Status() = %+v, want %+v", status, want)
+	}
+
+	if err := player.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, err := player.Status(); err != nil || status.state != PLAYER_STATE_PAUSED {
+		t.Errorf("Status() after Pause() = %+v, %v, want paused", status, err)
+	}
+
+	if got := fake.getCommands(); !reflect.DeepEqual(got, []string{"pl_pause"}) {
+		t.Errorf("commands = %q, want [pl_pause]", got)
+	}
+}
+
+func TestVlcAuthFailure(t *testing.T) {
+	fake, player := startFakeVlc(t)
+	player.httpPassword = "wrong"
+
+	err := player.Load([]string{"/music/a.mp3"}, loadOptions{playNow: true})
+
+	if err == nil || !strings.Contains(err.Error(), "rejected the http password") {
+		t.Errorf("Load with the wrong password returned %v, want a password error", err)
+	}
+
+	if _, err := player.List(); err == nil {
+		t.Errorf("List with the wrong password should fail")
+	}
+
+	if got := fake.getCommands(); len(got) != 0 {
+		t.Errorf("vlc got commands with the wrong password: %q", got)
+	}
+}
+
+// a stand in for the vlc binary that writes its arguments to a file
+func fakeVlcBinary(t *testing.T) (string, string) {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script as the vlc binary")
+	}
+
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	binary := filepath.Join(dir, "vlc")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > '" + argsFile + "'\n"
+
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return binary, argsFile
+}
+
+func readLaunchArgs(t *testing.T, argsFile string) []string {
+	t.Helper()
+	content, err := os.ReadFile(argsFile)
+
+	if err != nil {
+		t.Fatalf("vlc wasn't launched: %s", err)
+	}
+
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func TestVlcEmptyPasswordLaunches(t *testing.T) {
+	fake, player := startFakeVlc(t)
+	binary, argsFile := fakeVlcBinary(t)
+
+	// with the default empty password the http interface is never used, even
+	// when something is listening
+	player.httpPassword = ""
+	player.path = binary
+	player.persist = true
+
+	if err := player.Load([]string{"/music/a.mp3"}, loadOptions{playNow: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"--recursive=expand", "/music/a.mp3", "--no-playlist-enqueue"}
+
+	if got := readLaunchArgs(t, argsFile); !reflect.DeepEqual(got, want) {
+		t.Errorf("vlc args = %q, want %q", got, want)
+	}
+
+	if got := fake.getCommands(); len(got) != 0 {
+		t.Errorf("vlc got commands without a password: %q", got)
+	}
+}
+
+func TestVlcLaunchesWhenNothingListens(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	address := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+
+	binary, argsFile := fakeVlcBinary(t)
+	player := &vlcPlayer{path: binary, httpAddress: address, httpPassword: TEST_VLC_PASSWORD, persist: true}
+
+	if err := player.Load([]string{"/music/a.mp3"}, loadOptions{random: RANDOM_ON}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readLaunchArgs(t, argsFile)
+
+	for _, arg := range []string{"--extraintf=http", "--http-password=" + TEST_VLC_PASSWORD, "--random", "--playlist-enqueue"} {
+		if !strings.Contains(strings.Join(got, "\n")+"\n", arg+"\n") {
+			t.Errorf("vlc args %q are missing %s", got, arg)
+		}
+	}
+}
+
+func TestVlcClearWithoutVlc(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	address := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+
+	binary, argsFile := fakeVlcBinary(t)
+	player := &vlcPlayer{path: binary, httpAddress: address, httpPassword: TEST_VLC_PASSWORD}
+
+	if err := player.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	// no more vlc://quit
+	if _, err := os.Stat(argsFile); err == nil {
+		t.Errorf("Clear ran vlc with %q", readLaunchArgs(t, argsFile))
+	}
+}
+
+func TestGetVlcHttpPassword(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	config, err := utils.GetConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	password, err := getVlcHttpPassword(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(password) != VLC_PASSWORD_BYTES*2 {
+		t.Errorf("generated password %q, want %d hex characters", password, VLC_PASSWORD_BYTES*2)
+	}
+
+	config, err = utils.GetConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Player.VlcHttpPassword != password {
+		t.Errorf("saved password %q, want %q", config.Player.VlcHttpPassword, password)
+	}
+
+	if again, err := getVlcHttpPassword(config); err != nil || again != password {
+		t.Errorf("second call returned %q, %v, want the saved %q", again, err, password)
+	}
+
+	config.Player.VlcHttpPassword = "mine"
+
+	if own, err := getVlcHttpPassword(config); err != nil || own != "mine" {
+		t.Errorf("a configured password was replaced with %q, %v", own, err)
+	}
+}
@@ -0,0 +1,125 @@
+package play
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/kitesi/music/utils"
+)
+
+const (
+	PLAYER_VLC = "vlc"
+	PLAYER_MPV = "mpv"
+	PLAYER_MPD = "mpd"
+)
+
+type randomMode int
+
+const (
+	// leave the player's shuffle setting alone
+	RANDOM_UNCHANGED randomMode = iota
+	RANDOM_ON
+	RANDOM_OFF
+)
+
+type loadOptions struct {
+	// start playing the first of the new songs right away, otherwise they
+	// are only added to the end of the playlist
+	playNow bool
+	random  randomMode
+}
+
+const (
+	PLAYER_STATE_PLAYING = "playing"
+	PLAYER_STATE_PAUSED  = "paused"
+	PLAYER_STATE_STOPPED = "stopped"
+)
+
+// what the player is doing, position and duration are in seconds (0 if
+// unknown)
+type playerStatus struct {
+	state string
+	// the current song, empty when stopped
+	path     string
+	position float64
+	duration float64
+	random   bool
+}
+
+type queueEntry struct {
+	path string
+	// the song that's playing (or paused)
+	current bool
+}
+
+// something that can play the songs `music play` finds. Paths are absolute
+// and can be directories, which are added recursively. Positions in the
+// playlist start at 0.
+type Player interface {
+	// stops playback and empties the playlist
+	Clear() error
+	Load(paths []string, options loadOptions) error
+	List() ([]queueEntry, error)
+	Remove(position int) error
+	// moves the song so it ends up at position to
+	Move(from int, to int) error
+	Shuffle() error
+	Next() error
+	// pauses playback, or resumes it if it's paused or stopped
+	Pause() error
+	Status() (playerStatus, error)
+}
+
+func newPlayer(args *PlayArgs) (Player, error) {
+	config, _ := utils.GetConfig()
+
+	switch args.player {
+	case PLAYER_VLC:
+		password, err := getVlcHttpPassword(config)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &vlcPlayer{
+			path:         args.vlcPath,
+			httpAddress:  config.Player.VlcHttpAddress,
+			httpPassword: password,
+			persist:      args.persist,
+		}, nil
+	case PLAYER_MPV:
+		return &mpvPlayer{path: config.Player.MpvPath, socket: getMpvSocket(config), persist: args.persist}, nil
+	case PLAYER_MPD:
+		return &mpdPlayer{address: config.Player.MpdAddress, password: config.Player.MpdPassword, musicPath: args.musicPath}, nil
+	}
+
+	return nil, errors.New("invalid --player, expected value of 'vlc'|'mpv'|'mpd'")
+}
+
+// runs the player in the foreground if persist is set, otherwise starts it in
+// its own process group so it outlives the command
+func startPlayerProcess(path string, playerArgs []string, persist bool) error {
+	cmd := exec.Command(path, playerArgs...)
+
+	if persist {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		return cmd.Run()
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Detach the terminal
+	_, _ = syscall.Setsid()
+
+	// ignore error
+	return nil
+}
@@ -0,0 +1,278 @@
+package play
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kitesi/music/library"
+	"github.com/kitesi/music/utils"
+)
+
+// fields that can prefix a term (e.g. "artist:mitski"), read from the
+// embedded tags stored in the library index
+var queryFields = map[string]func(song library.Song) string{
+	"artist": func(song library.Song) string { return song.Artist },
+	"album":  func(song library.Song) string { return song.Album },
+	"title":  func(song library.Song) string { return song.Title },
+	"genre":  func(song library.Song) string { return song.Genre },
+}
+
+type numericField struct {
+	// ok is false if the song doesn't have a value for this field
+	value func(args *PlayArgs, song library.Song) (value float64, ok bool)
+	parse func(value string) (float64, error)
+	// "field:x" matches values in [x, x+unit), so "added:2024-01-01" matches
+	// the whole day. The upper end of a range is inclusive in the same way.
+	unit float64
+}
+
+// fields that take comparisons ("year:<2000", "duration:2m..4m") rather than
+// substrings
+var numericQueryFields = map[string]numericField{
+	"year": {
+		value: func(_ *PlayArgs, song library.Song) (float64, bool) {
+			return float64(song.Year), song.Year != 0
+		},
+		parse: parseNumber,
+		unit:  1,
+	},
+	"duration": {
+		value: func(_ *PlayArgs, song library.Song) (float64, bool) {
+			return song.Duration, song.Duration > 0
+		},
+		parse: parseDurationValue,
+		unit:  60,
+	},
+	"bitrate": {
+		value: func(_ *PlayArgs, song library.Song) (float64, bool) {
+			return float64(song.Bitrate), song.Bitrate > 0
+		},
+		parse: parseNumber,
+		unit:  1,
+	},
+	"plays": {
+		value: func(args *PlayArgs, song library.Song) (float64, bool) {
+			return float64(args.playCounts[strings.ToLower(song.Artist)+"\x00"+strings.ToLower(song.Title)]), true
+		},
+		parse: parseNumber,
+		unit:  1,
+	},
+	// uses the same timestamp as --sort-type
+	"added": {
+		value: func(args *PlayArgs, song library.Song) (float64, bool) {
+			timestamp := song.ModTime
+
+			if args.sortType == "a" {
+				timestamp = song.AccessTime
+			} else if args.sortType == "c" {
+				timestamp = song.ChangeTime
+			}
+
+			return float64(timestamp.Unix()), true
+		},
+		parse: parseAddedValue,
+		unit:  24 * 60 * 60,
+	},
+}
+
+// splits "field:value" into its parts, ok is false if the term doesn't start
+// with a known field so paths that happen to contain a colon still work
+func parseFieldTerm(term string) (field string, value string, ok bool) {
+	field, value, found := strings.Cut(term, ":")
+
+	if !found {
+		return "", "", false
+	}
+
+	_, isTextField := queryFields[field]
+	_, isNumericField := numericQueryFields[field]
+
+	if !isTextField && !isNumericField {
+		return "", "", false
+	}
+
+	return field, value, true
+}
+
+// "field:value" matches if the field contains value (or however --match
+// decides), "field:=value" only matches if the field is exactly value. Both
+// are case insensitive. Numeric fields are compared instead, see
+// parseComparison. m is the matcher for the term and rawValue keeps the
+// original case for regexes.
+func scoreFieldTerm(args *PlayArgs, m *matcher, song library.Song, field string, value string, rawValue string) float64 {
+	if numeric, isNumeric := numericQueryFields[field]; isNumeric {
+		songValue, ok := numeric.value(args, song)
+
+		if !ok {
+			return 0
+		}
+
+		comparison, err := parseComparison(value, numeric)
+
+		// terms are checked with checkFieldTerms before any song is tested,
+		// so this shouldn't happen
+		if err != nil || !comparison.matches(songValue) {
+			return 0
+		}
+
+		return 1
+	}
+
+	fieldValue := strings.ToLower(queryFields[field](song))
+
+	if exactValue, isExact := strings.CutPrefix(value, "="); isExact {
+		if fieldValue == exactValue {
+			return 1
+		}
+
+		return 0
+	}
+
+	return m.score(value, rawValue, fieldValue)
+}
+
+type comparison struct {
+	operator string
+	value    float64
+	// only used by ".."
+	upper float64
+	unit  float64
+}
+
+// parses "<x", "<=x", ">x", ">=x", "=x", "x" and ranges "x..y" where either
+// side of the range can be left out
+func parseComparison(value string, field numericField) (comparison, error) {
+	if lower, upper, isRange := strings.Cut(value, ".."); isRange {
+		c := comparison{operator: "..", value: math.Inf(-1), upper: math.Inf(1), unit: field.unit}
+		var err error
+
+		if lower != "" {
+			if c.value, err = field.parse(lower); err != nil {
+				return c, err
+			}
+		}
+
+		if upper != "" {
+			if c.upper, err = field.parse(upper); err != nil {
+				return c, err
+			}
+		}
+
+		// "added:30d..7d" reads naturally but parses backwards
+		if c.value > c.upper {
+			c.value, c.upper = c.upper, c.value
+		}
+
+		return c, nil
+	}
+
+	c := comparison{operator: "=", unit: field.unit}
+
+	for _, operator := range []string{"<=", ">=", "<", ">", "="} {
+		if rest, ok := strings.CutPrefix(value, operator); ok {
+			c.operator = operator
+			value = rest
+			break
+		}
+	}
+
+	parsed, err := field.parse(value)
+	c.value = parsed
+	return c, err
+}
+
+func (c comparison) matches(v float64) bool {
+	switch c.operator {
+	case "<":
+		return v < c.value
+	case "<=":
+		return v <= c.value
+	case ">":
+		return v > c.value
+	case ">=":
+		return v >= c.value
+	case "..":
+		return v >= c.value && v < c.upper+c.unit
+	}
+
+	return v >= c.value && v < c.value+c.unit
+}
+
+func parseNumber(value string) (float64, error) {
+	number, err := strconv.ParseFloat(value, 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("expected a number, got \"%s\"", value)
+	}
+
+	return number, nil
+}
+
+// plain numbers are seconds, otherwise a go duration like "3m" or "3m30s"
+func parseDurationValue(value string) (float64, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return seconds, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+
+	if err != nil {
+		return 0, fmt.Errorf("expected a duration like 90, 3m or 3m30s, got \"%s\"", value)
+	}
+
+	return duration.Seconds(), nil
+}
+
+// an age is turned into the point in time that long ago, so "added:>30d"
+// means added within the last 30 days
+func parseAddedValue(value string) (float64, error) {
+	date, err := utils.ParseDateOrAge(value, time.Now())
+
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(date.Unix()), nil
+}
+
+// makes sure every numeric field in the query can be parsed, so a typo is an
+// error rather than silently matching nothing
+func checkFieldTerms(q query) error {
+	var err error
+
+	q.walkLiterals(func(literal literalNode) {
+		if err != nil || literal.quoted {
+			return
+		}
+
+		field, value, ok := parseFieldTerm(literal.value)
+
+		if !ok {
+			return
+		}
+
+		if numeric, isNumeric := numericQueryFields[field]; isNumeric {
+			if _, parseErr := parseComparison(value, numeric); parseErr != nil {
+				err = errors.New("invalid " + field + " in \"" + literal.value + "\": " + parseErr.Error())
+			}
+		}
+	})
+
+	return err
+}
+
+func usesField(q query, name string) bool {
+	found := false
+
+	q.walkLiterals(func(literal literalNode) {
+		if field, _, ok := parseFieldTerm(literal.value); ok && !literal.quoted && field == name {
+			found = true
+		}
+	})
+
+	return found
+}
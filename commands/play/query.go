@@ -0,0 +1,502 @@
+package play
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+/*
+   The query language, loosest to tightest binding:
+
+   - terms: operands that aren't joined by an operator (usually separate
+     arguments). A song has to match at least one term and none of the
+     negated ones, same as before the language existed
+   - OR
+   - AND
+   - # (and)
+   - , (or)
+   - NOT, ! (a "!" at the very start of a term negates the whole term)
+   - (groups), "quoted literals", 'quoted literals', words
+
+   Words inside one argument that are only separated by spaces form a single
+   literal, so "make time" still searches for "make time". "(" and "!" are
+   only operators where an operand is expected and ")" only closes an open
+   group, so "song (live)" still works as a literal too. Quotes only open at
+   the start of a word and when they are closed later on, so apostrophes are
+   just characters. A backslash escapes any of those special characters.
+
+   With --match regex the words are patterns, so they are taken as they are
+   up to the next whitespace: "#" and "," aren't operators, backslashes are
+   kept, and "(" and ")" are only groups when they stand alone. That way
+   a{2,3} and \(live\) reach the regex untouched.
+*/
+
+// characters a backslash can escape
+const QUERY_SPECIAL_CHARACTERS = "#,()!\"'\\ "
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenLeftParen
+	tokenRightParen
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenHash
+	tokenComma
+	tokenBang
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	// the word started with a quote, so it is never treated as a field
+	quoted bool
+}
+
+type queryNode interface {
+	eval(validate func(literal literalNode) bool) bool
+	// how well the node matches from 0 to 1, used to rank fuzzy results
+	score(scoreLiteral func(literal literalNode) float64) float64
+}
+
+type literalNode struct {
+	// lowercase, raw keeps the original case for regexes
+	value  string
+	raw    string
+	quoted bool
+	// under a NOT (or an odd amount of them)
+	negated bool
+}
+
+type andNode struct {
+	left, right queryNode
+}
+
+type orNode struct {
+	left, right queryNode
+}
+
+type notNode struct {
+	node queryNode
+}
+
+func (n literalNode) eval(validate func(literalNode) bool) bool {
+	return validate(n)
+}
+
+func (n andNode) eval(validate func(literalNode) bool) bool {
+	return n.left.eval(validate) && n.right.eval(validate)
+}
+
+func (n orNode) eval(validate func(literalNode) bool) bool {
+	return n.left.eval(validate) || n.right.eval(validate)
+}
+
+func (n notNode) eval(validate func(literalNode) bool) bool {
+	return !n.node.eval(validate)
+}
+
+func (n literalNode) score(scoreLiteral func(literalNode) float64) float64 {
+	return scoreLiteral(n)
+}
+
+func (n andNode) score(scoreLiteral func(literalNode) float64) float64 {
+	return min(n.left.score(scoreLiteral), n.right.score(scoreLiteral))
+}
+
+func (n orNode) score(scoreLiteral func(literalNode) float64) float64 {
+	return max(n.left.score(scoreLiteral), n.right.score(scoreLiteral))
+}
+
+// negations only filter, they don't say anything about how good a match is
+func (n notNode) score(_ func(literalNode) float64) float64 {
+	return 1
+}
+
+type query struct {
+	terms []queryNode
+}
+
+// a song has to match at least one of the terms (if there are any) and none
+// of the negated terms
+func (q query) matches(validate func(literal literalNode) bool) bool {
+	passedOneTerm := true
+	hasPositiveTerm := false
+
+	for _, term := range q.terms {
+		if _, isNegated := term.(notNode); isNegated {
+			if !term.eval(validate) {
+				return false
+			}
+
+			continue
+		}
+
+		if !hasPositiveTerm {
+			hasPositiveTerm = true
+			passedOneTerm = false
+		}
+
+		if !passedOneTerm && term.eval(validate) {
+			passedOneTerm = true
+		}
+	}
+
+	return passedOneTerm
+}
+
+// the best score of the terms that aren't negated
+func (q query) score(scoreLiteral func(literal literalNode) float64) float64 {
+	best := 1.0
+	hasPositiveTerm := false
+
+	for _, term := range q.terms {
+		if _, isNegated := term.(notNode); isNegated {
+			continue
+		}
+
+		termScore := term.score(scoreLiteral)
+
+		if !hasPositiveTerm || termScore > best {
+			best = termScore
+		}
+
+		hasPositiveTerm = true
+	}
+
+	return best
+}
+
+func (q query) isEmpty() bool {
+	return len(q.terms) == 0
+}
+
+// calls fn for every literal in the query
+func (q query) walkLiterals(fn func(literal literalNode)) {
+	var walk func(node queryNode)
+
+	walk = func(node queryNode) {
+		switch n := node.(type) {
+		case literalNode:
+			fn(n)
+		case andNode:
+			walk(n.left)
+			walk(n.right)
+		case orNode:
+			walk(n.left)
+			walk(n.right)
+		case notNode:
+			walk(n.node)
+		}
+	}
+
+	for _, term := range q.terms {
+		walk(term)
+	}
+}
+
+// appends the tokens of one argument, depth is the amount of open groups
+// (which can span arguments) and is returned updated. regexMode takes words
+// as they are, see the comment at the top.
+func tokenizeArg(tokens []token, arg string, depth int, regexMode bool) ([]token, int) {
+	runes := []rune(arg)
+	argStart := len(tokens)
+
+	// a parenthesis is always a group outside of regex mode
+	isGroup := func(i int) bool {
+		return !regexMode || i+1 >= len(runes) || unicode.IsSpace(runes[i+1])
+	}
+
+	followsOperand := func() bool {
+		if len(tokens) == 0 {
+			return false
+		}
+
+		kind := tokens[len(tokens)-1].kind
+		return kind == tokenWord || kind == tokenRightParen
+	}
+
+	// the start of an argument counts as an operand position so that
+	// "music play a NOT b" and "music play a ( b OR c )" work
+	expectingOperand := func() bool {
+		return len(tokens) == argStart || !followsOperand()
+	}
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		if unicode.IsSpace(r) {
+			i++
+			continue
+		}
+
+		if expectingOperand() {
+			if r == '(' && isGroup(i) {
+				tokens = append(tokens, token{kind: tokenLeftParen})
+				depth++
+				i++
+				continue
+			}
+
+			if r == '!' {
+				tokens = append(tokens, token{kind: tokenBang})
+				i++
+				continue
+			}
+		}
+
+		switch {
+		case r == ')' && depth > 0 && isGroup(i):
+			tokens = append(tokens, token{kind: tokenRightParen})
+			depth--
+			i++
+			continue
+		case r == '#' && !regexMode:
+			tokens = append(tokens, token{kind: tokenHash})
+			i++
+			continue
+		case r == ',' && !regexMode:
+			tokens = append(tokens, token{kind: tokenComma})
+			i++
+			continue
+		}
+
+		// read a word until whitespace or an operator
+		var word strings.Builder
+		quoted := (r == '"' || r == '\'') && strings.ContainsRune(string(runes[i+1:]), r)
+
+		for i < len(runes) {
+			r = runes[i]
+
+			if unicode.IsSpace(r) || (!regexMode && (r == '#' || r == ',' || (r == ')' && depth > 0))) {
+				break
+			}
+
+			// only characters that mean something to the query can be
+			// escaped, anything else keeps its backslash so regexes like
+			// "\d" still work
+			if r == '\\' && !regexMode && i+1 < len(runes) && strings.ContainsRune(QUERY_SPECIAL_CHARACTERS, runes[i+1]) {
+				word.WriteRune(runes[i+1])
+				i += 2
+				continue
+			}
+
+			// quotes only open at the start of a word (or a field value) and
+			// need a closing quote, so apostrophes in names like "don't" are
+			// just characters
+			opensQuote := (r == '"' || r == '\'') && (word.Len() == 0 || strings.HasSuffix(word.String(), ":")) && strings.ContainsRune(string(runes[i+1:]), r)
+
+			if opensQuote {
+				end := i + 1
+
+				for end < len(runes) && runes[end] != r {
+					// single quotes are fully literal, double quotes allow escapes
+					if r == '"' && !regexMode && runes[end] == '\\' && end+1 < len(runes) {
+						word.WriteRune(runes[end+1])
+						end += 2
+						continue
+					}
+
+					word.WriteRune(runes[end])
+					end++
+				}
+
+				i = end + 1
+				continue
+			}
+
+			word.WriteRune(r)
+			i++
+		}
+
+		value := word.String()
+
+		if !quoted && expectingOperand() && value == "NOT" {
+			tokens = append(tokens, token{kind: tokenNot})
+			continue
+		}
+
+		if !quoted && followsOperand() && (value == "AND" || value == "OR") {
+			kind := tokenAnd
+			if value == "OR" {
+				kind = tokenOr
+			}
+
+			tokens = append(tokens, token{kind: kind})
+			continue
+		}
+
+		// words only separated by spaces are one literal
+		if len(tokens) > argStart && tokens[len(tokens)-1].kind == tokenWord {
+			tokens[len(tokens)-1].value += " " + value
+			continue
+		}
+
+		tokens = append(tokens, token{kind: tokenWord, value: value, quoted: quoted})
+	}
+
+	return tokens, depth
+}
+
+type queryParser struct {
+	tokens   []token
+	position int
+}
+
+func (p *queryParser) peek() (token, bool) {
+	if p.position >= len(p.tokens) {
+		return token{}, false
+	}
+
+	return p.tokens[p.position], true
+}
+
+func (p *queryParser) accept(kind tokenKind) bool {
+	if t, ok := p.peek(); ok && t.kind == kind {
+		p.position++
+		return true
+	}
+
+	return false
+}
+
+func (p *queryParser) parseTerm() (queryNode, error) {
+	// kept from the old syntax, "!a#b" is "NOT (a#b)" rather than "(NOT a)#b"
+	if p.accept(tokenBang) {
+		node, err := p.parseOr()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return notNode{node}, nil
+	}
+
+	return p.parseOr()
+}
+
+func (p *queryParser) parseBinary(kind tokenKind, next func() (queryNode, error), join func(left, right queryNode) queryNode) (queryNode, error) {
+	left, err := next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(kind) {
+		right, err := next()
+
+		if err != nil {
+			return nil, err
+		}
+
+		left = join(left, right)
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	return p.parseBinary(tokenOr, p.parseAnd, func(left, right queryNode) queryNode { return orNode{left, right} })
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	return p.parseBinary(tokenAnd, p.parseHash, func(left, right queryNode) queryNode { return andNode{left, right} })
+}
+
+func (p *queryParser) parseHash() (queryNode, error) {
+	return p.parseBinary(tokenHash, p.parseComma, func(left, right queryNode) queryNode { return andNode{left, right} })
+}
+
+func (p *queryParser) parseComma() (queryNode, error) {
+	return p.parseBinary(tokenComma, p.parseUnary, func(left, right queryNode) queryNode { return orNode{left, right} })
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	if p.accept(tokenNot) || p.accept(tokenBang) {
+		node, err := p.parseUnary()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return notNode{node}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	t, ok := p.peek()
+
+	if !ok {
+		return nil, errors.New("query ends where a search term was expected")
+	}
+
+	switch t.kind {
+	case tokenLeftParen:
+		p.position++
+		node, err := p.parseOr()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.accept(tokenRightParen) {
+			return nil, errors.New("expected a closing parenthesis")
+		}
+
+		return node, nil
+	case tokenWord:
+		p.position++
+		return literalNode{value: strings.ToLower(t.value), raw: t.value, quoted: t.quoted}, nil
+	}
+
+	return nil, errors.New("expected a search term before an operator")
+}
+
+// marks the literals that end up negated, NOT NOT a isn't
+func markNegated(node queryNode, negated bool) queryNode {
+	switch n := node.(type) {
+	case literalNode:
+		n.negated = negated
+		return n
+	case andNode:
+		return andNode{markNegated(n.left, negated), markNegated(n.right, negated)}
+	case orNode:
+		return orNode{markNegated(n.left, negated), markNegated(n.right, negated)}
+	case notNode:
+		return notNode{markNegated(n.node, !negated)}
+	}
+
+	return node
+}
+
+// parses the positional terms (or tags) of the play command, regexMode is
+// for terms with --match regex
+func parseQuery(args []string, regexMode bool) (query, error) {
+	tokens := []token{}
+	depth := 0
+
+	// unbalanced groups are left for the parser to report
+	for _, arg := range args {
+		tokens, depth = tokenizeArg(tokens, arg, depth, regexMode)
+	}
+
+	parser := queryParser{tokens: tokens}
+	q := query{}
+
+	for parser.position < len(parser.tokens) {
+		term, err := parser.parseTerm()
+
+		if err != nil {
+			return q, err
+		}
+
+		q.terms = append(q.terms, markNegated(term, false))
+	}
+
+	return q, nil
+}
@@ -0,0 +1,240 @@
+package play
+
+import (
+	"strings"
+	"testing"
+)
+
+// the query as a string with every operator spelled out, so tests can
+// compare the shape of the tree
+func formatNode(node queryNode) string {
+	switch n := node.(type) {
+	case literalNode:
+		return "\"" + n.value + "\""
+	case andNode:
+		return "and(" + formatNode(n.left) + " " + formatNode(n.right) + ")"
+	case orNode:
+		return "or(" + formatNode(n.left) + " " + formatNode(n.right) + ")"
+	case notNode:
+		return "not(" + formatNode(n.node) + ")"
+	}
+
+	return "?"
+}
+
+func formatQuery(q query) string {
+	terms := []string{}
+
+	for _, term := range q.terms {
+		terms = append(terms, formatNode(term))
+	}
+
+	return strings.Join(terms, " ")
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"word", []string{"tonight"}, `"tonight"`},
+		{"separate terms", []string{"a", "b"}, `"a" "b"`},
+		{"lowercased", []string{"Mitski"}, `"mitski"`},
+		{"spaces make one literal", []string{"make time"}, `"make time"`},
+
+		{"or below and", []string{"a OR b AND c"}, `or("a" and("b" "c"))`},
+		{"and below hash", []string{"a AND b#c"}, `and("a" and("b" "c"))`},
+		{"hash below comma", []string{"a#b,c"}, `and("a" or("b" "c"))`},
+		{"comma below not", []string{"NOT a,b"}, `or(not("a") "b")`},
+		{"comma below bang", []string{"a,!b"}, `or("a" not("b"))`},
+		{"and is left associative", []string{"a AND b AND c"}, `and(and("a" "b") "c")`},
+		{"old syntax", []string{"make#you,me#believe"}, `and(and("make" or("you" "me")) "believe")`},
+		{"double not", []string{"NOT NOT a"}, `not(not("a"))`},
+
+		{"leading bang negates the term", []string{"!a#b"}, `not(and("a" "b"))`},
+		{"leading bang with or", []string{"!a OR b"}, `not(or("a" "b"))`},
+		{"negated argument", []string{"a", "!b"}, `"a" not("b")`},
+
+		{"parentheses", []string{"(a OR b) AND c"}, `and(or("a" "b") "c")`},
+		{"nested parentheses", []string{"((a))"}, `"a"`},
+		{"not a group", []string{"NOT (a OR b)"}, `not(or("a" "b"))`},
+		{"groups across arguments", []string{"(", "a", "OR", "b", ")"}, `or("a" "b")`},
+		{"operators across arguments", []string{"a", "NOT", "b"}, `"a" not("b")`},
+		{"parentheses in a name", []string{"song (live)"}, `"song (live)"`},
+		{"unopened closing parenthesis", []string{"a)"}, `"a)"`},
+
+		{"double quotes", []string{`"live, vol. 1"`}, `"live, vol. 1"`},
+		{"single quotes", []string{`'a#b'`}, `"a#b"`},
+		{"quoted operator", []string{`a "OR" b`}, `"a or b"`},
+		{"escape in double quotes", []string{`"a\"b"`}, `"a"b"`},
+		{"single quotes are literal", []string{`'a\b'`}, `"a\b"`},
+		{"apostrophe", []string{"don't"}, `"don't"`},
+		{"unclosed quote", []string{`"abc`}, `""abc"`},
+		{"escaped hash", []string{`soul \#1`}, `"soul #1"`},
+		{"escaped comma", []string{`a\,b`}, `"a,b"`},
+		{"escaped bang", []string{`\!joe`}, `"!joe"`},
+		{"escaped parenthesis", []string{`\(a`}, `"(a"`},
+		{"other backslashes are kept", []string{`\d`}, `"\d"`},
+
+		{"field", []string{"artist:mitski"}, `"artist:mitski"`},
+		{"field with quoted value", []string{`artist:"bury, me"`}, `"artist:bury, me"`},
+		{"fields with operators", []string{"artist:a#album:b,genre:c"}, `and("artist:a" or("album:b" "genre:c"))`},
+		{"numeric field", []string{"year:2010..2019#duration:<3m"}, `and("year:2010..2019" "duration:<3m")`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q, err := parseQuery(test.args, false)
+
+			if err != nil {
+				t.Fatalf("parseQuery(%q) returned error: %s", test.args, err)
+			}
+
+			if got := formatQuery(q); got != test.want {
+				t.Errorf("parseQuery(%q) = %s, want %s", test.args, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseQueryRegexMode(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"commas are part of the pattern", []string{"a{2,3}"}, `"a{2,3}"`},
+		{"hashes are part of the pattern", []string{"#1"}, `"#1"`},
+		{"backslashes are kept", []string{`\(live\)`}, `"\(live\)"`},
+		{"attached parentheses are part of the pattern", []string{"(a|b)"}, `"(a|b)"`},
+		{"standalone parentheses group", []string{"( a|b ) AND c"}, `and("a|b" "c")`},
+		{"operators still work", []string{"^mitski/ OR ^nujabes/", "NOT live"}, `or("^mitski/" "^nujabes/") not("live")`},
+		{"leading bang", []string{"!live$"}, `not("live$")`},
+		{"single quotes", []string{`'a b'`}, `"a b"`},
+		{"double quotes don't escape", []string{`"a\d"`}, `"a\d"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q, err := parseQuery(test.args, true)
+
+			if err != nil {
+				t.Fatalf("parseQuery(%q) returned error: %s", test.args, err)
+			}
+
+			if got := formatQuery(q); got != test.want {
+				t.Errorf("parseQuery(%q) = %s, want %s", test.args, got, test.want)
+			}
+		})
+	}
+
+	if _, err := parseQuery([]string{"( a"}, true); err == nil {
+		t.Errorf("an unclosed group in regex mode should be an error")
+	}
+}
+
+func TestParseQueryNegated(t *testing.T) {
+	q, err := parseQuery([]string{"a AND NOT b", "!c", "NOT NOT d"}, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	negated := map[string]bool{}
+
+	q.walkLiterals(func(literal literalNode) {
+		negated[literal.value] = literal.negated
+	})
+
+	want := map[string]bool{"a": false, "b": true, "c": true, "d": false}
+
+	for value, wantNegated := range want {
+		if negated[value] != wantNegated {
+			t.Errorf("literal %q negated = %t, want %t", value, negated[value], wantNegated)
+		}
+	}
+}
+
+func TestParseQueryQuotedFlag(t *testing.T) {
+	q, err := parseQuery([]string{`"artist:x"`, "artist:x"}, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !q.terms[0].(literalNode).quoted || q.terms[1].(literalNode).quoted {
+		t.Errorf("only the quoted literal should be marked quoted: %+v", q.terms)
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"unbalanced parenthesis", []string{"(a"}},
+		{"unbalanced across arguments", []string{"(", "a", "OR", "b"}},
+		{"dangling or", []string{"a OR"}},
+		{"dangling and", []string{"a AND"}},
+		{"dangling not", []string{"a", "NOT"}},
+		{"dangling hash", []string{"a#"}},
+		{"dangling comma", []string{"a,"}},
+		{"leading hash", []string{"#a"}},
+		{"leading comma", []string{",a"}},
+		{"double operator", []string{"a##b"}},
+		{"empty group", []string{"()"}},
+		{"empty group with operator", []string{"a AND ()"}},
+		{"only a bang", []string{"!"}},
+		{"or in a group", []string{"(a OR)"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("parseQuery(%q) panicked: %v", test.args, r)
+				}
+			}()
+
+			if q, err := parseQuery(test.args, false); err == nil {
+				t.Errorf("parseQuery(%q) = %s, want an error", test.args, formatQuery(q))
+			}
+		})
+	}
+}
+
+func TestQueryMatches(t *testing.T) {
+	tests := []struct {
+		args []string
+		path string
+		want bool
+	}{
+		{[]string{}, "anything", true},
+		{[]string{"a", "b"}, "xbx", true},
+		{[]string{"a", "b"}, "xcx", false},
+		{[]string{"!joe"}, "mitski", true},
+		{[]string{"!joe"}, "joe", false},
+		{[]string{"jazz", "!live"}, "jazz live", false},
+		{[]string{"(jazz OR soul) AND NOT live"}, "soul studio", true},
+		{[]string{"(jazz OR soul) AND NOT live"}, "soul live", false},
+		{[]string{"make#you,me#believe"}, "make me believe", true},
+		{[]string{"make#you,me#believe"}, "make it believe", false},
+	}
+
+	for _, test := range tests {
+		q, err := parseQuery(test.args, false)
+
+		if err != nil {
+			t.Fatalf("parseQuery(%q) returned error: %s", test.args, err)
+		}
+
+		got := q.matches(func(literal literalNode) bool {
+			return strings.Contains(test.path, literal.value)
+		})
+
+		if got != test.want {
+			t.Errorf("%q matching %q = %t, want %t", test.args, test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package play
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/kitesi/music/utils"
+)
+
+func addQueueFlags(queueCmd *cobra.Command, args *PlayArgs) {
+	config, err := utils.GetConfig()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+	}
+
+	queueCmd.Flags().BoolVar(&args.debug, "debug", config.Debug, "enable debug mode")
+	queueCmd.Flags().StringVar(&args.player, "player", config.Player.Name, "player to use (vlc|mpv|mpd)")
+	queueCmd.Flags().StringVarP(&args.musicPath, "music-path", "m", config.MusicPath, "the music path to use")
+
+	args.vlcPath = config.Player.VlcPath
+}
+
+// a queue subcommand that only needs the player
+func queueSubcommand(use string, short string, positional cobra.PositionalArgs, runner func(player Player, args *PlayArgs, positional []string) error) *cobra.Command {
+	args := PlayArgs{}
+
+	subCmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  positional,
+		Run: func(_ *cobra.Command, positional []string) {
+			player, err := newPlayer(&args)
+
+			if err == nil {
+				err = runner(player, &args, positional)
+			}
+
+			if err != nil {
+				if args.debug {
+					fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+				} else {
+					fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				}
+			}
+		},
+	}
+
+	addQueueFlags(subCmd, &args)
+	return subCmd
+}
+
+func QueueSetup() *cobra.Command {
+	queueCmd := &cobra.Command{
+		Use:   "queue",
+		Short: "View and change the player's playlist",
+	}
+
+	queueCmd.AddCommand(queueSubcommand("list", "List the songs in the playlist", cobra.ExactArgs(0), queueListRunner))
+	queueCmd.AddCommand(queueAddSetup())
+	queueCmd.AddCommand(queueSubcommand("remove <position..>", "Remove songs from the playlist", cobra.MinimumNArgs(1), queueRemoveRunner))
+	queueCmd.AddCommand(queueSubcommand("move <from> <to>", "Move a song to another position", cobra.ExactArgs(2), queueMoveRunner))
+
+	queueCmd.AddCommand(queueSubcommand("clear", "Stop playback and empty the playlist", cobra.ExactArgs(0), func(player Player, _ *PlayArgs, _ []string) error {
+		return player.Clear()
+	}))
+
+	queueCmd.AddCommand(queueSubcommand("shuffle", "Shuffle the playlist", cobra.ExactArgs(0), func(player Player, _ *PlayArgs, _ []string) error {
+		return player.Shuffle()
+	}))
+
+	queueCmd.AddCommand(queueSubcommand("next", "Skip to the next song", cobra.ExactArgs(0), func(player Player, _ *PlayArgs, _ []string) error {
+		return player.Next()
+	}))
+
+	queueCmd.AddCommand(queueSubcommand("pause", "Pause playback, or resume it", cobra.ExactArgs(0), func(player Player, _ *PlayArgs, _ []string) error {
+		return player.Pause()
+	}))
+
+	queueCmd.AddCommand(queueSubcommand("status", "Show what's playing", cobra.ExactArgs(0), queueStatusRunner))
+	return queueCmd
+}
+
+func queueAddSetup() *cobra.Command {
+	args := &PlayArgs{}
+
+	addCmd := &cobra.Command{
+		Use:   "add [terms..]",
+		Short: "Add the songs matching the terms to the end of the playlist",
+	}
+
+	// only the flags that pick songs, the rest of play's (--clear, --append,
+	// --add-to-tag...) don't mean anything here
+	addQueryFlags(addCmd, args)
+
+	addCmd.Run = func(_ *cobra.Command, terms []string) {
+		if err := queueAddRunner(args, terms); err != nil {
+			if args.debug {
+				fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+			} else {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			}
+		}
+	}
+
+	return addCmd
+}
+
+func queueAddRunner(args *PlayArgs, terms []string) error {
+	player, err := newPlayer(args)
+
+	if err != nil {
+		return err
+	}
+
+	songs, err := getSongs(args, terms)
+
+	if err != nil {
+		return err
+	}
+
+	if len(songs) == 0 {
+		fmt.Println("Didn't match anything")
+		return nil
+	}
+
+	fmt.Printf("Adding [%d]\n", len(songs))
+
+	for _, s := range songs {
+		fmt.Printf("- %s\n", utils.GetBareSongName(s, args.musicPath))
+	}
+
+	if args.dryRun {
+		return nil
+	}
+
+	return player.Load(songs, loadOptions{playNow: false, random: RANDOM_UNCHANGED})
+}
+
+func queueListRunner(player Player, args *PlayArgs, _ []string) error {
+	entries, err := player.List()
+
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("The playlist is empty")
+		return nil
+	}
+
+	width := len(strconv.Itoa(len(entries)))
+
+	for i, entry := range entries {
+		marker := " "
+
+		if entry.current {
+			marker = ">"
+		}
+
+		fmt.Printf("%s %*d. %s\n", marker, width, i+1, utils.GetBareSongName(entry.path, args.musicPath))
+	}
+
+	return nil
+}
+
+func queueStatusRunner(player Player, args *PlayArgs, _ []string) error {
+	status, err := player.Status()
+
+	if err != nil {
+		return err
+	}
+
+	if status.state == PLAYER_STATE_STOPPED {
+		fmt.Println("Stopped")
+		return nil
+	}
+
+	shuffle := "off"
+
+	if status.random {
+		shuffle = "on"
+	}
+
+	fmt.Printf("%s: %s\n", status.state, utils.GetBareSongName(status.path, args.musicPath))
+	fmt.Printf("%s / %s, shuffle %s\n", formatPosition(status.position), formatPosition(status.duration), shuffle)
+	return nil
+}
+
+// as m:ss
+func formatPosition(seconds float64) string {
+	total := int(seconds)
+	return fmt.Sprintf("%d:%02d", total/60, total%60)
+}
+
+// positions are shown starting at 1, the players start at 0
+func parsePosition(value string, length int) (int, error) {
+	position, err := strconv.Atoi(value)
+
+	if err != nil || position < 1 {
+		return 0, errors.New("invalid position \"" + value + "\", expected a number starting at 1")
+	}
+
+	if position > length {
+		return 0, fmt.Errorf("invalid position %d, the playlist only has %d songs", position, length)
+	}
+
+	return position - 1, nil
+}
+
+func queueRemoveRunner(player Player, _ *PlayArgs, positional []string) error {
+	entries, err := player.List()
+
+	if err != nil {
+		return err
+	}
+
+	positions := make([]int, len(positional))
+
+	for i, value := range positional {
+		position, err := parsePosition(value, len(entries))
+
+		if err != nil {
+			return err
+		}
+
+		positions[i] = position
+	}
+
+	// remove from the end first so the other positions don't shift
+	sort.Sort(sort.Reverse(sort.IntSlice(positions)))
+	removed := map[int]bool{}
+
+	for _, position := range positions {
+		if removed[position] {
+			continue
+		}
+
+		if err := player.Remove(position); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("could not remove song at %d", position+1))
+		}
+
+		removed[position] = true
+	}
+
+	return nil
+}
+
+func queueMoveRunner(player Player, _ *PlayArgs, positional []string) error {
+	entries, err := player.List()
+
+	if err != nil {
+		return err
+	}
+
+	from, err := parsePosition(positional[0], len(entries))
+
+	if err != nil {
+		return err
+	}
+
+	to, err := parsePosition(positional[1], len(entries))
+
+	if err != nil {
+		return err
+	}
+
+	if from == to {
+		return nil
+	}
+
+	return player.Move(from, to)
+}
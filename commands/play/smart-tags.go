@@ -0,0 +1,54 @@
+package play
+
+import (
+	"github.com/kitesi/music/commands/tags"
+)
+
+func init() {
+	tags.SetSmartTagResolver(getSmartTagSongs)
+}
+
+func smartTagFromArgs(args *PlayArgs, terms []string) tags.SmartTag {
+	return tags.SmartTag{
+		Terms:        terms,
+		Tags:         args.tags,
+		Match:        args.matchMode,
+		New:          args.new,
+		PlayNewFirst: args.playNewFirst,
+		SkipOldFirst: args.skipOldFirst,
+		SortType:     args.sortType,
+		Limit:        max(args.limit, 0),
+		Skip:         args.skip,
+	}
+}
+
+// runs the smart tag's query the same way music play would
+func getSmartTagSongs(musicPath string, smartTag tags.SmartTag, storedTags map[string][]string) ([]string, error) {
+	args := &PlayArgs{
+		musicPath:    musicPath,
+		tags:         smartTag.Tags,
+		matchMode:    smartTag.Match,
+		new:          smartTag.New,
+		playNewFirst: smartTag.PlayNewFirst,
+		skipOldFirst: smartTag.SkipOldFirst,
+		sortType:     smartTag.SortType,
+		limit:        smartTag.Limit,
+		skip:         smartTag.Skip,
+		storedTags:   storedTags,
+	}
+
+	if args.matchMode == "" {
+		args.matchMode = MATCH_SUBSTRING
+	}
+
+	if args.sortType == "" {
+		args.sortType = "m"
+	}
+
+	// no limit is -1 for play but left out in the file
+	if args.limit == 0 {
+		args.limit = -1
+	}
+
+	return getSongs(args, smartTag.Terms)
+}
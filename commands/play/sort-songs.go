@@ -2,16 +2,31 @@ package play
 
 import (
 	"sort"
+
+	"github.com/kitesi/music/library"
 )
 
-func sortByNew(songs []Song, requestedTimeStat string) {
+func sortByNew(songs []library.Song, requestedTimeStat string) {
 	sort.Slice(songs, func(i, j int) bool {
 		if requestedTimeStat == "a" {
-			return songs[i].stat.AccessTime().After(songs[j].stat.AccessTime())
+			return songs[i].AccessTime.After(songs[j].AccessTime)
 		} else if requestedTimeStat == "c" {
-			return songs[i].stat.ChangeTime().After(songs[j].stat.ChangeTime())
+			return songs[i].ChangeTime.After(songs[j].ChangeTime)
 		}
 
-		return songs[i].stat.ModTime().After(songs[j].stat.ModTime())
+		return songs[i].ModTime.After(songs[j].ModTime)
+	})
+}
+
+// highest score first, songs with the same score keep their order
+func sortByScore(songs []library.Song, score func(song library.Song) float64) {
+	scores := make(map[string]float64, len(songs))
+
+	for _, song := range songs {
+		scores[song.Path] = score(song)
+	}
+
+	sort.SliceStable(songs, func(i, j int) bool {
+		return scores[songs[i].Path] > scores[songs[j].Path]
 	})
 }
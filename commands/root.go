@@ -2,8 +2,10 @@ package cmd
 
 import (
 	"github.com/kitesi/music/commands/lastfm"
+	"github.com/kitesi/music/commands/library"
 	"github.com/kitesi/music/commands/play"
 	"github.com/kitesi/music/commands/spotify"
+	"github.com/kitesi/music/commands/stats"
 	"github.com/kitesi/music/commands/tags"
 
 	"github.com/spf13/cobra"
@@ -27,20 +29,33 @@ func Execute() {
 		Long:  "Import playlists from Spotify",
 	}
 
+	libraryCommand := &cobra.Command{
+		Use:   "library",
+		Short: "Library index utilities",
+		Long:  "Manage the index of the music path that queries run against",
+	}
+
 	rootCmd.AddCommand(play.Setup())
+	rootCmd.AddCommand(play.QueueSetup())
 	rootCmd.AddCommand(tags.Setup())
+	rootCmd.AddCommand(stats.Setup())
 	// rootCmd.AddCommand(lyrics.Setup())
 	rootCmd.AddCommand(lastfmCommand)
 	rootCmd.AddCommand(spotifyCommand)
+	rootCmd.AddCommand(libraryCommand)
 
 	lastfmCommand.AddCommand(lastfm.WatchSetup())
 	lastfmCommand.AddCommand(lastfm.SuggestSetup())
 	lastfmCommand.AddCommand(lastfm.RecentSetup())
 	lastfmCommand.AddCommand(lastfm.ImportSetup())
+	lastfmCommand.AddCommand(lastfm.SyncHistorySetup())
+	lastfmCommand.AddCommand(lastfm.RulesSetup())
 
 	spotifyCommand.AddCommand(spotify.ImportSetup())
 	spotifyCommand.AddCommand(spotify.SetOriginSetup())
 
+	libraryCommand.AddCommand(library.RefreshSetup())
+
 	rootCmd.AddGroup(&cobra.Group{
 		ID:    "generic",
 		Title: "Generic Commands",
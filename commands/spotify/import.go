@@ -19,8 +19,8 @@ import (
 
 	"github.com/adrg/strutil"
 	"github.com/adrg/strutil/metrics"
-	"github.com/dhowden/tag"
 	"github.com/kitesi/music/commands/tags"
+	"github.com/kitesi/music/library"
 	"github.com/kitesi/music/simpleconfig"
 	"github.com/kitesi/music/utils"
 	"github.com/spf13/cobra"
@@ -229,22 +229,10 @@ func getSongId(song SpotifyTrackObject) string {
 
 var featureRegex = regexp.MustCompile(`(?i)\(?(ft\.?|feat\.?)\)?`)
 
-func testFileAgainstPlaylist(fileName string, playlistSongs *[]SpotifyTrackObject, metricCmp strutil.StringMetric, mostSimilar *map[string]SimilarityInfo, onMatch func(int, string)) error {
-	file, err := os.Open(fileName)
-
-	if err != nil {
-		return errors.New("Error opening file: " + fileName + " - " + err.Error())
-	}
-
-	defer file.Close()
-	metadata, err := tag.ReadFrom(file)
-
-	if err != nil {
-		return errors.New("Error reading metadata from file: " + fileName + " - " + err.Error())
-	}
-
-	title := normalizeString(metadata.Title())
-	artist := normalizeString(metadata.Artist())
+func testSongAgainstPlaylist(song library.Song, playlistSongs *[]SpotifyTrackObject, metricCmp strutil.StringMetric, mostSimilar *map[string]SimilarityInfo, onMatch func(int, string)) {
+	fileName := song.Path
+	title := normalizeString(song.Title)
+	artist := normalizeString(song.Artist)
 
 	for i, playlistSong := range *playlistSongs {
 		playlistSongName := playlistSong.Name
@@ -280,8 +268,6 @@ func testFileAgainstPlaylist(fileName string, playlistSongs *[]SpotifyTrackObjec
 			delete((*mostSimilar), songId)
 		}
 	}
-
-	return nil
 }
 
 func updateLocalPlaylistToMatch(playlistSongs []SpotifyTrackObject, localTagName string, args *SpotifyImportArgs) error {
@@ -318,6 +304,18 @@ func updateLocalPlaylistToMatch(playlistSongs []SpotifyTrackObject, localTagName
 		}
 	}
 
+	librarySongs, err := library.GetSongs(args.musicPath)
+
+	if err != nil {
+		return errors.New("Error getting library: " + err.Error())
+	}
+
+	librarySongsByPath := make(map[string]library.Song, len(librarySongs))
+
+	for _, song := range librarySongs {
+		librarySongsByPath[song.Path] = song
+	}
+
 	tagSongIndex := 0
 	foundTaggedSongs := []MatchedSpotifyToLocal{}
 	mostSimilarTagged := map[string]SimilarityInfo{}
@@ -331,7 +329,10 @@ func updateLocalPlaylistToMatch(playlistSongs []SpotifyTrackObject, localTagName
 	}
 
 	for tagSongIndex < len(tagSongs) && len(playlistSongs) > 0 {
-		testFileAgainstPlaylist(tagSongs[tagSongIndex], &playlistSongs, metricCmp, &mostSimilarTagged, onTaggedMatch)
+		if song, ok := librarySongsByPath[tagSongs[tagSongIndex]]; ok {
+			testSongAgainstPlaylist(song, &playlistSongs, metricCmp, &mostSimilarTagged, onTaggedMatch)
+		}
+
 		tagSongIndex++
 	}
 
@@ -377,24 +378,15 @@ func updateLocalPlaylistToMatch(playlistSongs []SpotifyTrackObject, localTagName
 		playlistSongs = append(playlistSongs[:i], playlistSongs[i+1:]...)
 	}
 
-	err = filepath.WalkDir(args.musicPath, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		ext := filepath.Ext(path)
+	for _, song := range librarySongs {
+		ext := filepath.Ext(song.Path)
 
 		if ext != ".mp3" && ext != ".flac" && ext != ".m4a" && ext != ".ogg" {
-			return nil
+			continue
 		}
 
-		if d.IsDir() {
-			return nil
-		}
-
-		testFileAgainstPlaylist(path, &playlistSongs, metricCmp, &mostSimilarUntagged, onUntaggedMatch)
-		return nil
-	})
+		testSongAgainstPlaylist(song, &playlistSongs, metricCmp, &mostSimilarUntagged, onUntaggedMatch)
+	}
 
 	if len(foundUntaggedSongs) != 0 {
 		fmt.Println("\nFound", len(foundUntaggedSongs), "songs from the spotify playlist that are not tagged:")
@@ -441,10 +433,6 @@ func updateLocalPlaylistToMatch(playlistSongs []SpotifyTrackObject, localTagName
 		}
 	}
 
-	if err != nil {
-		return errors.New("Error walking music path: " + err.Error())
-	}
-
 	toAppend := []string{}
 
 	for _, song := range foundUntaggedSongs {
@@ -453,7 +441,7 @@ func updateLocalPlaylistToMatch(playlistSongs []SpotifyTrackObject, localTagName
 
 	if len(toAppend) != 0 {
 		fmt.Println("\nAdding", len(toAppend), "songs to tag:", localTagName)
-		err := tags.ChangeSongsInTag(args.musicPath, localTagName, toAppend, true)
+		err := tags.ChangeSongsInTag(args.musicPath, localTagName, toAppend, true, "spotify import")
 
 		if err != nil {
 			return errors.New("Error changing songs in tag: " + err.Error())
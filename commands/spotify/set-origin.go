@@ -60,26 +60,23 @@ func setupOriginRunner(positional []string, args *SetOriginArgs) error {
 		return fmt.Errorf("tag %s does not exist", tag)
 	}
 
-	// ignore error and use default
-	config, _ := utils.GetConfig()
+	// read and written under the config lock, so a concurrent change to the
+	// config isn't overwritten
+	return utils.UpdateConfig(func(config *utils.Config) error {
+		if config.TagPlaylistAssociations == nil {
+			config.TagPlaylistAssociations = make(map[string]string)
+		}
 
-	if config.TagPlaylistAssociations == nil {
-		config.TagPlaylistAssociations = make(map[string]string)
-	}
+		if origin == "" {
+			if config.TagPlaylistAssociations[tag] == "" {
+				return fmt.Errorf("no association for tag %s", tag)
+			}
 
-	if origin == "" {
-		if config.TagPlaylistAssociations[tag] == "" {
-			return fmt.Errorf("no association for tag %s", tag)
-		} else {
 			delete(config.TagPlaylistAssociations, tag)
+		} else {
+			config.TagPlaylistAssociations[tag] = origin
 		}
-	} else {
-		config.TagPlaylistAssociations[tag] = origin
-	}
-
-	if err := utils.WriteConfig(config); err != nil {
-		return err
-	}
 
-	return nil
+		return nil
+	})
 }
@@ -0,0 +1,220 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	dbUtils "github.com/kitesi/music/db"
+)
+
+type countEntry struct {
+	Name   string `json:"name"`
+	Artist string `json:"artist,omitempty"`
+	Plays  int    `json:"plays"`
+	// seconds
+	ListenTime int `json:"listenTime"`
+}
+
+type periodEntry struct {
+	Period     string `json:"period"`
+	Plays      int    `json:"plays"`
+	ListenTime int    `json:"listenTime"`
+}
+
+type skipStats struct {
+	Plays    int     `json:"plays"`
+	Skips    int     `json:"skips"`
+	SkipRate float64 `json:"skipRate"`
+	// tracks with the most skips
+	MostSkipped []countEntry `json:"mostSkipped"`
+}
+
+type playStats struct {
+	Plays      int `json:"plays"`
+	ListenTime int `json:"listenTime"`
+
+	Artists []countEntry  `json:"artists"`
+	Albums  []countEntry  `json:"albums"`
+	Tracks  []countEntry  `json:"tracks"`
+	Time    []periodEntry `json:"time"`
+	Skips   skipStats     `json:"skips"`
+	// listening time in seconds by weekday (monday first) and hour
+	Hours [7][24]int `json:"hours"`
+}
+
+// counts plays grouped case insensitively, named by the first spelling seen
+type counter struct {
+	entries map[string]*countEntry
+	order   []string
+}
+
+func newCounter() *counter {
+	return &counter{entries: map[string]*countEntry{}}
+}
+
+func (c *counter) add(key string, name string, artist string, listenTime int) {
+	key = strings.ToLower(key)
+	entry, ok := c.entries[key]
+
+	if !ok {
+		entry = &countEntry{Name: name, Artist: artist}
+		c.entries[key] = entry
+		c.order = append(c.order, key)
+	} else if artist != "" && !strings.EqualFold(entry.Artist, artist) {
+		entry.Artist = "Various Artists"
+	}
+
+	entry.Plays++
+	entry.ListenTime += listenTime
+}
+
+// the most played first, up to limit (everything if it's below 1)
+func (c *counter) top(limit int) []countEntry {
+	entries := []countEntry{}
+
+	for _, key := range c.order {
+		entries = append(entries, *c.entries[key])
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Plays != entries[j].Plays {
+			return entries[i].Plays > entries[j].Plays
+		}
+
+		return entries[i].ListenTime > entries[j].ListenTime
+	})
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	return entries
+}
+
+// whether the play covered less than skipCoverage of the track
+func isSkip(play dbUtils.PlayRecord, skipCoverage float64) bool {
+	return play.Duration > 0 && float64(play.UniqueCoverage) < skipCoverage*float64(play.Duration)
+}
+
+func trackKey(play dbUtils.PlayRecord) string {
+	return play.Artist + "\x00" + play.Title
+}
+
+func periodStart(t time.Time, per string) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+
+	switch per {
+	case PER_WEEK:
+		// weeks start on monday
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case PER_MONTH:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+
+	return day
+}
+
+func nextPeriod(t time.Time, per string) time.Time {
+	switch per {
+	case PER_WEEK:
+		return t.AddDate(0, 0, 7)
+	case PER_MONTH:
+		return t.AddDate(0, 1, 0)
+	}
+
+	return t.AddDate(0, 0, 1)
+}
+
+func periodName(t time.Time, per string) string {
+	switch per {
+	case PER_WEEK:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case PER_MONTH:
+		return t.Format("2006-01")
+	}
+
+	return t.Format("2006-01-02")
+}
+
+// listening time for every period from the first play to the last, including
+// the ones without any
+func listeningTime(plays []dbUtils.PlayRecord, per string) []periodEntry {
+	periods := []periodEntry{}
+
+	if len(plays) == 0 {
+		return periods
+	}
+
+	byPeriod := map[string]*periodEntry{}
+	last := periodStart(plays[len(plays)-1].StartTime, per)
+
+	for start := periodStart(plays[0].StartTime, per); !start.After(last); start = nextPeriod(start, per) {
+		periods = append(periods, periodEntry{Period: periodName(start, per)})
+	}
+
+	for i := range periods {
+		byPeriod[periods[i].Period] = &periods[i]
+	}
+
+	for _, play := range plays {
+		if entry, ok := byPeriod[periodName(periodStart(play.StartTime, per), per)]; ok {
+			entry.Plays++
+			entry.ListenTime += play.ListenTime
+		}
+	}
+
+	return periods
+}
+
+// plays have to be sorted by start time. Top lists only count scrobbable
+// plays, everything else counts all of them.
+func analyze(plays []dbUtils.PlayRecord, args *StatsArgs) playStats {
+	stats := playStats{}
+	artists := newCounter()
+	albums := newCounter()
+	tracks := newCounter()
+	skipped := newCounter()
+
+	for _, play := range plays {
+		stats.Plays++
+		stats.ListenTime += play.ListenTime
+
+		weekday := (int(play.StartTime.Weekday()) + 6) % 7
+		stats.Hours[weekday][play.StartTime.Hour()] += play.ListenTime
+
+		if play.Duration > 0 {
+			stats.Skips.Plays++
+
+			if isSkip(play, args.skipCoverage) {
+				stats.Skips.Skips++
+				skipped.add(trackKey(play), play.Title, play.Artist, play.ListenTime)
+			}
+		}
+
+		if !play.Scrobbable {
+			continue
+		}
+
+		artists.add(play.Artist, play.Artist, "", play.ListenTime)
+		tracks.add(trackKey(play), play.Title, play.Artist, play.ListenTime)
+
+		if play.Album != "" {
+			albums.add(play.Album, play.Album, play.Artist, play.ListenTime)
+		}
+	}
+
+	if stats.Skips.Plays > 0 {
+		stats.Skips.SkipRate = float64(stats.Skips.Skips) / float64(stats.Skips.Plays)
+	}
+
+	stats.Artists = artists.top(args.limit)
+	stats.Albums = albums.top(args.limit)
+	stats.Tracks = tracks.top(args.limit)
+	stats.Skips.MostSkipped = skipped.top(args.limit)
+	stats.Time = listeningTime(plays, args.per)
+
+	return stats
+}
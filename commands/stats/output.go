@@ -0,0 +1,223 @@
+package stats
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+var WEEKDAYS = []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+
+// from nothing to the most listened hour
+var HEAT_LEVELS = []rune(" ░▒▓█")
+
+// 1h 05m, 3m 20s
+func formatDuration(seconds int) string {
+	if seconds >= 3600 {
+		return fmt.Sprintf("%dh %02dm", seconds/3600, seconds%3600/60)
+	}
+
+	return fmt.Sprintf("%dm %02ds", seconds/60, seconds%60)
+}
+
+func printJson(stats playStats, sections []string) error {
+	// only the sections asked for
+	output := map[string]any{
+		"plays":      stats.Plays,
+		"listenTime": stats.ListenTime,
+	}
+
+	for _, section := range sections {
+		switch section {
+		case SECTION_ARTISTS:
+			output[section] = stats.Artists
+		case SECTION_ALBUMS:
+			output[section] = stats.Albums
+		case SECTION_TRACKS:
+			output[section] = stats.Tracks
+		case SECTION_TIME:
+			output[section] = stats.Time
+		case SECTION_SKIPS:
+			output[section] = stats.Skips
+		case SECTION_HOURS:
+			output[section] = stats.Hours
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
+
+func countRecords(entries []countEntry, withArtist bool) [][]string {
+	records := [][]string{}
+
+	for i, entry := range entries {
+		record := []string{strconv.Itoa(i + 1), entry.Name}
+
+		if withArtist {
+			record = append(record, entry.Artist)
+		}
+
+		records = append(records, append(record, strconv.Itoa(entry.Plays), strconv.Itoa(entry.ListenTime)))
+	}
+
+	return records
+}
+
+// every section is its own block with a header, separated by an empty line
+func printCsv(stats playStats, sections []string) error {
+	writer := csv.NewWriter(os.Stdout)
+
+	for i, section := range sections {
+		if i > 0 {
+			writer.Write(nil)
+		}
+
+		records := [][]string{}
+
+		switch section {
+		case SECTION_ARTISTS:
+			records = append([][]string{{"rank", "artist", "plays", "listen_time"}}, countRecords(stats.Artists, false)...)
+		case SECTION_ALBUMS:
+			records = append([][]string{{"rank", "album", "artist", "plays", "listen_time"}}, countRecords(stats.Albums, true)...)
+		case SECTION_TRACKS:
+			records = append([][]string{{"rank", "title", "artist", "plays", "listen_time"}}, countRecords(stats.Tracks, true)...)
+		case SECTION_SKIPS:
+			records = append([][]string{{"rank", "title", "artist", "skips", "listen_time"}}, countRecords(stats.Skips.MostSkipped, true)...)
+		case SECTION_TIME:
+			records = append(records, []string{"period", "plays", "listen_time"})
+
+			for _, period := range stats.Time {
+				records = append(records, []string{period.Period, strconv.Itoa(period.Plays), strconv.Itoa(period.ListenTime)})
+			}
+		case SECTION_HOURS:
+			header := []string{"weekday"}
+
+			for hour := 0; hour < 24; hour++ {
+				header = append(header, strconv.Itoa(hour))
+			}
+
+			records = append(records, header)
+
+			for day, hours := range stats.Hours {
+				record := []string{WEEKDAYS[day]}
+
+				for _, seconds := range hours {
+					record = append(record, strconv.Itoa(seconds))
+				}
+
+				records = append(records, record)
+			}
+		}
+
+		if err := writer.WriteAll(records); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func printCountTable(title string, unit string, entries []countEntry, withArtist bool) {
+	fmt.Println(title)
+
+	if len(entries) == 0 {
+		fmt.Println("  nothing yet")
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	for i, entry := range entries {
+		name := entry.Name
+
+		if withArtist {
+			name += " - " + entry.Artist
+		}
+
+		fmt.Fprintf(writer, "  %d.\t%s\t%d %s\t%s\n", i+1, name, entry.Plays, unit, formatDuration(entry.ListenTime))
+	}
+
+	writer.Flush()
+}
+
+func heatLevel(seconds int, most int) rune {
+	if seconds == 0 || most == 0 {
+		return HEAT_LEVELS[0]
+	}
+
+	// anything listened to gets at least the lightest shade
+	level := 1 + seconds*(len(HEAT_LEVELS)-2)/most
+	return HEAT_LEVELS[min(level, len(HEAT_LEVELS)-1)]
+}
+
+func printTable(stats playStats, sections []string) {
+	fmt.Printf("%d plays, %s listened\n", stats.Plays, formatDuration(stats.ListenTime))
+
+	for _, section := range sections {
+		fmt.Println()
+
+		switch section {
+		case SECTION_ARTISTS:
+			printCountTable("Top artists", "plays", stats.Artists, false)
+		case SECTION_ALBUMS:
+			printCountTable("Top albums", "plays", stats.Albums, true)
+		case SECTION_TRACKS:
+			printCountTable("Top tracks", "plays", stats.Tracks, true)
+		case SECTION_SKIPS:
+			fmt.Printf("Skip rate: %.1f%% (%d of %d plays)\n", stats.Skips.SkipRate*100, stats.Skips.Skips, stats.Skips.Plays)
+
+			if len(stats.Skips.MostSkipped) > 0 {
+				fmt.Println()
+				printCountTable("Most skipped", "skips", stats.Skips.MostSkipped, true)
+			}
+		case SECTION_TIME:
+			fmt.Println("Listening time")
+			most := 0
+
+			for _, period := range stats.Time {
+				most = max(most, period.ListenTime)
+			}
+
+			writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+			for _, period := range stats.Time {
+				bar := ""
+
+				if most > 0 {
+					bar = strings.Repeat("█", period.ListenTime*30/most)
+				}
+
+				fmt.Fprintf(writer, "  %s\t%s\t%s\n", period.Period, formatDuration(period.ListenTime), bar)
+			}
+
+			writer.Flush()
+		case SECTION_HOURS:
+			fmt.Println("Listening by hour")
+			most := 0
+
+			for _, hours := range stats.Hours {
+				most = max(most, slices.Max(hours[:]))
+			}
+
+			fmt.Println("       0     6     12    18   23")
+
+			for day, hours := range stats.Hours {
+				row := []rune{}
+
+				for _, seconds := range hours {
+					row = append(row, heatLevel(seconds, most))
+				}
+
+				fmt.Printf("  %s  %s\n", WEEKDAYS[day], string(row))
+			}
+		}
+	}
+}
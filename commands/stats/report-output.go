@@ -0,0 +1,252 @@
+package stats
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	CHART_WIDTH  = 720
+	CHART_HEIGHT = 240
+	// room for the values above the bars and the labels below them
+	CHART_PADDING = 24
+	CHART_COLOR   = "#4f7cac"
+)
+
+type reportChart struct {
+	Title string
+	Svg   string
+}
+
+// a bar chart as a standalone svg, so it works both inline in html and as a
+// data uri image in markdown
+func svgBarChart(labels []string, values []int, format func(int) string) string {
+	most := 0
+
+	for _, value := range values {
+		most = max(most, value)
+	}
+
+	var svg strings.Builder
+	barSpace := float64(CHART_WIDTH) / float64(len(values))
+	barHeight := float64(CHART_HEIGHT - 2*CHART_PADDING)
+
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="12">`, CHART_WIDTH, CHART_HEIGHT, CHART_WIDTH, CHART_HEIGHT)
+
+	for i, value := range values {
+		height := 0.0
+
+		if most > 0 {
+			height = barHeight * float64(value) / float64(most)
+		}
+
+		x := barSpace * float64(i)
+		y := CHART_PADDING + barHeight - height
+		center := x + barSpace/2
+		label := html.EscapeString(labels[i])
+		text := html.EscapeString(format(value))
+
+		fmt.Fprintf(&svg, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s: %s</title></rect>`, x+barSpace*0.15, y, barSpace*0.7, height, CHART_COLOR, label, text)
+		fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f" text-anchor="middle" fill="#555">%s</text>`, center, y-6, text)
+		fmt.Fprintf(&svg, `<text x="%.1f" y="%d" text-anchor="middle" fill="#333">%s</text>`, center, CHART_HEIGHT-6, label)
+	}
+
+	svg.WriteString("</svg>")
+	return svg.String()
+}
+
+func monthLabels() []string {
+	labels := []string{}
+
+	for month := time.January; month <= time.December; month++ {
+		labels = append(labels, month.String()[:3])
+	}
+
+	return labels
+}
+
+func formatHours(seconds int) string {
+	if seconds == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%.1fh", float64(seconds)/3600)
+}
+
+func formatCount(count int) string {
+	if count == 0 {
+		return ""
+	}
+
+	return fmt.Sprint(count)
+}
+
+func reportCharts(report yearReport) []reportChart {
+	listening := []int{}
+	plays := []int{}
+	discovered := make([]int, 12)
+
+	for _, month := range report.Months {
+		listening = append(listening, month.ListenTime)
+		plays = append(plays, month.Plays)
+	}
+
+	for _, found := range report.Discoveries {
+		discovered[found.FirstHeard.Month()-1]++
+	}
+
+	return []reportChart{
+		{Title: "Listening time per month", Svg: svgBarChart(monthLabels(), listening, formatHours)},
+		{Title: "Plays per month", Svg: svgBarChart(monthLabels(), plays, formatCount)},
+		{Title: "New artists per month", Svg: svgBarChart(monthLabels(), discovered, formatCount)},
+	}
+}
+
+func formatDay(t time.Time) string {
+	return t.Format("Jan 2")
+}
+
+const HTML_REPORT_TEMPLATE = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Year}} in music</title>
+<style>
+body { font-family: sans-serif; max-width: 760px; margin: 2em auto; padding: 0 1em; color: #222; }
+h1 { margin-bottom: 0; }
+.summary { color: #555; margin-top: .3em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1em; }
+th, td { text-align: left; padding: .3em .5em; border-bottom: 1px solid #ddd; }
+td.number { text-align: right; white-space: nowrap; }
+svg { max-width: 100%; height: auto; }
+.timeline li { margin-bottom: .3em; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>{{.Year}} in music</h1>
+<p class="summary">{{.Stats.Plays}} plays, {{duration .Stats.ListenTime}} listened, {{len .Discoveries}} new artists</p>
+
+<h2>Top tracks</h2>
+{{if .Stats.Tracks}}<table>
+<tr><th>#</th><th>Track</th><th>Artist</th><th>Plays</th><th>Time</th></tr>
+{{range $i, $track := .Stats.Tracks}}<tr><td>{{inc $i}}</td><td>{{$track.Name}}</td><td>{{$track.Artist}}</td><td class="number">{{$track.Plays}}</td><td class="number">{{duration $track.ListenTime}}</td></tr>
+{{end}}</table>{{else}}<p class="muted">Nothing played this year.</p>{{end}}
+
+<h2>Top artists</h2>
+{{if .Stats.Artists}}<table>
+<tr><th>#</th><th>Artist</th><th>Plays</th><th>Time</th></tr>
+{{range $i, $artist := .Stats.Artists}}<tr><td>{{inc $i}}</td><td>{{$artist.Name}}</td><td class="number">{{$artist.Plays}}</td><td class="number">{{duration $artist.ListenTime}}</td></tr>
+{{end}}</table>{{else}}<p class="muted">Nothing played this year.</p>{{end}}
+
+{{range .Charts}}<h2>{{.Title}}</h2>
+{{svg .Svg}}
+{{end}}
+<h2>Discoveries</h2>
+{{if .Discoveries}}<ul class="timeline">
+{{range .Discoveries}}<li><strong>{{day .FirstHeard}}</strong> {{.Artist}} <span class="muted">({{.Plays}} plays)</span></li>
+{{end}}</ul>{{else}}<p class="muted">No new artists this year.</p>{{end}}
+
+<h2>Longest streaks</h2>
+{{if .Streaks}}<table>
+<tr><th>Days</th><th>From</th><th>To</th></tr>
+{{range .Streaks}}<tr><td class="number">{{.Days}}</td><td>{{day .Start}}</td><td>{{day .End}}</td></tr>
+{{end}}</table>{{else}}<p class="muted">No streaks yet.</p>{{end}}
+
+<h2>Most skipped</h2>
+<p>{{percent .Stats.Skips.SkipRate}} of plays were skipped ({{.Stats.Skips.Skips}} of {{.Stats.Skips.Plays}}).</p>
+{{if .Stats.Skips.MostSkipped}}<table>
+<tr><th>#</th><th>Track</th><th>Artist</th><th>Skips</th></tr>
+{{range $i, $track := .Stats.Skips.MostSkipped}}<tr><td>{{inc $i}}</td><td>{{$track.Name}}</td><td>{{$track.Artist}}</td><td class="number">{{$track.Plays}}</td></tr>
+{{end}}</table>{{end}}
+</body>
+</html>
+`
+
+var reportFuncs = template.FuncMap{
+	"duration": formatDuration,
+	"day":      formatDay,
+	"inc":      func(i int) int { return i + 1 },
+	"percent":  func(rate float64) string { return fmt.Sprintf("%.1f%%", rate*100) },
+	// the charts are built with everything in them escaped already
+	"svg": func(svg string) template.HTML { return template.HTML(svg) },
+}
+
+func writeHtmlReport(out io.Writer, report yearReport) error {
+	tmpl, err := template.New("report").Funcs(reportFuncs).Parse(HTML_REPORT_TEMPLATE)
+
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(out, struct {
+		yearReport
+		Charts []reportChart
+	}{report, reportCharts(report)})
+}
+
+// pipes would end the table cell
+func markdownCell(value string) string {
+	return strings.ReplaceAll(value, "|", `\|`)
+}
+
+func writeMarkdownReport(out io.Writer, report yearReport) error {
+	var md strings.Builder
+	stats := report.Stats
+
+	fmt.Fprintf(&md, "# %d in music\n\n", report.Year)
+	fmt.Fprintf(&md, "%d plays, %s listened, %d new artists\n\n", stats.Plays, formatDuration(stats.ListenTime), len(report.Discoveries))
+
+	md.WriteString("## Top tracks\n\n| # | Track | Artist | Plays | Time |\n| - | - | - | -: | -: |\n")
+
+	for i, track := range stats.Tracks {
+		fmt.Fprintf(&md, "| %d | %s | %s | %d | %s |\n", i+1, markdownCell(track.Name), markdownCell(track.Artist), track.Plays, formatDuration(track.ListenTime))
+	}
+
+	md.WriteString("\n## Top artists\n\n| # | Artist | Plays | Time |\n| - | - | -: | -: |\n")
+
+	for i, artist := range stats.Artists {
+		fmt.Fprintf(&md, "| %d | %s | %d | %s |\n", i+1, markdownCell(artist.Name), artist.Plays, formatDuration(artist.ListenTime))
+	}
+
+	// data uris keep the file self contained
+	for _, chart := range reportCharts(report) {
+		fmt.Fprintf(&md, "\n## %s\n\n![%s](data:image/svg+xml;base64,%s)\n", chart.Title, chart.Title, base64.StdEncoding.EncodeToString([]byte(chart.Svg)))
+	}
+
+	md.WriteString("\n## Discoveries\n\n")
+
+	if len(report.Discoveries) == 0 {
+		md.WriteString("No new artists this year.\n")
+	}
+
+	for _, found := range report.Discoveries {
+		fmt.Fprintf(&md, "- **%s** %s (%d plays)\n", formatDay(found.FirstHeard), found.Artist, found.Plays)
+	}
+
+	md.WriteString("\n## Longest streaks\n\n| Days | From | To |\n| -: | - | - |\n")
+
+	for _, run := range report.Streaks {
+		fmt.Fprintf(&md, "| %d | %s | %s |\n", run.Days, formatDay(run.Start), formatDay(run.End))
+	}
+
+	md.WriteString("\n## Most skipped\n\n")
+	fmt.Fprintf(&md, "%.1f%% of plays were skipped (%d of %d).\n\n", stats.Skips.SkipRate*100, stats.Skips.Skips, stats.Skips.Plays)
+
+	if len(stats.Skips.MostSkipped) > 0 {
+		md.WriteString("| # | Track | Artist | Skips |\n| - | - | - | -: |\n")
+
+		for i, track := range stats.Skips.MostSkipped {
+			fmt.Fprintf(&md, "| %d | %s | %s | %d |\n", i+1, markdownCell(track.Name), markdownCell(track.Artist), track.Plays)
+		}
+	}
+
+	_, err := io.WriteString(out, md.String())
+	return err
+}
@@ -0,0 +1,219 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	dbUtils "github.com/kitesi/music/db"
+	"github.com/kitesi/music/utils"
+	"github.com/spf13/cobra"
+)
+
+const (
+	FORMAT_HTML     = "html"
+	FORMAT_MARKDOWN = "markdown"
+
+	// how many of the longest streaks the report lists
+	REPORT_STREAKS = 5
+)
+
+type StatsReportArgs struct {
+	debug        bool
+	logDbFile    string
+	year         int
+	limit        int
+	format       string
+	output       string
+	skipCoverage float64
+}
+
+func ReportSetup() *cobra.Command {
+	args := StatsReportArgs{}
+
+	config, err := utils.GetConfig()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+	}
+
+	reportCmd := &cobra.Command{
+		Use:   "report",
+		Short: "Year in review report",
+		Long:  "A year in review report from the lastfm log db, as a single html (or markdown) file that works offline",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, positional []string) {
+			if err := reportRunner(&args); err != nil {
+				if args.debug {
+					fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+				} else {
+					fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				}
+			}
+		},
+	}
+
+	reportCmd.Flags().StringVar(&args.logDbFile, "log-db-file", config.LastFm.LogDbFile, "the lastfm log db to read plays from")
+	reportCmd.Flags().IntVarP(&args.year, "year", "y", time.Now().Year(), "the year to report on")
+	reportCmd.Flags().IntVarP(&args.limit, "limit", "l", 10, "how many tracks, artists and skipped songs to list")
+	reportCmd.Flags().StringVarP(&args.format, "format", "f", FORMAT_HTML, "output format, one of 'html'|'markdown'")
+	reportCmd.Flags().StringVarP(&args.output, "output", "o", "", "file to write the report to instead of stdout")
+	reportCmd.Flags().Float64Var(&args.skipCoverage, "skip-coverage", 0.5, "plays that covered less than this much of the track count as skips")
+	reportCmd.Flags().BoolVar(&args.debug, "debug", config.Debug, "enable debug mode")
+
+	return reportCmd
+}
+
+type discovery struct {
+	Artist     string
+	FirstHeard time.Time
+	// plays in the report's year
+	Plays int
+}
+
+// consecutive days with something played
+type streak struct {
+	Start time.Time
+	End   time.Time
+	Days  int
+}
+
+type yearReport struct {
+	Year  int
+	Stats playStats
+	// listening time and plays per month, january first
+	Months      [12]periodEntry
+	Discoveries []discovery
+	Streaks     []streak
+}
+
+// artists first heard in the year, in the order they were. Plays are every
+// play ever so artists heard before the year don't count.
+func discoveries(plays []dbUtils.PlayRecord, year int) []discovery {
+	found := []discovery{}
+	byArtist := map[string]int{}
+
+	for _, play := range plays {
+		if play.Artist == "" {
+			continue
+		}
+
+		key := strings.ToLower(play.Artist)
+		i, seen := byArtist[key]
+
+		if !seen {
+			i = len(found)
+			byArtist[key] = i
+			found = append(found, discovery{Artist: play.Artist, FirstHeard: play.StartTime})
+		}
+
+		if play.StartTime.Year() == year {
+			found[i].Plays++
+		}
+	}
+
+	return slices.DeleteFunc(found, func(d discovery) bool {
+		return d.FirstHeard.Year() != year
+	})
+}
+
+// the longest runs of days with a play, longest (then earliest) first
+func streaks(plays []dbUtils.PlayRecord, limit int) []streak {
+	runs := []streak{}
+
+	for _, play := range plays {
+		day := periodStart(play.StartTime, PER_DAY)
+
+		if len(runs) > 0 {
+			last := &runs[len(runs)-1]
+
+			if day.Equal(last.End) {
+				continue
+			}
+
+			if day.Equal(last.End.AddDate(0, 0, 1)) {
+				last.End = day
+				last.Days++
+				continue
+			}
+		}
+
+		runs = append(runs, streak{Start: day, End: day, Days: 1})
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].Days > runs[j].Days
+	})
+
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+
+	return runs
+}
+
+func buildReport(allPlays []dbUtils.PlayRecord, args *StatsReportArgs) yearReport {
+	report := yearReport{Year: args.year}
+	plays := []dbUtils.PlayRecord{}
+
+	for _, play := range allPlays {
+		if play.StartTime.Year() == args.year {
+			plays = append(plays, play)
+		}
+	}
+
+	report.Stats = analyze(plays, &StatsArgs{limit: args.limit, skipCoverage: args.skipCoverage, per: PER_MONTH})
+
+	for month := range report.Months {
+		report.Months[month].Period = time.Month(month + 1).String()
+	}
+
+	for _, play := range plays {
+		month := &report.Months[play.StartTime.Month()-1]
+		month.Plays++
+		month.ListenTime += play.ListenTime
+	}
+
+	report.Discoveries = discoveries(allPlays, args.year)
+	report.Streaks = streaks(plays, REPORT_STREAKS)
+
+	return report
+}
+
+func reportRunner(args *StatsReportArgs) error {
+	if !slices.Contains([]string{FORMAT_HTML, FORMAT_MARKDOWN}, args.format) {
+		return fmt.Errorf("invalid --format, expected value of 'html'|'markdown'")
+	}
+
+	// every play, so it's known which artists were heard before the year
+	plays, err := loadPlays(args.logDbFile, time.Time{}, time.Time{})
+
+	if err != nil {
+		return err
+	}
+
+	report := buildReport(plays, args)
+
+	var out io.Writer = os.Stdout
+
+	if args.output != "" {
+		file, err := os.Create(args.output)
+
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+		out = file
+	}
+
+	if args.format == FORMAT_MARKDOWN {
+		return writeMarkdownReport(out, report)
+	}
+
+	return writeHtmlReport(out, report)
+}
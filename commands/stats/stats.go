@@ -0,0 +1,178 @@
+package stats
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	dbUtils "github.com/kitesi/music/db"
+	"github.com/kitesi/music/utils"
+	"github.com/spf13/cobra"
+)
+
+const (
+	FORMAT_TABLE = "table"
+	FORMAT_JSON  = "json"
+	FORMAT_CSV   = "csv"
+
+	SECTION_ARTISTS = "artists"
+	SECTION_ALBUMS  = "albums"
+	SECTION_TRACKS  = "tracks"
+	SECTION_TIME    = "time"
+	SECTION_SKIPS   = "skips"
+	SECTION_HOURS   = "hours"
+
+	PER_DAY   = "day"
+	PER_WEEK  = "week"
+	PER_MONTH = "month"
+)
+
+var SECTIONS = []string{SECTION_ARTISTS, SECTION_ALBUMS, SECTION_TRACKS, SECTION_TIME, SECTION_SKIPS, SECTION_HOURS}
+
+type StatsArgs struct {
+	debug        bool
+	logDbFile    string
+	from         string
+	to           string
+	limit        int
+	format       string
+	per          string
+	skipCoverage float64
+}
+
+func Setup() *cobra.Command {
+	args := StatsArgs{}
+
+	config, err := utils.GetConfig()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+	}
+
+	statsCmd := &cobra.Command{
+		Use:       "stats [section...]",
+		Short:     "Listening stats from the lastfm log db",
+		Long:      "Listening stats from the plays in the lastfm log db. Sections are artists, albums, tracks, time, skips and hours, all of them by default.",
+		ValidArgs: SECTIONS,
+		Args:      cobra.OnlyValidArgs,
+		Run: func(cmd *cobra.Command, positional []string) {
+			if err := statsRunner(&args, positional); err != nil {
+				if args.debug {
+					fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+				} else {
+					fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				}
+			}
+		},
+	}
+
+	statsCmd.Flags().StringVar(&args.logDbFile, "log-db-file", config.LastFm.LogDbFile, "the lastfm log db to read plays from")
+	statsCmd.Flags().StringVar(&args.from, "from", "", "only plays from this date (2024-01-31) or age (30d, 2w, 1y) on")
+	statsCmd.Flags().StringVar(&args.to, "to", "", "only plays before this date (2024-01-31) or age (30d, 2w, 1y)")
+	statsCmd.Flags().IntVarP(&args.limit, "limit", "l", 10, "how many artists, albums and tracks to list")
+	statsCmd.Flags().StringVarP(&args.format, "format", "f", FORMAT_TABLE, "output format, one of 'table'|'json'|'csv'")
+	statsCmd.Flags().StringVar(&args.per, "per", PER_DAY, "listening time per 'day'|'week'|'month'")
+	statsCmd.Flags().Float64Var(&args.skipCoverage, "skip-coverage", 0.5, "plays that covered less than this much of the track count as skips")
+	statsCmd.Flags().BoolVar(&args.debug, "debug", config.Debug, "enable debug mode")
+
+	statsCmd.AddCommand(ReportSetup())
+	return statsCmd
+}
+
+// a date or age (see utils.ParseDateOrAge), the zero time if empty
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	return utils.ParseDateOrAge(value, now)
+}
+
+// every play in the log db that started in [from, to), either can be zero to
+// leave that side open
+func loadPlays(logDbFile string, from time.Time, to time.Time) ([]dbUtils.PlayRecord, error) {
+	if logDbFile == "" {
+		return nil, fmt.Errorf("log db file not provided and not set in config (lastfm.logDbFile)")
+	}
+
+	if _, err := os.Stat(logDbFile); err != nil {
+		return nil, fmt.Errorf("could not open log db file (%s): %s", logDbFile, err.Error())
+	}
+
+	db, err := dbUtils.OpenDB(logDbFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer db.Close()
+
+	if err := dbUtils.RunMigrations(db); err != nil {
+		return nil, fmt.Errorf("could not run migrations on log db file: %s", err.Error())
+	}
+
+	plays, err := dbUtils.GetPlays(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	inRange := []dbUtils.PlayRecord{}
+
+	for _, play := range plays {
+		if (!from.IsZero() && play.StartTime.Before(from)) || (!to.IsZero() && !play.StartTime.Before(to)) {
+			continue
+		}
+
+		play.StartTime = play.StartTime.Local()
+		inRange = append(inRange, play)
+	}
+
+	return inRange, nil
+}
+
+func statsRunner(args *StatsArgs, sections []string) error {
+	if !slices.Contains([]string{FORMAT_TABLE, FORMAT_JSON, FORMAT_CSV}, args.format) {
+		return fmt.Errorf("invalid --format, expected value of 'table'|'json'|'csv'")
+	}
+
+	if !slices.Contains([]string{PER_DAY, PER_WEEK, PER_MONTH}, args.per) {
+		return fmt.Errorf("invalid --per, expected value of 'day'|'week'|'month'")
+	}
+
+	now := time.Now()
+	from, err := parseTime(args.from, now)
+
+	if err != nil {
+		return fmt.Errorf("invalid --from: %s", err.Error())
+	}
+
+	to, err := parseTime(args.to, now)
+
+	if err != nil {
+		return fmt.Errorf("invalid --to: %s", err.Error())
+	}
+
+	plays, err := loadPlays(args.logDbFile, from, to)
+
+	if err != nil {
+		return err
+	}
+
+	if len(sections) == 0 {
+		sections = SECTIONS
+	}
+
+	stats := analyze(plays, args)
+
+	switch args.format {
+	case FORMAT_JSON:
+		return printJson(stats, sections)
+	case FORMAT_CSV:
+		return printCsv(stats, sections)
+	}
+
+	printTable(stats, sections)
+	return nil
+}
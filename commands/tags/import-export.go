@@ -0,0 +1,451 @@
+package tags
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/kitesi/music/library"
+	"github.com/kitesi/music/utils"
+	"github.com/spf13/cobra"
+)
+
+type TagsExportArgs struct {
+	debug     bool
+	musicPath string
+	format    string
+	output    string
+	maps      []string
+}
+
+type TagsImportArgs struct {
+	debug     bool
+	musicPath string
+	format    string
+	tagName   string
+	set       bool
+	maps      []string
+}
+
+func ExportSetup() *cobra.Command {
+	args := TagsExportArgs{}
+
+	exportCmd := &cobra.Command{
+		Use:   "export <tag>",
+		Short: "Export a tag as a playlist file",
+		Long:  "Export a tag (with its nested tags) as a m3u8, pls, xspf or json playlist. The format is taken from the output file's extension unless --format is given.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, positional []string) {
+			if err := exportRunner(&args, positional[0]); err != nil {
+				if args.debug {
+					fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+				} else {
+					fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				}
+			}
+		},
+	}
+
+	config, err := utils.GetConfig()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+	}
+
+	exportCmd.Flags().StringVarP(&args.format, "format", "f", "", "playlist format, one of 'm3u8'|'pls'|'xspf'|'json'")
+	exportCmd.Flags().StringVarP(&args.output, "output", "o", "", "file to write to instead of stdout")
+	exportCmd.Flags().StringArrayVar(&args.maps, "map", []string{}, "rewrite paths starting with a prefix, as from=to (e.g. /home/me/music=E:\\Music)")
+	exportCmd.Flags().BoolVar(&args.debug, "debug", config.Debug, "enable debug mode")
+	exportCmd.Flags().StringVarP(&args.musicPath, "music-path", "m", config.MusicPath, "the music path to use")
+
+	return exportCmd
+}
+
+func ImportSetup() *cobra.Command {
+	args := TagsImportArgs{}
+
+	importCmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Import a playlist file into a tag",
+		Long:  "Add the songs of a m3u, m3u8, pls, xspf or json playlist to a tag, named after the file by default. Paths are matched against the music path, songs that can't be found are listed.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, positional []string) {
+			if err := importRunner(&args, positional[0]); err != nil {
+				if args.debug {
+					fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+				} else {
+					fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				}
+			}
+		},
+	}
+
+	config, err := utils.GetConfig()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+	}
+
+	importCmd.Flags().StringVarP(&args.format, "format", "f", "", "playlist format, one of 'm3u8'|'pls'|'xspf'|'json', from the file's extension by default")
+	importCmd.Flags().StringVarP(&args.tagName, "tag", "t", "", "tag to add the songs to")
+	importCmd.Flags().BoolVar(&args.set, "set", false, "replace the songs in the tag instead of adding to them")
+	importCmd.Flags().StringArrayVar(&args.maps, "map", []string{}, "rewrite paths starting with a prefix, as from=to (e.g. C:\\Users\\me\\Music=/home/me/music)")
+	importCmd.Flags().BoolVar(&args.debug, "debug", config.Debug, "enable debug mode")
+	importCmd.Flags().StringVarP(&args.musicPath, "music-path", "m", config.MusicPath, "the music path to use")
+
+	return importCmd
+}
+
+type pathMap struct {
+	from string
+	to   string
+}
+
+func parsePathMaps(values []string) ([]pathMap, error) {
+	maps := []pathMap{}
+
+	for _, value := range values {
+		from, to, ok := strings.Cut(value, "=")
+
+		if !ok || from == "" {
+			return nil, fmt.Errorf("invalid --map \"%s\", expected from=to", value)
+		}
+
+		maps = append(maps, pathMap{from: from, to: to})
+	}
+
+	return maps, nil
+}
+
+func isWindowsPath(path string) bool {
+	return windowsDriveRegex.MatchString(path) || strings.Contains(path, "\\")
+}
+
+// the path with the first matching prefix replaced. Windows paths are
+// compared ignoring case and the kind of slash, and the rest of the path
+// gets the slashes of the replacement.
+func applyPathMaps(path string, maps []pathMap) string {
+	for _, m := range maps {
+		rest := ""
+		matched := false
+
+		if isWindowsPath(m.from) || isWindowsPath(path) {
+			slashed := strings.ReplaceAll(path, "\\", "/")
+			from := strings.TrimSuffix(strings.ReplaceAll(m.from, "\\", "/"), "/")
+
+			if len(slashed) >= len(from) && strings.EqualFold(slashed[:len(from)], from) {
+				rest, matched = slashed[len(from):], true
+			}
+		} else {
+			from := strings.TrimSuffix(m.from, "/")
+
+			if strings.HasPrefix(path, from) {
+				rest, matched = path[len(from):], true
+			}
+		}
+
+		// only whole directory names
+		if !matched || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			continue
+		}
+
+		to := strings.TrimRight(m.to, "/\\")
+
+		if isWindowsPath(m.to) {
+			rest = strings.ReplaceAll(rest, "/", "\\")
+		}
+
+		return to + rest
+	}
+
+	return path
+}
+
+func exportRunner(args *TagsExportArgs, tagName string) error {
+	format := args.format
+
+	if format == "" && args.output != "" {
+		detected, err := playlistFormat(args.output)
+
+		if err != nil {
+			return err
+		}
+
+		format = detected
+	} else if format == "" {
+		format = FORMAT_M3U8
+	}
+
+	if !slices.Contains([]string{FORMAT_M3U8, FORMAT_PLS, FORMAT_XSPF, FORMAT_JSON}, format) {
+		return errors.New("invalid --format, expected value of 'm3u8'|'pls'|'xspf'|'json'")
+	}
+
+	maps, err := parsePathMaps(args.maps)
+
+	if err != nil {
+		return err
+	}
+
+	storedTags, err := GetStoredTags(args.musicPath)
+
+	if err != nil {
+		return fmt.Errorf("could not get stored tags: %w", err)
+	}
+
+	songs, ok := GetTagSongs(storedTags, tagName)
+
+	if !ok {
+		return fmt.Errorf("tag \"%s\" does not exist", tagName)
+	}
+
+	librarySongs, err := library.GetSongs(args.musicPath)
+
+	if err != nil {
+		return fmt.Errorf("could not get library: %w", err)
+	}
+
+	indexedSongs := make(map[string]library.Song, len(librarySongs))
+
+	for _, song := range librarySongs {
+		indexedSongs[song.Path] = song
+	}
+
+	list := playlist{Name: tagName, Tracks: []playlistTrack{}}
+
+	for _, songPath := range songs {
+		track := playlistTrack{Path: songPath}
+
+		if song, ok := indexedSongs[songPath]; ok {
+			track.Title = song.Title
+			track.Artist = song.Artist
+			track.Album = song.Album
+			track.Duration = int(song.Duration)
+		}
+
+		if absolutePath, err := filepath.Abs(songPath); err == nil {
+			track.Path = absolutePath
+		}
+
+		track.Path = applyPathMaps(track.Path, maps)
+		list.Tracks = append(list.Tracks, track)
+	}
+
+	var out io.Writer = os.Stdout
+
+	if args.output != "" {
+		file, err := os.Create(args.output)
+
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+		out = file
+	}
+
+	return writePlaylist(out, format, list)
+}
+
+// finds songs in the library index by their path, or by the end of it when
+// the playlist comes from somewhere else
+type songResolver struct {
+	byPath map[string]string
+	// each song's path components, lowercase and last first
+	components map[string][]string
+}
+
+func newSongResolver(songs []library.Song) songResolver {
+	resolver := songResolver{byPath: map[string]string{}, components: map[string][]string{}}
+
+	for _, song := range songs {
+		absolutePath, err := filepath.Abs(song.Path)
+
+		if err != nil {
+			absolutePath = song.Path
+		}
+
+		resolver.byPath[absolutePath] = song.Path
+		resolver.components[song.Path] = reversedComponents(song.Path)
+	}
+
+	return resolver
+}
+
+func reversedComponents(path string) []string {
+	parts := strings.Split(strings.ToLower(strings.ReplaceAll(path, "\\", "/")), "/")
+	slices.Reverse(parts)
+	return parts
+}
+
+// a match on the file name alone could be any song with the same name (e.g.
+// "01 intro.mp3"), so at least its directory has to match too
+const MIN_MATCHING_COMPONENTS = 2
+
+// the song's path in the library, the playlist's own directory is used for
+// relative paths
+func (r songResolver) resolve(path string, playlistDir string) (string, bool) {
+	if path == "" {
+		return "", false
+	}
+
+	if !isWindowsPath(path) {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(playlistDir, path)
+		}
+
+		if songPath, ok := r.byPath[filepath.Clean(path)]; ok {
+			return songPath, true
+		}
+	}
+
+	songPath, length := r.longestMatch(path)
+
+	if length < MIN_MATCHING_COMPONENTS {
+		return "", false
+	}
+
+	return songPath, true
+}
+
+// the only song with the same file name, shown next to a path that
+// couldn't be resolved
+func (r songResolver) guess(path string) string {
+	songPath, length := r.longestMatch(path)
+
+	if length == 0 {
+		return ""
+	}
+
+	return songPath
+}
+
+// whichever song shares the longest end of the path and how many components
+// it shares, as long as it's the only one that does
+func (r songResolver) longestMatch(path string) (string, int) {
+	wanted := reversedComponents(path)
+	best := ""
+	bestLength := 0
+	tied := false
+
+	for songPath, components := range r.components {
+		length := 0
+
+		for length < len(wanted) && length < len(components) && wanted[length] == components[length] {
+			length++
+		}
+
+		if length == 0 {
+			continue
+		}
+
+		if length > bestLength {
+			best, bestLength, tied = songPath, length, false
+		} else if length == bestLength {
+			tied = true
+		}
+	}
+
+	if tied {
+		return "", 0
+	}
+
+	return best, bestLength
+}
+
+func importRunner(args *TagsImportArgs, fileName string) error {
+	format := args.format
+
+	if format == "" {
+		detected, err := playlistFormat(fileName)
+
+		if err != nil {
+			return err
+		}
+
+		format = detected
+	}
+
+	maps, err := parsePathMaps(args.maps)
+
+	if err != nil {
+		return err
+	}
+
+	tagName := args.tagName
+
+	if tagName == "" {
+		tagName = strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	}
+
+	if err := ValidateTagName(tagName); err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(fileName)
+
+	if err != nil {
+		return fmt.Errorf("could not read playlist: %w", err)
+	}
+
+	tracks, err := readPlaylist(content, format)
+
+	if err != nil {
+		return err
+	}
+
+	librarySongs, err := library.GetSongs(args.musicPath)
+
+	if err != nil {
+		return fmt.Errorf("could not get library: %w", err)
+	}
+
+	resolver := newSongResolver(librarySongs)
+	playlistDir, err := filepath.Abs(filepath.Dir(fileName))
+
+	if err != nil {
+		return err
+	}
+
+	songs := []string{}
+	unresolved := []string{}
+
+	for _, track := range tracks {
+		mappedPath := applyPathMaps(track.Path, maps)
+		songPath, ok := resolver.resolve(mappedPath, playlistDir)
+
+		if !ok {
+			if guess := resolver.guess(mappedPath); guess != "" {
+				unresolved = append(unresolved, fmt.Sprintf("%s (maybe %s)", track.Path, guess))
+			} else {
+				unresolved = append(unresolved, track.Path)
+			}
+
+			continue
+		}
+
+		songs = append(songs, songPath)
+	}
+
+	if len(songs) > 0 || args.set {
+		if err := ChangeSongsInTag(args.musicPath, tagName, songs, !args.set, "tags import "+filepath.Base(fileName)); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Imported %d of %d songs into tag \"%s\"\n", len(songs), len(tracks), tagName)
+
+	if len(unresolved) > 0 {
+		fmt.Fprintf(os.Stderr, "\nCould not find %d songs:\n", len(unresolved))
+
+		for _, path := range unresolved {
+			fmt.Fprintf(os.Stderr, "- %s\n", path)
+		}
+	}
+
+	return nil
+}
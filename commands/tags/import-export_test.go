@@ -0,0 +1,132 @@
+package tags
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kitesi/music/library"
+)
+
+func TestApplyPathMaps(t *testing.T) {
+	maps := []pathMap{
+		{from: "C:\\Users\\friend\\Music", to: "/home/me/music"},
+		{from: "/home/me/music/", to: "E:\\Music\\"},
+		{from: "/media/usb", to: "/mnt/usb"},
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"C:\\Users\\friend\\Music\\Nujabes\\Luv.mp3", "/home/me/music/Nujabes/Luv.mp3"},
+		{"c:/users/FRIEND/music/a.mp3", "/home/me/music/a.mp3"},
+		{"/home/me/music/Nujabes/Luv.mp3", "E:\\Music\\Nujabes\\Luv.mp3"},
+		{"/home/me/music", "E:\\Music"},
+		{"/media/usb/a.mp3", "/mnt/usb/a.mp3"},
+		// only whole directory names
+		{"/media/usb2/a.mp3", "/media/usb2/a.mp3"},
+		{"C:\\Users\\friend\\Musical\\a.mp3", "C:\\Users\\friend\\Musical\\a.mp3"},
+		{"/elsewhere/a.mp3", "/elsewhere/a.mp3"},
+	}
+
+	for _, test := range tests {
+		if got := applyPathMaps(test.path, maps); got != test.want {
+			t.Errorf("applyPathMaps(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestParsePathMaps(t *testing.T) {
+	maps, err := parsePathMaps([]string{"a=b", "C:\\x=/y=z", "/gone="})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []pathMap{{from: "a", to: "b"}, {from: "C:\\x", to: "/y=z"}, {from: "/gone", to: ""}}
+
+	if !reflect.DeepEqual(maps, want) {
+		t.Errorf("parsePathMaps = %+v, want %+v", maps, want)
+	}
+
+	for _, value := range []string{"no-equals", "=b"} {
+		if _, err := parsePathMaps([]string{value}); err == nil {
+			t.Errorf("parsePathMaps(%q) should fail", value)
+		}
+	}
+}
+
+func TestSongResolver(t *testing.T) {
+	musicPath := t.TempDir()
+	songs := []string{
+		"Nujabes/Modal Soul/Luv(sic).mp3",
+		"Nujabes/Modal Soul/Feather.mp3",
+		"Nujabes/Metaphorical Music/Feather.mp3",
+		"Mitski/Be the Cowboy/01 Geyser.mp3",
+		"Mitski/Puberty 2/01 Happy.mp3",
+		"Various/01 Intro.mp3",
+		"Other/01 Intro.mp3",
+	}
+
+	librarySongs := []library.Song{}
+
+	for _, song := range songs {
+		librarySongs = append(librarySongs, library.Song{Path: filepath.Join(musicPath, song)})
+	}
+
+	resolver := newSongResolver(librarySongs)
+	playlistDir := filepath.Join(musicPath, "playlists")
+
+	tests := []struct {
+		name string
+		path string
+		// relative to the music path, empty if it shouldn't resolve
+		want string
+	}{
+		{"absolute", filepath.Join(musicPath, "Nujabes/Modal Soul/Luv(sic).mp3"), "Nujabes/Modal Soul/Luv(sic).mp3"},
+		{"relative to the playlist", "../Mitski/Puberty 2/01 Happy.mp3", "Mitski/Puberty 2/01 Happy.mp3"},
+		{"unclean", filepath.Join(musicPath, "Nujabes/./Modal Soul/../Modal Soul/Feather.mp3"), "Nujabes/Modal Soul/Feather.mp3"},
+		{"another computer", "/home/friend/Music/Modal Soul/Luv(sic).mp3", "Nujabes/Modal Soul/Luv(sic).mp3"},
+		{"windows path ignoring case", "D:\\Music\\nujabes\\metaphorical music\\FEATHER.mp3", "Nujabes/Metaphorical Music/Feather.mp3"},
+		{"longest match wins", "/x/Metaphorical Music/Feather.mp3", "Nujabes/Metaphorical Music/Feather.mp3"},
+		{"tied", "/x/Feather.mp3", ""},
+		{"only the file name", "/x/y/Luv(sic).mp3", ""},
+		{"a file name next to the playlist", "01 Happy.mp3", ""},
+		{"missing", "/x/Nujabes/Missing.mp3", ""},
+		{"empty", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := resolver.resolve(test.path, playlistDir)
+			want := ""
+
+			if test.want != "" {
+				want = filepath.Join(musicPath, test.want)
+			}
+
+			if got != want || ok != (want != "") {
+				t.Errorf("resolve(%q) = %q, %t, want %q", test.path, got, ok, want)
+			}
+		})
+	}
+
+	guesses := map[string]string{
+		"/x/y/Luv(sic).mp3": "Nujabes/Modal Soul/Luv(sic).mp3",
+		"/x/Feather.mp3":    "",
+		"/x/y/Unknown.mp3":  "",
+	}
+
+	for path, wantGuess := range guesses {
+		want := ""
+
+		if wantGuess != "" {
+			want = filepath.Join(musicPath, wantGuess)
+		}
+
+		if got := resolver.guess(path); got != want {
+			t.Errorf("guess(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
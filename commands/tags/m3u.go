@@ -0,0 +1,161 @@
+package tags
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kitesi/music/library"
+)
+
+const (
+	M3U_HEADER   = "#EXTM3U"
+	M3U_PLAYLIST = "#PLAYLIST:"
+	M3U_EXTINF   = "#EXTINF:"
+	// our own directives, players skip them like any other comment
+	M3U_ADDED    = "#EXT-MUSIC-ADDED:"
+	M3U_ADDED_BY = "#EXT-MUSIC-ADDED-BY:"
+)
+
+// one song in a tag file
+type tagEntry struct {
+	// as written in the file, relative to it or absolute
+	Path string
+	// from #EXTINF, -1 if unknown
+	Duration int
+	// from #EXTINF, usually "artist - title"
+	Title   string
+	HasInfo bool
+	Added   time.Time
+	// the query that added the song
+	AddedBy string
+	// any other lines before the song, kept as they are
+	Comments []string
+}
+
+type tagFile struct {
+	// #EXTM3U and #PLAYLIST
+	Header  []string
+	Entries []tagEntry
+	// lines after the last song
+	Trailer []string
+}
+
+func parseTagFile(content string) tagFile {
+	file := tagFile{}
+	entry := tagEntry{Duration: -1}
+	inHeader := true
+
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "":
+			continue
+		case inHeader && (line == M3U_HEADER || strings.HasPrefix(line, M3U_PLAYLIST)):
+			file.Header = append(file.Header, line)
+			continue
+		}
+
+		inHeader = false
+
+		switch {
+		case strings.HasPrefix(line, M3U_EXTINF):
+			// #EXTINF:<duration>[ attributes],<title>
+			info, title, _ := strings.Cut(strings.TrimPrefix(line, M3U_EXTINF), ",")
+			durationText, _, _ := strings.Cut(info, " ")
+			duration, err := strconv.ParseFloat(durationText, 64)
+
+			if err != nil {
+				entry.Comments = append(entry.Comments, line)
+				continue
+			}
+
+			entry.Duration = int(duration)
+			entry.Title = title
+			entry.HasInfo = true
+		case strings.HasPrefix(line, M3U_ADDED):
+			added, err := time.Parse(time.RFC3339, strings.TrimPrefix(line, M3U_ADDED))
+
+			if err != nil {
+				entry.Comments = append(entry.Comments, line)
+				continue
+			}
+
+			entry.Added = added
+		case strings.HasPrefix(line, M3U_ADDED_BY):
+			entry.AddedBy = strings.TrimPrefix(line, M3U_ADDED_BY)
+		case strings.HasPrefix(line, "#"):
+			entry.Comments = append(entry.Comments, line)
+		default:
+			entry.Path = line
+			file.Entries = append(file.Entries, entry)
+			entry = tagEntry{Duration: -1}
+		}
+	}
+
+	file.Trailer = entry.Comments
+	return file
+}
+
+func (f tagFile) String() string {
+	lines := append([]string{}, f.Header...)
+
+	for _, entry := range f.Entries {
+		lines = append(lines, entry.Comments...)
+
+		if entry.HasInfo {
+			lines = append(lines, fmt.Sprintf("%s%d,%s", M3U_EXTINF, entry.Duration, entry.Title))
+		}
+
+		if !entry.Added.IsZero() {
+			lines = append(lines, M3U_ADDED+entry.Added.Format(time.RFC3339))
+		}
+
+		if entry.AddedBy != "" {
+			lines = append(lines, M3U_ADDED_BY+entry.AddedBy)
+		}
+
+		lines = append(lines, entry.Path)
+	}
+
+	lines = append(lines, f.Trailer...)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func newTagFile(tagName string) tagFile {
+	return tagFile{Header: []string{M3U_HEADER, M3U_PLAYLIST + tagName}}
+}
+
+// the absolute (or music path rooted) path of the entry's song
+func (e tagEntry) songPath(tagPath string) string {
+	if filepath.IsAbs(e.Path) {
+		return e.Path
+	}
+
+	return filepath.Join(filepath.Dir(tagPath), e.Path)
+}
+
+// sets the #EXTINF line from the song's embedded tags, the file name is used
+// when it has no title
+func (e *tagEntry) setInfo(song library.Song) {
+	e.Duration = -1
+
+	if song.Duration > 0 {
+		e.Duration = int(song.Duration)
+	}
+
+	e.Title = song.Title
+
+	if e.Title == "" {
+		e.Title = strings.TrimSuffix(filepath.Base(song.Path), filepath.Ext(song.Path))
+	} else if song.Artist != "" {
+		e.Title = song.Artist + " - " + song.Title
+	}
+
+	// a newline would end the directive
+	e.Title = strings.Join(strings.Fields(e.Title), " ")
+	e.HasInfo = true
+}
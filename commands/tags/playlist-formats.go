@@ -0,0 +1,290 @@
+package tags
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FORMAT_M3U8 = "m3u8"
+	FORMAT_PLS  = "pls"
+	FORMAT_XSPF = "xspf"
+	FORMAT_JSON = "json"
+)
+
+// a song in a playlist file, anything but the path can be empty
+type playlistTrack struct {
+	Path   string `json:"path"`
+	Title  string `json:"title,omitempty"`
+	Artist string `json:"artist,omitempty"`
+	Album  string `json:"album,omitempty"`
+	// seconds, 0 if unknown
+	Duration int `json:"duration,omitempty"`
+}
+
+type playlist struct {
+	Name   string          `json:"name"`
+	Tracks []playlistTrack `json:"tracks"`
+}
+
+// "artist - title" like the #EXTINF lines
+func (t playlistTrack) displayTitle() string {
+	if t.Artist != "" && t.Title != "" {
+		return t.Artist + " - " + t.Title
+	}
+
+	if t.Title != "" {
+		return t.Title
+	}
+
+	// the path can be a windows one after --map
+	name := filepath.Base(strings.ReplaceAll(t.Path, "\\", "/"))
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	// milliseconds
+	Duration int `xml:"duration,omitempty"`
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+// the format of a playlist file from its extension
+func playlistFormat(fileName string) (string, error) {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".m3u", ".m3u8":
+		return FORMAT_M3U8, nil
+	case ".pls":
+		return FORMAT_PLS, nil
+	case ".xspf":
+		return FORMAT_XSPF, nil
+	case ".json":
+		return FORMAT_JSON, nil
+	}
+
+	return "", fmt.Errorf("unknown playlist format for \"%s\", expected an extension of '.m3u'|'.m3u8'|'.pls'|'.xspf'|'.json'", fileName)
+}
+
+func writePlaylist(out io.Writer, format string, list playlist) error {
+	switch format {
+	case FORMAT_M3U8:
+		file := newTagFile(list.Name)
+
+		for _, track := range list.Tracks {
+			file.Entries = append(file.Entries, tagEntry{Path: track.Path, Duration: unknownDuration(track.Duration), Title: track.displayTitle(), HasInfo: true})
+		}
+
+		_, err := io.WriteString(out, file.String())
+		return err
+	case FORMAT_PLS:
+		writer := bufio.NewWriter(out)
+		fmt.Fprintln(writer, "[playlist]")
+
+		for i, track := range list.Tracks {
+			fmt.Fprintf(writer, "File%d=%s\nTitle%d=%s\nLength%d=%d\n", i+1, track.Path, i+1, track.displayTitle(), i+1, unknownDuration(track.Duration))
+		}
+
+		fmt.Fprintf(writer, "NumberOfEntries=%d\nVersion=2\n", len(list.Tracks))
+		return writer.Flush()
+	case FORMAT_XSPF:
+		xspf := xspfPlaylist{Version: "1", Title: list.Name}
+
+		for _, track := range list.Tracks {
+			xspf.Tracks = append(xspf.Tracks, xspfTrack{
+				Location: pathToLocation(track.Path),
+				Title:    track.Title,
+				Creator:  track.Artist,
+				Album:    track.Album,
+				Duration: track.Duration * 1000,
+			})
+		}
+
+		if _, err := io.WriteString(out, xml.Header); err != nil {
+			return err
+		}
+
+		encoder := xml.NewEncoder(out)
+		encoder.Indent("", "  ")
+
+		if err := encoder.Encode(xspf); err != nil {
+			return err
+		}
+
+		_, err := io.WriteString(out, "\n")
+		return err
+	case FORMAT_JSON:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	}
+
+	return fmt.Errorf("invalid format, expected value of 'm3u8'|'pls'|'xspf'|'json'")
+}
+
+// xspf locations are uris, absolute paths become file:// ones
+func pathToLocation(path string) string {
+	slashed := strings.ReplaceAll(path, "\\", "/")
+
+	if windowsDriveRegex.MatchString(slashed) {
+		slashed = "/" + slashed
+	}
+
+	location := url.URL{Path: slashed}
+
+	if strings.HasPrefix(slashed, "/") {
+		location.Scheme = "file"
+	}
+
+	return location.String()
+}
+
+func locationToPath(location string) string {
+	parsed, err := url.Parse(location)
+
+	if err != nil || (parsed.Scheme != "file" && parsed.Scheme != "") {
+		return location
+	}
+
+	// file:///C:/Music/song.mp3
+	if windowsDriveRegex.MatchString(strings.TrimPrefix(parsed.Path, "/")) {
+		return strings.TrimPrefix(parsed.Path, "/")
+	}
+
+	return parsed.Path
+}
+
+var windowsDriveRegex = regexp.MustCompile(`^[a-zA-Z]:[\\/]`)
+
+func readPlaylist(content []byte, format string) ([]playlistTrack, error) {
+	tracks := []playlistTrack{}
+
+	switch format {
+	case FORMAT_M3U8:
+		// utf-8 files from windows can start with a byte order mark
+		text := strings.TrimPrefix(string(content), "\uFEFF")
+
+		for _, entry := range parseTagFile(text).Entries {
+			track := playlistTrack{Path: entry.Path, Title: entry.Title}
+
+			if entry.Duration > 0 {
+				track.Duration = entry.Duration
+			}
+
+			tracks = append(tracks, track)
+		}
+	case FORMAT_PLS:
+		byNumber := map[int]*playlistTrack{}
+
+		for _, line := range strings.Split(string(content), "\n") {
+			key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+
+			if !ok {
+				continue
+			}
+
+			for _, field := range []string{"File", "Title", "Length"} {
+				number, err := strconv.Atoi(strings.TrimPrefix(key, field))
+
+				if !strings.HasPrefix(key, field) || err != nil {
+					continue
+				}
+
+				if byNumber[number] == nil {
+					byNumber[number] = &playlistTrack{}
+				}
+
+				switch field {
+				case "File":
+					byNumber[number].Path = value
+				case "Title":
+					byNumber[number].Title = value
+				case "Length":
+					byNumber[number].Duration = max(0, atoiOrZero(value))
+				}
+			}
+		}
+
+		numbers := []int{}
+
+		for number := range byNumber {
+			numbers = append(numbers, number)
+		}
+
+		sort.Ints(numbers)
+
+		for _, number := range numbers {
+			if byNumber[number].Path != "" {
+				tracks = append(tracks, *byNumber[number])
+			}
+		}
+	case FORMAT_XSPF:
+		var xspf xspfPlaylist
+
+		if err := xml.Unmarshal(content, &xspf); err != nil {
+			return nil, fmt.Errorf("could not parse xspf: %w", err)
+		}
+
+		for _, track := range xspf.Tracks {
+			tracks = append(tracks, playlistTrack{
+				Path:     locationToPath(strings.TrimSpace(track.Location)),
+				Title:    track.Title,
+				Artist:   track.Creator,
+				Album:    track.Album,
+				Duration: track.Duration / 1000,
+			})
+		}
+	case FORMAT_JSON:
+		var list playlist
+
+		if err := json.Unmarshal(content, &list); err != nil {
+			// a plain list of paths works too
+			paths := []string{}
+
+			if json.Unmarshal(content, &paths) != nil {
+				return nil, fmt.Errorf("could not parse json: %w", err)
+			}
+
+			for _, path := range paths {
+				list.Tracks = append(list.Tracks, playlistTrack{Path: path})
+			}
+		}
+
+		tracks = append(tracks, list.Tracks...)
+	default:
+		return nil, fmt.Errorf("invalid format, expected value of 'm3u8'|'pls'|'xspf'|'json'")
+	}
+
+	return tracks, nil
+}
+
+// m3u and pls use -1 for an unknown length
+func unknownDuration(duration int) int {
+	if duration <= 0 {
+		return -1
+	}
+
+	return duration
+}
+
+func atoiOrZero(value string) int {
+	number, _ := strconv.Atoi(value)
+	return number
+}
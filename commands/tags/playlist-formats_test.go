@@ -0,0 +1,210 @@
+package tags
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadPlaylist(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		want    []playlistTrack
+	}{
+		{
+			name:   "m3u8",
+			format: FORMAT_M3U8,
+			content: "\uFEFF#EXTM3U\r\n#PLAYLIST:lofi\r\n" +
+				"#EXTINF:215,Nujabes - Luv(sic)\r\n../Nujabes/Luv(sic).mp3\r\n" +
+				"# a comment\r\n/music/Feather.mp3\r\n" +
+				"#EXTINF:-1,Stream\r\nhttp://example.com/stream\r\n",
+			want: []playlistTrack{
+				{Path: "../Nujabes/Luv(sic).mp3", Title: "Nujabes - Luv(sic)", Duration: 215},
+				{Path: "/music/Feather.mp3"},
+				{Path: "http://example.com/stream", Title: "Stream"},
+			},
+		},
+		{
+			name:   "plain m3u",
+			format: FORMAT_M3U8,
+			content: "C:\\Music\\a.mp3\n" +
+				"b.mp3\n",
+			want: []playlistTrack{{Path: "C:\\Music\\a.mp3"}, {Path: "b.mp3"}},
+		},
+		{
+			name:   "pls",
+			format: FORMAT_PLS,
+			content: "[playlist]\r\n" +
+				"File2=/music/b.mp3\r\nTitle2=B\r\nLength2=-1\r\n" +
+				"File1=/music/a=1.mp3\r\nTitle1=A\r\nLength1=200\r\n" +
+				"Title3=no file\r\n" +
+				"File10=/music/j.mp3\r\n" +
+				"NumberOfEntries=3\r\nVersion=2\r\n",
+			want: []playlistTrack{
+				{Path: "/music/a=1.mp3", Title: "A", Duration: 200},
+				{Path: "/music/b.mp3", Title: "B"},
+				{Path: "/music/j.mp3"},
+			},
+		},
+		{
+			name:   "xspf",
+			format: FORMAT_XSPF,
+			content: `<?xml version="1.0" encoding="UTF-8"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/">
+  <trackList>
+    <track>
+      <location>file:///music/Nujabes/Luv%28sic%29%20pt.%203.mp3</location>
+      <title>Luv(sic) pt. 3</title>
+      <creator>Nujabes</creator>
+      <album>Modal Soul</album>
+      <duration>215500</duration>
+    </track>
+    <track><location>file:///C:/Music/a.mp3</location></track>
+    <track><location> relative/b.mp3 </location></track>
+    <track><location>http://example.com/stream</location></track>
+  </trackList>
+</playlist>`,
+			want: []playlistTrack{
+				{Path: "/music/Nujabes/Luv(sic) pt. 3.mp3", Title: "Luv(sic) pt. 3", Artist: "Nujabes", Album: "Modal Soul", Duration: 215},
+				{Path: "C:/Music/a.mp3"},
+				{Path: "relative/b.mp3"},
+				{Path: "http://example.com/stream"},
+			},
+		},
+		{
+			name:    "json",
+			format:  FORMAT_JSON,
+			content: `{"name":"lofi","tracks":[{"path":"/music/a.mp3","title":"A","artist":"B","album":"C","duration":90},{"path":"b.mp3"}]}`,
+			want: []playlistTrack{
+				{Path: "/music/a.mp3", Title: "A", Artist: "B", Album: "C", Duration: 90},
+				{Path: "b.mp3"},
+			},
+		},
+		{
+			name:    "json list of paths",
+			format:  FORMAT_JSON,
+			content: `["/music/a.mp3", "b.mp3"]`,
+			want:    []playlistTrack{{Path: "/music/a.mp3"}, {Path: "b.mp3"}},
+		},
+		{
+			name:    "empty pls",
+			format:  FORMAT_PLS,
+			content: "[playlist]\nNumberOfEntries=0\n",
+			want:    []playlistTrack{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readPlaylist([]byte(test.content), test.format)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("readPlaylist = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadPlaylistErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+	}{
+		{"broken xspf", FORMAT_XSPF, "<playlist><trackList>"},
+		{"broken json", FORMAT_JSON, `{"tracks": [`},
+		{"json of the wrong shape", FORMAT_JSON, `42`},
+		{"unknown format", "wpl", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if tracks, err := readPlaylist([]byte(test.content), test.format); err == nil {
+				t.Errorf("readPlaylist = %+v, want an error", tracks)
+			}
+		})
+	}
+}
+
+// every format keeps the paths (and whatever else it can hold) when written
+// and read back
+func TestWritePlaylistRoundTrip(t *testing.T) {
+	list := playlist{Name: "road trip", Tracks: []playlistTrack{
+		{Path: "/music/Nujabes/Luv(sic) #3.mp3", Title: "Luv(sic)", Artist: "Nujabes", Album: "Modal Soul", Duration: 215},
+		{Path: "C:\\Music\\a & b.mp3", Title: "A & B"},
+		{Path: "/music/no tags.mp3"},
+	}}
+
+	tests := []struct {
+		format string
+		want   []playlistTrack
+	}{
+		{FORMAT_M3U8, []playlistTrack{
+			{Path: "/music/Nujabes/Luv(sic) #3.mp3", Title: "Nujabes - Luv(sic)", Duration: 215},
+			{Path: "C:\\Music\\a & b.mp3", Title: "A & B"},
+			{Path: "/music/no tags.mp3", Title: "no tags"},
+		}},
+		{FORMAT_PLS, []playlistTrack{
+			{Path: "/music/Nujabes/Luv(sic) #3.mp3", Title: "Nujabes - Luv(sic)", Duration: 215},
+			{Path: "C:\\Music\\a & b.mp3", Title: "A & B"},
+			{Path: "/music/no tags.mp3", Title: "no tags"},
+		}},
+		{FORMAT_XSPF, []playlistTrack{
+			{Path: "/music/Nujabes/Luv(sic) #3.mp3", Title: "Luv(sic)", Artist: "Nujabes", Album: "Modal Soul", Duration: 215},
+			{Path: "C:/Music/a & b.mp3", Title: "A & B"},
+			{Path: "/music/no tags.mp3"},
+		}},
+		{FORMAT_JSON, list.Tracks},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			var out bytes.Buffer
+
+			if err := writePlaylist(&out, test.format, list); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readPlaylist(out.Bytes(), test.format)
+
+			if err != nil {
+				t.Fatalf("could not read back %s: %s\n%s", test.format, err, out.String())
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("read back %+v, want %+v\n%s", got, test.want, out.String())
+			}
+		})
+	}
+
+	if err := writePlaylist(&bytes.Buffer{}, "wpl", list); err == nil {
+		t.Errorf("writing an unknown format should fail")
+	}
+}
+
+func TestPlaylistFormat(t *testing.T) {
+	tests := map[string]string{
+		"a.m3u":         FORMAT_M3U8,
+		"a.M3U8":        FORMAT_M3U8,
+		"dir.pls/a.pls": FORMAT_PLS,
+		"a.xspf":        FORMAT_XSPF,
+		"a.json":        FORMAT_JSON,
+	}
+
+	for fileName, want := range tests {
+		if got, err := playlistFormat(fileName); err != nil || got != want {
+			t.Errorf("playlistFormat(%q) = %q, %v, want %q", fileName, got, err, want)
+		}
+	}
+
+	if _, err := playlistFormat("a.wpl"); err == nil || !strings.Contains(err.Error(), "a.wpl") {
+		t.Errorf("playlistFormat of an unknown extension returned %v, want an error naming the file", err)
+	}
+}
@@ -0,0 +1,169 @@
+package tags
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kitesi/music/utils"
+)
+
+const SMART_TAG_SUFFIX = ".smart.json"
+
+// a tag that's a saved play query, its songs are whatever the query matches
+// when it's read. The fields are the play flags of the same name.
+type SmartTag struct {
+	Terms        []string `json:"terms"`
+	Tags         []string `json:"tags,omitempty"`
+	Match        string   `json:"match,omitempty"`
+	New          bool     `json:"new,omitempty"`
+	PlayNewFirst bool     `json:"playNewFirst,omitempty"`
+	SkipOldFirst bool     `json:"skipOldFirst,omitempty"`
+	SortType     string   `json:"sortType,omitempty"`
+	Limit        int      `json:"limit,omitempty"`
+	Skip         int      `json:"skip,omitempty"`
+}
+
+// runs a smart tag's query, storedTags are the tags its --tags can use
+type SmartTagResolver func(musicPath string, smartTag SmartTag, storedTags map[string][]string) ([]string, error)
+
+// the query code lives in the play package, which imports this one, so it
+// hands over the resolver when it's loaded
+var smartTagResolver SmartTagResolver
+
+func SetSmartTagResolver(resolver SmartTagResolver) {
+	smartTagResolver = resolver
+}
+
+func GetSmartTagPath(musicPath string, tagName string) string {
+	return filepath.Join(musicPath, "tags", tagName+SMART_TAG_SUFFIX)
+}
+
+func IsSmartTag(musicPath string, tagName string) bool {
+	_, err := os.Stat(GetSmartTagPath(musicPath, tagName))
+	return err == nil
+}
+
+func readSmartTag(tagPath string) (SmartTag, error) {
+	smartTag := SmartTag{}
+	content, err := os.ReadFile(tagPath)
+
+	if err != nil {
+		return smartTag, fmt.Errorf("could not read smart tag file \"%s\": %w", tagPath, err)
+	}
+
+	if err := json.Unmarshal(content, &smartTag); err != nil {
+		return smartTag, fmt.Errorf("could not parse smart tag file \"%s\": %w", tagPath, err)
+	}
+
+	return smartTag, nil
+}
+
+func SaveSmartTag(musicPath string, tagName string, smartTag SmartTag) error {
+	if smartTag.Terms == nil {
+		smartTag.Terms = []string{}
+	}
+
+	content, err := json.MarshalIndent(smartTag, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	if err := ValidateTagName(tagName); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(GetSmartTagPath(musicPath, tagName)), 0777); err != nil {
+		return fmt.Errorf("could not create tags directory: %w", err)
+	}
+
+	unlock, err := lockTags()
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	if err := utils.WriteFileAtomic(GetSmartTagPath(musicPath, tagName), append(content, '\n'), 0666); err != nil {
+		return fmt.Errorf("could not write smart tag file: %w", err)
+	}
+
+	return nil
+}
+
+// adds the songs of every smart tag in the tags directory to storedTags. The
+// queries only see the plain tags, not other smart tags.
+func resolveSmartTags(musicPath string, tagNames []string, storedTags map[string][]string) error {
+	plainTags := make(map[string][]string, len(storedTags))
+
+	for name, songs := range storedTags {
+		plainTags[name] = songs
+	}
+
+	for _, tagName := range tagNames {
+		if smartTagResolver == nil {
+			return fmt.Errorf("smart tags can't be read here")
+		}
+
+		smartTag, err := readSmartTag(GetSmartTagPath(musicPath, tagName))
+
+		if err != nil {
+			return err
+		}
+
+		songs, err := smartTagResolver(musicPath, smartTag, plainTags)
+
+		if err != nil {
+			return fmt.Errorf("could not get the songs of smart tag \"%s\": %w", tagName, err)
+		}
+
+		storedTags[tagName] = songs
+	}
+
+	return nil
+}
+
+// writes the smart tag's current songs to its m3u file, for players that
+// only know m3u files
+func MaterializeSmartTag(musicPath string, tagName string) (int, error) {
+	// the query reads the plain tags, so they can't change until it's written
+	unlock, err := lockTags()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer unlock()
+	storedTags, err := GetStoredTags(musicPath)
+
+	if err != nil {
+		return 0, fmt.Errorf("could not get stored tags: %w", err)
+	}
+
+	tagPath := GetTagPath(musicPath, tagName)
+	file := newTagFile(tagName)
+	file.Header = append(file.Header, fmt.Sprintf("# generated from %s%s, changes to this file are overwritten", filepath.Base(tagName), SMART_TAG_SUFFIX))
+
+	for _, song := range storedTags[tagName] {
+		relativePath, err := filepath.Rel(filepath.Dir(tagPath), song)
+
+		if err != nil {
+			return 0, fmt.Errorf("could not get relative path for \"%s\": %w", song, err)
+		}
+
+		file.Entries = append(file.Entries, tagEntry{Path: relativePath, Duration: -1})
+	}
+
+	if err := fillTagInfo(musicPath, tagPath, file.Entries); err != nil {
+		return 0, err
+	}
+
+	if err := utils.WriteFileAtomic(tagPath, []byte(file.String()), 0666); err != nil {
+		return 0, fmt.Errorf("could not write tag file: %w", err)
+	}
+
+	return len(file.Entries), nil
+}
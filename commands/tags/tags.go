@@ -3,13 +3,17 @@ package tags
 import (
 	// "errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/kitesi/music/library"
 	"github.com/kitesi/music/utils"
 	"github.com/spf13/cobra"
 )
@@ -18,6 +22,7 @@ type TagsCommandArgs struct {
 	edit         bool
 	check        bool
 	shouldDelete bool
+	materialize  bool
 	debug        bool
 	musicPath    string
 }
@@ -26,11 +31,34 @@ func GetTagPath(musicPath string, tagName string) string {
 	return filepath.Join(musicPath, "tags", tagName+".m3u")
 }
 
+// anything that changes a tag file holds this lock, so two processes (like
+// mx and spotify import) can't both read a tag and then overwrite each
+// other's change. It lives next to the config instead of in the tags
+// directory, which may be synced and a lock can't keep out other machines
+// anyway.
+func lockTags() (func(), error) {
+	configPath, err := utils.GetConfigPath()
+
+	if err != nil {
+		return nil, fmt.Errorf("could not find config directory: %w", err)
+	}
+
+	unlock, err := utils.LockFile(filepath.Join(filepath.Dir(configPath), "tags.lock"))
+
+	if err != nil {
+		return nil, fmt.Errorf("could not lock tags: %w", err)
+	}
+
+	return unlock, nil
+}
+
+// tag names are their path under the tags directory without the extension,
+// with / between the directories (e.g. genre/jazz/bebop)
 func GetStoredTags(musicPath string) (map[string][]string, error) {
 	storedTags := make(map[string][]string)
 	tagsDirectory := filepath.Join(musicPath, "tags")
 
-	files, err := os.ReadDir(filepath.Join(musicPath, "tags"))
+	_, err := os.Stat(tagsDirectory)
 
 	// if the tags directory doesn't exist, create the directory and return an empty map
 	if os.IsNotExist(err) {
@@ -45,46 +73,134 @@ func GetStoredTags(musicPath string) (map[string][]string, error) {
 		return storedTags, nil
 	}
 
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".m3u") {
-			songs := []string{}
+	smartTagNames := []string{}
 
-			tagPath := filepath.Join(musicPath, "tags", file.Name())
-			tagContent, err := os.ReadFile(tagPath)
+	err = filepath.WalkDir(tagsDirectory, func(tagPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
 
-			if err != nil {
-				return nil, fmt.Errorf("could not read tag file \"%s\": %w", tagPath, err)
-			}
+		if entry.IsDir() {
+			return nil
+		}
 
-			// sort of a naive implementation, and assumes the user won't modify the tag file
-			for _, line := range strings.Split(string(tagContent), "\n") {
-				if strings.HasPrefix(line, "#") || line == "" {
-					continue
-				}
+		relativePath, err := filepath.Rel(tagsDirectory, tagPath)
 
-				songPath := filepath.Join(musicPath, "tags", line)
+		if err != nil {
+			return err
+		}
 
-				if filepath.IsAbs(line) {
-					songPath = line
-				}
+		relativePath = filepath.ToSlash(relativePath)
 
-				songs = append(songs, songPath)
-			}
+		if strings.HasSuffix(relativePath, SMART_TAG_SUFFIX) {
+			smartTagNames = append(smartTagNames, strings.TrimSuffix(relativePath, SMART_TAG_SUFFIX))
+			return nil
+		}
 
-			storedTags[strings.TrimSuffix(file.Name(), ".m3u")] = songs
+		if !strings.HasSuffix(relativePath, ".m3u") {
+			return nil
 		}
+
+		songs := []string{}
+		tagContent, err := os.ReadFile(tagPath)
+
+		if err != nil {
+			return fmt.Errorf("could not read tag file \"%s\": %w", tagPath, err)
+		}
+
+		for _, entry := range parseTagFile(string(tagContent)).Entries {
+			songs = append(songs, entry.songPath(tagPath))
+		}
+
+		storedTags[strings.TrimSuffix(relativePath, ".m3u")] = songs
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// a smart tag's m3u file is only a copy for other players
+	if err := resolveSmartTags(musicPath, smartTagNames, storedTags); err != nil {
+		return nil, err
 	}
 
 	return storedTags, nil
 }
 
+// checks the tag name can be used as a path under the tags directory
+func ValidateTagName(tagName string) error {
+	if tagName == "" {
+		return errors.New("tag name can't be empty")
+	}
+
+	for _, part := range strings.Split(tagName, "/") {
+		if part == "" || part == "." || part == ".." || strings.Contains(part, "\\") {
+			return fmt.Errorf("invalid tag name \"%s\", expected names separated by /, like genre/jazz", tagName)
+		}
+	}
+
+	return nil
+}
+
+// whether tag is parent or one of its descendants
+func IsTagOrDescendant(tag string, parent string) bool {
+	return tag == parent || strings.HasPrefix(tag, parent+"/")
+}
+
+// the songs in the tag and all of its descendants
+func GetTagSongs(storedTags map[string][]string, tagName string) ([]string, bool) {
+	songs := []string{}
+	seen := map[string]bool{}
+	found := false
+
+	for _, name := range sortedTagNames(storedTags) {
+		if !IsTagOrDescendant(name, tagName) {
+			continue
+		}
+
+		found = true
+
+		for _, song := range storedTags[name] {
+			if !seen[song] {
+				seen[song] = true
+				songs = append(songs, song)
+			}
+		}
+	}
+
+	return songs, found
+}
+
+func sortedTagNames(storedTags map[string][]string) []string {
+	names := make([]string, 0, len(storedTags))
+
+	for name := range storedTags {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// removes the directories a deleted tag was in if nothing else is in them
+func removeEmptyTagDirectories(musicPath string, tagName string) {
+	tagsDirectory := filepath.Join(musicPath, "tags")
+
+	for dir := filepath.Dir(GetTagPath(musicPath, tagName)); dir != tagsDirectory; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
 func Setup() *cobra.Command {
 	args := TagsCommandArgs{}
 
 	tagsCmd := &cobra.Command{
 		Use:   "tags [tags..]",
 		Short: "Manage tags",
-		Long:  "Manage tags. Lists all the tags by default. If a tag is provided, this will list all the songs in that tag.",
+		Long:  "Manage tags. Lists all the tags by default. If a tag is provided, this will list all the songs in that tag.\n\nCommands that change tags lock them so they don't overwrite each other's changes. The lock only covers processes on the same machine, not other devices syncing the tags directory.",
 		Run: func(cmd *cobra.Command, positional []string) {
 			if err := tagsCommandRunner(&args, positional); err != nil {
 				if args.debug {
@@ -105,9 +221,12 @@ func Setup() *cobra.Command {
 	tagsCmd.Flags().BoolVarP(&args.edit, "edit", "e", false, "edit tags.json or a specific tag with $EDITOR")
 	tagsCmd.Flags().BoolVarP(&args.check, "check", "c", false, "check if the songs exist under the given tags")
 	tagsCmd.Flags().BoolVarP(&args.shouldDelete, "delete", "d", false, "delete a tag")
+	tagsCmd.Flags().BoolVar(&args.materialize, "materialize", false, "write a smart tag's songs to its m3u file")
 	tagsCmd.Flags().BoolVar(&args.debug, "debug", config.Debug, "enable debug mode")
 	tagsCmd.Flags().StringVarP(&args.musicPath, "music-path", "m", config.MusicPath, "the music path to use")
 
+	tagsCmd.AddCommand(ExportSetup())
+	tagsCmd.AddCommand(ImportSetup())
 	return tagsCmd
 }
 
@@ -122,6 +241,27 @@ func tagsCommandRunner(args *TagsCommandArgs, positional []string) error {
 		return errors.New("can't use --edit with --check")
 	} else if args.check && args.shouldDelete {
 		return errors.New("can't use --delete with --check")
+	} else if args.materialize && (len(positional) == 0 || args.edit || args.shouldDelete || args.check) {
+		return errors.New("--materialize needs a tag and can't be used with --edit, --delete or --check")
+	}
+
+	if args.materialize {
+		for _, requestedTagName := range positional {
+			if !IsSmartTag(args.musicPath, requestedTagName) {
+				fmt.Fprintf(os.Stderr, "error: \"%s\" is not a smart tag\n", requestedTagName)
+				continue
+			}
+
+			count, err := MaterializeSmartTag(args.musicPath, requestedTagName)
+
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("wrote %d songs to %s\n", count, GetTagPath(args.musicPath, requestedTagName))
+		}
+
+		return nil
 	}
 
 	if args.check {
@@ -132,7 +272,7 @@ func tagsCommandRunner(args *TagsCommandArgs, positional []string) error {
 		}
 
 		for _, requestedTagName := range positional {
-			tag, ok := storedTags[requestedTagName]
+			tag, ok := GetTagSongs(storedTags, requestedTagName)
 
 			if !ok {
 				fmt.Fprintf(os.Stderr, "error: tag \"%s\" does not exist\n", requestedTagName)
@@ -141,6 +281,7 @@ func tagsCommandRunner(args *TagsCommandArgs, positional []string) error {
 
 			allSongsExist := true
 
+			// the library index can be an hour old, so ask the file system
 			for _, song := range tag {
 				_, err := os.Stat(song)
 
@@ -168,10 +309,7 @@ func tagsCommandRunner(args *TagsCommandArgs, positional []string) error {
 			return fmt.Errorf("could not get stored tags: %w", err)
 		}
 
-		for k := range storedTags {
-			fmt.Println(k)
-		}
-
+		printTagTree(storedTags)
 		return nil
 	}
 
@@ -188,6 +326,18 @@ func tagsCommandRunner(args *TagsCommandArgs, positional []string) error {
 		return fmt.Errorf("could not get tags directory: %w", err)
 	}
 
+	// held from reading the tags until the last one is deleted, so a tag
+	// changed in the meantime isn't missed
+	if args.shouldDelete {
+		unlock, err := lockTags()
+
+		if err != nil {
+			return err
+		}
+
+		defer unlock()
+	}
+
 	storedTags, err := GetStoredTags(args.musicPath)
 
 	if err != nil {
@@ -195,16 +345,25 @@ func tagsCommandRunner(args *TagsCommandArgs, positional []string) error {
 	}
 
 	for _, requestedTagName := range positional {
-		tag, ok := storedTags[requestedTagName]
+		if err := ValidateTagName(requestedTagName); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			continue
+		}
+
+		_, ok := storedTags[requestedTagName]
+		// a parent tag has the songs of its descendants
+		tag, hasSongs := GetTagSongs(storedTags, requestedTagName)
+
+		isSmart := IsSmartTag(args.musicPath, requestedTagName)
 
 		if args.edit {
 			tagPath := GetTagPath(args.musicPath, requestedTagName)
 
-			if !ok {
-				err := os.WriteFile(tagPath, []byte("#EXTM3U\n#PLAYLIST:"+requestedTagName+"\n"), 0666)
-
-				if err != nil {
-					return fmt.Errorf("could not write tag file: %w", err)
+			if isSmart {
+				tagPath = GetSmartTagPath(args.musicPath, requestedTagName)
+			} else if !ok {
+				if err := createTagFile(args.musicPath, requestedTagName); err != nil {
+					return err
 				}
 			}
 			_, err = utils.EditFile(tagPath)
@@ -213,14 +372,25 @@ func tagsCommandRunner(args *TagsCommandArgs, positional []string) error {
 				fmt.Fprintln(os.Stderr, err)
 				continue
 			}
-		} else if !ok {
+		} else if !hasSongs {
 			fmt.Fprintf(os.Stderr, "error: tag \"%s\" does not exist\n", requestedTagName)
+		} else if args.shouldDelete && !ok {
+			fmt.Fprintf(os.Stderr, "error: tag \"%s\" only has nested tags, delete those instead\n", requestedTagName)
 		} else if args.shouldDelete {
 			delete(storedTags, requestedTagName)
 
-			if err := os.Remove(GetTagPath(args.musicPath, requestedTagName)); err != nil {
+			if isSmart {
+				if err := os.Remove(GetSmartTagPath(args.musicPath, requestedTagName)); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}
+
+			// smart tags don't always have an m3u copy
+			if err := os.Remove(GetTagPath(args.musicPath, requestedTagName)); err != nil && !(isSmart && os.IsNotExist(err)) {
 				fmt.Fprintln(os.Stderr, err)
 			}
+
+			removeEmptyTagDirectories(args.musicPath, requestedTagName)
 		} else {
 			fmt.Printf("Name: %s, Amount: %d\n", requestedTagName, len(tag))
 			fmt.Println(strings.Join(tag, "\n"))
@@ -230,66 +400,210 @@ func tagsCommandRunner(args *TagsCommandArgs, positional []string) error {
 	return nil
 }
 
+type tagTreeNode struct {
+	name     string
+	path     string
+	children []*tagTreeNode
+}
+
+func (n *tagTreeNode) child(name string) *tagTreeNode {
+	for _, child := range n.children {
+		if child.name == name {
+			return child
+		}
+	}
+
+	path := name
+
+	if n.path != "" {
+		path = n.path + "/" + name
+	}
+
+	child := &tagTreeNode{name: name, path: path}
+	n.children = append(n.children, child)
+	return child
+}
+
+// prints the tags as a tree, every tag with the amount of songs in it and its
+// descendants
+func printTagTree(storedTags map[string][]string) {
+	root := &tagTreeNode{}
+
+	for _, name := range sortedTagNames(storedTags) {
+		node := root
+
+		for _, part := range strings.Split(name, "/") {
+			node = node.child(part)
+		}
+	}
+
+	var printNode func(node *tagTreeNode, prefix string, connector string, childPrefix string)
+
+	printNode = func(node *tagTreeNode, prefix string, connector string, childPrefix string) {
+		songs, _ := GetTagSongs(storedTags, node.path)
+		fmt.Printf("%s%s%s (%d)\n", prefix, connector, node.name, len(songs))
+
+		for i, child := range node.children {
+			if i == len(node.children)-1 {
+				printNode(child, prefix+childPrefix, "└── ", "    ")
+			} else {
+				printNode(child, prefix+childPrefix, "├── ", "│   ")
+			}
+		}
+	}
+
+	for _, node := range root.children {
+		printNode(node, "", "", "")
+	}
+}
+
 func formatTime(timeStamp int64) string {
 	return time.Unix(timeStamp, 0).Format("2006-01-02 15:04:05")
 }
 
-func ChangeSongsInTag(musicPath string, tagName string, songs []string, shouldAppend bool) error {
-	storedTags, err := GetStoredTags(musicPath)
+// adds the songs to the tag (or replaces its songs if shouldAppend is false),
+// addedBy is what added them, like the play query. Songs that were already in
+// the tag keep their place and comments.
+func ChangeSongsInTag(musicPath string, tagName string, songs []string, shouldAppend bool, addedBy string) error {
+	if err := ValidateTagName(tagName); err != nil {
+		return err
+	}
+
+	if IsSmartTag(musicPath, tagName) {
+		return fmt.Errorf("\"%s\" is a smart tag, change its query with music tags --edit instead", tagName)
+	}
+
+	unlock, err := lockTags()
 
 	if err != nil {
-		return fmt.Errorf("could not get stored tags: %w", err)
+		return err
 	}
 
+	defer unlock()
+
 	tagPath := GetTagPath(musicPath, tagName)
-	tagContent := []string{}
-	tagSongs, ok := storedTags[tagName]
+	file := newTagFile(tagName)
+	content, err := os.ReadFile(tagPath)
 
-	if shouldAppend {
-		_, err := os.Stat(tagPath)
+	if err == nil {
+		file = parseTagFile(string(content))
 
-		if os.IsNotExist(err) {
-			tagContent = []string{fmt.Sprintf("#EXTM3U\n#PLAYLIST:%s", tagName)}
-		} else if err != nil {
-			return fmt.Errorf("could not get tag file: %w", err)
-		} else {
-			c, err := os.ReadFile(tagPath)
+		if len(file.Header) == 0 {
+			file.Header = newTagFile(tagName).Header
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("could not read tag file: %w", err)
+	}
 
-			if err != nil {
-				return fmt.Errorf("could not read tag file: %w", err)
-			}
+	existing := map[string]tagEntry{}
 
-			tagContent = []string{string(c)}
-		}
-	} else {
-		tagContent = []string{fmt.Sprintf("#EXTM3U\n#PLAYLIST:%s", tagName)}
-		tagSongs = []string{}
+	for _, entry := range file.Entries {
+		existing[entry.songPath(tagPath)] = entry
+	}
+
+	if !shouldAppend {
+		file.Entries = []tagEntry{}
 	}
 
-	if !ok || tagSongs == nil {
-		tagSongs = []string{}
+	included := map[string]bool{}
+
+	for _, entry := range file.Entries {
+		included[entry.songPath(tagPath)] = true
 	}
 
+	now := time.Now()
+
 	for _, song := range songs {
-		if song != "" && !utils.Includes(tagSongs, song) {
-			relativePath, err := filepath.Rel(filepath.Join(musicPath, "tags"), song)
+		if song == "" || included[song] {
+			continue
+		}
+
+		entry, ok := existing[song]
+
+		if !ok {
+			relativePath, err := filepath.Rel(filepath.Dir(tagPath), song)
 
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "error: could not get relative path for \"%s\": %s\n", song, err)
 				continue
 			}
 
-			tagContent = append(tagContent, relativePath)
-			tagSongs = append(tagSongs, song)
+			entry = tagEntry{Path: relativePath, Duration: -1, Added: now, AddedBy: addedBy}
 		}
+
+		file.Entries = append(file.Entries, entry)
+		included[song] = true
+	}
+
+	if err := fillTagInfo(musicPath, tagPath, file.Entries); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(tagPath), 0777); err != nil {
+		return fmt.Errorf("could not create tag directory: %w", err)
+	}
+
+	err = utils.WriteFileAtomic(tagPath, []byte(file.String()), 0666)
+
+	if err != nil {
+		return fmt.Errorf("could not write tag file: %w", err)
 	}
 
-	err = os.WriteFile(tagPath, []byte(strings.Join(tagContent, "\n")), 0666)
+	return nil
+}
+
+// writes an empty tag file, unless another process made the tag in the
+// meantime
+func createTagFile(musicPath string, tagName string) error {
+	unlock, err := lockTags()
 
 	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	tagPath := GetTagPath(musicPath, tagName)
+
+	if _, err := os.Stat(tagPath); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(tagPath), 0777); err != nil {
+		return fmt.Errorf("could not create tag directory: %w", err)
+	}
+
+	if err := utils.WriteFileAtomic(tagPath, []byte(newTagFile(tagName).String()), 0666); err != nil {
 		return fmt.Errorf("could not write tag file: %w", err)
 	}
 
-	storedTags[tagName] = tagSongs
+	return nil
+}
+
+// adds #EXTINF lines from the library index to the entries that don't have
+// one, so players show more than the file name
+func fillTagInfo(musicPath string, tagPath string, entries []tagEntry) error {
+	if !slices.ContainsFunc(entries, func(entry tagEntry) bool { return !entry.HasInfo }) {
+		return nil
+	}
+
+	librarySongs, err := library.GetSongs(musicPath)
+
+	if err != nil {
+		return fmt.Errorf("could not get library: %w", err)
+	}
+
+	indexedSongs := make(map[string]library.Song, len(librarySongs))
+
+	for _, song := range librarySongs {
+		indexedSongs[song.Path] = song
+	}
+
+	for i := range entries {
+		if song, ok := indexedSongs[entries[i].songPath(tagPath)]; ok && !entries[i].HasInfo {
+			entries[i].setInfo(song)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,129 @@
+package tags
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// keeps the config, its lock and the library index out of the real home
+func setupTestMusicPath(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "config"))
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(home, "cache"))
+
+	musicPath := filepath.Join(home, "music")
+
+	if err := os.MkdirAll(filepath.Join(musicPath, "tags"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	return musicPath
+}
+
+func TestChangeSongsInTagConcurrently(t *testing.T) {
+	musicPath := setupTestMusicPath(t)
+	writers := 16
+	songsPerWriter := 8
+
+	if testing.Short() {
+		writers = 4
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*songsPerWriter)
+	want := []string{}
+
+	for writer := 0; writer < writers; writer++ {
+		for song := 0; song < songsPerWriter; song++ {
+			want = append(want, filepath.Join(musicPath, fmt.Sprintf("writer %d", writer), fmt.Sprintf("song %d.mp3", song)))
+		}
+	}
+
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+
+		go func(writer int) {
+			defer wg.Done()
+
+			// one song at a time, so every write has to see the ones before it
+			for song := 0; song < songsPerWriter; song++ {
+				songPath := want[writer*songsPerWriter+song]
+
+				if err := ChangeSongsInTag(musicPath, "genre/lofi", []string{songPath}, true, "test"); err != nil {
+					errs <- err
+				}
+			}
+		}(writer)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	storedTags, err := GetStoredTags(musicPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]bool{}
+
+	for _, song := range storedTags["genre/lofi"] {
+		got[song] = true
+	}
+
+	for _, song := range want {
+		if !got[song] {
+			t.Errorf("lost %s", song)
+		}
+	}
+
+	if len(storedTags["genre/lofi"]) != len(want) {
+		t.Errorf("tag has %d songs, want %d", len(storedTags["genre/lofi"]), len(want))
+	}
+
+	// neither temporary files nor the lock end up in the synced directory
+	filepath.WalkDir(filepath.Join(musicPath, "tags"), func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(entry.Name(), ".tmp-") || strings.HasSuffix(entry.Name(), ".lock") {
+			t.Errorf("%s was left in the tags directory", path)
+		}
+
+		return nil
+	})
+}
+
+func TestCreateTagFileKeepsExistingTag(t *testing.T) {
+	musicPath := setupTestMusicPath(t)
+	song := filepath.Join(musicPath, "a.mp3")
+
+	if err := ChangeSongsInTag(musicPath, "lofi", []string{song}, true, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := createTagFile(musicPath, "lofi"); err != nil {
+		t.Fatal(err)
+	}
+
+	storedTags, err := GetStoredTags(musicPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if songs := storedTags["lofi"]; len(songs) != 1 || songs[0] != song {
+		t.Errorf("tag has %q after createTagFile, want [%s]", songs, song)
+	}
+}
@@ -10,7 +10,7 @@ _music_completions()
 
     for i in "${COMP_WORDS[@]}"
     do
-        if [ "$i" = "install" ] || [ "$i" = "play" ] || [ "$i" = "tags" ] || [ "$i" = "lastfm" ]; then
+        if [ "$i" = "install" ] || [ "$i" = "play" ] || [ "$i" = "tags" ] || [ "$i" = "lastfm" ] || [ "$i" = "queue" ]; then
             subcommand="$i"
             break
         fi
@@ -34,8 +34,11 @@ _music_completions()
         lastfm)
             COMPREPLY=( $(compgen -W "--help --debug --interval" -- ${cur_word}) )
             ;;
+        queue)
+            COMPREPLY=( $(compgen -W "list add remove move clear shuffle next --help --player --music-path" -- ${cur_word}) )
+            ;;
         *)
-            COMPREPLY=( $(compgen -W "help completion play tags install lastfm --help --version" -- ${cur_word}) )
+            COMPREPLY=( $(compgen -W "help completion play queue tags install lastfm --help --version" -- ${cur_word}) )
             ;;
     esac
 
@@ -85,7 +88,7 @@ _music_tags_completions() {
 }
 
 _music_play_completions() {
-    local generic_options="--help --append --live --editor --skip --random --tags --add-to-tag --set-to-tag --dry-paths --play-new-first --skip-old-first --persist --vlc-path --sort-type --music-path --dry-run --limit --new --no-persist"
+    local generic_options="--help --append --live --editor --skip --random --tags --add-to-tag --set-to-tag --dry-paths --play-new-first --skip-old-first --persist --player --vlc-path --sort-type --match --music-path --dry-run --limit --new --no-persist"
     local cur_word="${COMP_WORDS[COMP_CWORD]}"
     local prev_word="${COMP_WORDS[COMP_CWORD - 1]}"
 
@@ -93,6 +96,12 @@ _music_play_completions() {
         --sort-type|-s)
             COMPREPLY=( $(compgen -W "a c m" -- "$cur_word") ) 
             ;;
+        --player)
+            COMPREPLY=( $(compgen -W "vlc mpv mpd" -- "$cur_word") )
+            ;;
+        --match)
+            COMPREPLY=( $(compgen -W "substring fuzzy regex" -- "$cur_word") )
+            ;;
         --music-path)
             COMPREPLY=()
             ;; 
@@ -0,0 +1,185 @@
+package dbUtils
+
+import (
+	"database/sql"
+	"time"
+)
+
+// the library index lives in its own database file, so it keeps its own
+// migration history separate from the plays database
+var libraryMigrations = []Migration{
+	{
+		Version: 1,
+		Up: `
+		create table songs (
+			path text primary key,
+			music_path text not null,
+
+			size integer not null,
+			mod_time timestamp not null,
+			access_time timestamp not null,
+			change_time timestamp not null,
+
+			title text not null default '',
+			artist text not null default '',
+			album text not null default '',
+			album_artist text not null default '',
+			genre text not null default '',
+			year integer not null default 0,
+			track integer not null default 0,
+
+			indexed_at timestamp not null
+		);
+
+		create index songs_music_path on songs (music_path);
+
+		create table library_refreshes (
+			music_path text primary key,
+			refreshed_at timestamp not null
+		);
+		`,
+	},
+	{
+		Version: 2,
+		Up: `
+		alter table songs add column duration real not null default 0;
+		alter table songs add column bitrate integer not null default 0;
+
+		-- force every file to be re-read on the next refresh so the new
+		-- columns get filled in
+		update songs set size = -1;
+		delete from library_refreshes;
+		`,
+	},
+}
+
+func RunLibraryMigrations(db *sql.DB) error {
+	return runMigrations(db, libraryMigrations)
+}
+
+type LibrarySong struct {
+	Path        string
+	MusicPath   string
+	Size        int64
+	ModTime     time.Time
+	AccessTime  time.Time
+	ChangeTime  time.Time
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Genre       string
+	Year        int
+	Track       int
+	Duration    float64 // seconds, 0 if unknown
+	Bitrate     int     // average kbps, 0 if unknown
+	IndexedAt   time.Time
+}
+
+const GET_LIBRARY_SONGS_QUERY = `
+	select path, music_path, size, mod_time, access_time, change_time,
+	title, artist, album, album_artist, genre, year, track, duration, bitrate, indexed_at
+	from songs where music_path = ? order by path;
+`
+
+func GetLibrarySongs(db *sql.DB, musicPath string) ([]LibrarySong, error) {
+	rows, err := db.Query(GET_LIBRARY_SONGS_QUERY, musicPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var songs []LibrarySong
+
+	for rows.Next() {
+		var song LibrarySong
+		if err := rows.Scan(
+			&song.Path, &song.MusicPath, &song.Size, &song.ModTime, &song.AccessTime, &song.ChangeTime,
+			&song.Title, &song.Artist, &song.Album, &song.AlbumArtist, &song.Genre, &song.Year, &song.Track, &song.Duration, &song.Bitrate, &song.IndexedAt,
+		); err != nil {
+			return nil, err
+		}
+		songs = append(songs, song)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return songs, nil
+}
+
+const UPSERT_LIBRARY_SONG_QUERY = `
+	insert into songs
+	(path, music_path, size, mod_time, access_time, change_time,
+	title, artist, album, album_artist, genre, year, track, duration, bitrate, indexed_at)
+
+	values (?, ?, ?, ?, ?, ?,
+	?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+
+	on conflict (path) do update set
+	music_path = excluded.music_path, size = excluded.size,
+	mod_time = excluded.mod_time, access_time = excluded.access_time, change_time = excluded.change_time,
+	title = excluded.title, artist = excluded.artist, album = excluded.album,
+	album_artist = excluded.album_artist, genre = excluded.genre,
+	year = excluded.year, track = excluded.track,
+	duration = excluded.duration, bitrate = excluded.bitrate, indexed_at = excluded.indexed_at;
+`
+
+func UpsertLibrarySong(tx *sql.Tx, song LibrarySong) error {
+	_, err := tx.Exec(
+		UPSERT_LIBRARY_SONG_QUERY,
+		song.Path,
+		song.MusicPath,
+		song.Size,
+		song.ModTime,
+		song.AccessTime,
+		song.ChangeTime,
+		song.Title,
+		song.Artist,
+		song.Album,
+		song.AlbumArtist,
+		song.Genre,
+		song.Year,
+		song.Track,
+		song.Duration,
+		song.Bitrate,
+		song.IndexedAt,
+	)
+	return err
+}
+
+const DELETE_LIBRARY_SONG_QUERY = `
+	delete from songs where path = ?;
+`
+
+func DeleteLibrarySong(tx *sql.Tx, path string) error {
+	_, err := tx.Exec(DELETE_LIBRARY_SONG_QUERY, path)
+	return err
+}
+
+const GET_LIBRARY_REFRESH_TIME_QUERY = `
+	select refreshed_at from library_refreshes where music_path = ?;
+`
+
+// returns the zero time if the music path has never been indexed
+func GetLibraryRefreshTime(db *sql.DB, musicPath string) (time.Time, error) {
+	var refreshedAt time.Time
+	err := db.QueryRow(GET_LIBRARY_REFRESH_TIME_QUERY, musicPath).Scan(&refreshedAt)
+
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+
+	return refreshedAt, err
+}
+
+const SET_LIBRARY_REFRESH_TIME_QUERY = `
+	insert into library_refreshes (music_path, refreshed_at) values (?, ?)
+	on conflict (music_path) do update set refreshed_at = excluded.refreshed_at;
+`
+
+func SetLibraryRefreshTime(tx *sql.Tx, musicPath string, refreshedAt time.Time) error {
+	_, err := tx.Exec(SET_LIBRARY_REFRESH_TIME_QUERY, musicPath, refreshedAt)
+	return err
+}
@@ -85,6 +85,86 @@ var migrations = []Migration{
 		alter table plays_temp rename to plays;
 		`,
 	},
+	{
+		Version: 5,
+		Up: `
+		alter table plays add column ignored_code text;
+		alter table plays add column ignored_message text;
+		`,
+	},
+	{
+		// plays can be scrobbled to several targets (lastfm, listenbrainz,
+		// maloja), each with their own fulfilled state. Everything before
+		// this was lastfm.
+		Version: 6,
+		Up: `
+		create table play_targets (
+			play_id integer not null references plays(id) on delete cascade,
+			target text not null,
+			fulfilled boolean not null,
+			ignored_code text,
+			ignored_message text,
+			primary key (play_id, target)
+		);
+
+		insert into play_targets (
+			play_id, target, fulfilled, ignored_code, ignored_message
+		) select id, 'lastfm', fulfilled, ignored_code, ignored_message from plays where scrobbable = true;
+
+		create table plays_temp (
+			id integer primary key autoincrement,
+			scrobbable boolean not null,
+
+			album text,
+			artist text not null,
+			title text not null,
+			duration integer not null,
+
+			listen_time integer not null,
+			wall_time integer,
+			max_position integer,
+			unique_coverage integer,
+			seek_count integer,
+
+			started_at timestamp not null,
+			source text
+		);
+
+		insert into plays_temp (
+			id, scrobbable, album, artist, title, duration, listen_time, wall_time, max_position, unique_coverage, seek_count, started_at, source
+		) select id, scrobbable, album, artist, title, duration, listen_time, wall_time, max_position, unique_coverage, seek_count, started_at, source from plays;
+
+		drop table plays;
+		alter table plays_temp rename to plays;
+		`,
+	},
+	{
+		// album, artist and title are what was scrobbled (after the rewrite
+		// rules), the original columns what the player said
+		Version: 7,
+		Up: `
+		alter table plays add column original_album text;
+		alter table plays add column original_artist text;
+		alter table plays add column original_title text;
+
+		update plays set original_album = album, original_artist = artist, original_title = title;
+		`,
+	},
+	{
+		// where lastfm sync-history is for each user: everything up to
+		// synced_to is in plays, and a sync that got interrupted continues at
+		// next_page of its pass_from to pass_to window (0 if there isn't one)
+		Version: 8,
+		Up: `
+		create table sync_history (
+			username text primary key,
+			synced_to integer not null default 0,
+			pass_from integer not null default 0,
+			pass_to integer not null default 0,
+			next_page integer not null default 0
+		);
+		`,
+	},
 }
 
 func getCurrentVersion(db *sql.DB) (int, error) {
@@ -96,6 +176,10 @@ func getCurrentVersion(db *sql.DB) (int, error) {
 }
 
 func RunMigrations(db *sql.DB) error {
+	return runMigrations(db, migrations)
+}
+
+func runMigrations(db *sql.DB, migrations []Migration) error {
 	_, err := db.Exec(`
 			create table if not exists schema_migrations (
 			version integer primary key
@@ -108,6 +192,10 @@ func RunMigrations(db *sql.DB) error {
 
 	currentVersion, err := getCurrentVersion(db)
 
+	if err != nil {
+		return err
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -2,12 +2,19 @@ package dbUtils
 
 import (
 	"database/sql"
+	"net/url"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func OpenDB(filePath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", filePath)
+	// sqlite reads the dsn as a uri, so ?, # and % in the path have to be
+	// escaped or they'd cut the path short
+	dsn := url.URL{Scheme: "file", Opaque: (&url.URL{Path: filePath}).EscapedPath()}
+	// wait for other writers (e.g. the watcher and its retry flusher) instead
+	// of failing with "database is locked"
+	dsn.RawQuery = "_busy_timeout=5000"
+	db, err := sql.Open("sqlite3", dsn.String())
 
 	if err != nil {
 		return nil, err
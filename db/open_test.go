@@ -0,0 +1,28 @@
+package dbUtils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenDBEscapesPath(t *testing.T) {
+	for _, name := range []string{"plain.db", "what?.db", "#1.db", "100%.db", "a b.db"} {
+		filePath := filepath.Join(t.TempDir(), name)
+		db, err := OpenDB(filePath)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Exec("CREATE TABLE t (x INTEGER)"); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+
+		db.Close()
+
+		if _, err := os.Stat(filePath); err != nil {
+			t.Errorf("%s: the database wasn't created at its path: %s", name, err)
+		}
+	}
+}
@@ -12,12 +12,25 @@ type Play struct {
 	Album     string
 	Artist    string
 	Title     string
+	Duration  int
 	StartTime time.Time
+	// before the rewrite rules
+	OriginalAlbum  string
+	OriginalArtist string
+	OriginalTitle  string
+}
+
+// how a play went for one scrobbling target (e.g. "lastfm")
+type PlayTarget struct {
+	Target    string
+	Fulfilled bool
+	// set when the target ignored the scrobble
+	IgnoredCode    string
+	IgnoredMessage string
 }
 
 type InsertIntoPlaysParams struct {
 	Scrobbable     bool
-	Fulfilled      bool
 	Album          string
 	Artist         string
 	Title          string
@@ -29,26 +42,50 @@ type InsertIntoPlaysParams struct {
 	SeekCount      int
 	StartTime      time.Time
 	Source         string
+	OriginalAlbum  string
+	OriginalArtist string
+	OriginalTitle  string
+	// only for scrobbable plays, one for each enabled target
+	Targets []PlayTarget
+}
+
+// a play a target won't accept, Code is the target's reason (for lastfm its
+// ignoredMessage code)
+type IgnoredPlay struct {
+	ID      int64
+	Code    string
+	Message string
 }
 
 const INSERT_INTO_PLAYS_QUERY = `
 	insert into plays 
-	(scrobbable, fulfilled, 
+	(scrobbable, 
 	album, artist, title, 
 	duration, listen_time, wall_time, max_position, unique_coverage, seek_count,
-	started_at, source) 
+	started_at, source,
+	original_album, original_artist, original_title) 
 
-	values (?, ?, 
+	values (?, 
 	?, ?, ?, 
 	?, ?, ?, ?, ?, ?,
-	?, ?);
+	?, ?,
+	?, ?, ?);
+`
+
+const INSERT_INTO_PLAY_TARGETS_QUERY = `
+	insert into play_targets (play_id, target, fulfilled, ignored_code, ignored_message) values (?, ?, ?, ?, ?);
 `
 
 func InsertIntoPlays(db *sql.DB, params InsertIntoPlaysParams) error {
-	_, err := db.Exec(
+	tx, err := db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(
 		INSERT_INTO_PLAYS_QUERY,
 		params.Scrobbable,
-		params.Fulfilled,
 		params.Album,
 		params.Artist,
 		params.Title,
@@ -60,17 +97,46 @@ func InsertIntoPlays(db *sql.DB, params InsertIntoPlaysParams) error {
 		params.SeekCount,
 		params.StartTime,
 		params.Source,
+		params.OriginalAlbum,
+		params.OriginalArtist,
+		params.OriginalTitle,
 	)
-	return err
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	id, err := result.LastInsertId()
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, target := range params.Targets {
+		_, err := tx.Exec(INSERT_INTO_PLAY_TARGETS_QUERY, id, target.Target, target.Fulfilled, nullIfEmpty(target.IgnoredCode), nullIfEmpty(target.IgnoredMessage))
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 // for now no pagination, just assume we can fit all unfulfilled plays in memory
 const GET_UNFULFILLED_PLAYS_QUERY = `
-	select id,album,artist,title,started_at from plays where fulfilled = false and scrobbable = true;
+	select plays.id, plays.album, plays.artist, plays.title, plays.duration, plays.started_at,
+	coalesce(plays.original_album, plays.album), coalesce(plays.original_artist, plays.artist), coalesce(plays.original_title, plays.title) from plays
+	join play_targets on play_targets.play_id = plays.id
+	where play_targets.target = ? and play_targets.fulfilled = false and play_targets.ignored_code is null and plays.scrobbable = true;
 `
 
-func GetUnfulfilledPlays(db *sql.DB) ([]Play, error) {
-	rows, err := db.Query(GET_UNFULFILLED_PLAYS_QUERY)
+// the plays that still have to be sent to target
+func GetUnfulfilledPlays(db *sql.DB, target string) ([]Play, error) {
+	rows, err := db.Query(GET_UNFULFILLED_PLAYS_QUERY, target)
 
 	if err != nil {
 		return nil, err
@@ -81,7 +147,7 @@ func GetUnfulfilledPlays(db *sql.DB) ([]Play, error) {
 
 	for rows.Next() {
 		var play Play
-		if err := rows.Scan(&play.ID, &play.Album, &play.Artist, &play.Title, &play.StartTime); err != nil {
+		if err := rows.Scan(&play.ID, &play.Album, &play.Artist, &play.Title, &play.Duration, &play.StartTime, &play.OriginalAlbum, &play.OriginalArtist, &play.OriginalTitle); err != nil {
 			return nil, err
 		}
 		plays = append(plays, play)
@@ -94,23 +160,188 @@ func GetUnfulfilledPlays(db *sql.DB) ([]Play, error) {
 }
 
 const UPDATE_UNFULFILLED_PLAYS_QUERY_HELPER = `
-	update plays set fulfilled = true where id in (%s);
+	update play_targets set fulfilled = true where target = ? and play_id in (%s);
 `
 
-func UpdateUnfulfilledPlays(db *sql.DB, plays []Play) error {
+func UpdateUnfulfilledPlays(db *sql.DB, target string, plays []Play) error {
 	if len(plays) == 0 {
 		return nil
 	}
 
 	placeholders := make([]string, len(plays))
-	args := make([]any, len(plays))
+	args := make([]any, len(plays)+1)
+	args[0] = target
 
 	for i, play := range plays {
 		placeholders[i] = "?"
-		args[i] = play.ID
+		args[i+1] = play.ID
 	}
 
 	query := fmt.Sprintf(UPDATE_UNFULFILLED_PLAYS_QUERY_HELPER, strings.Join(placeholders, ","))
 	_, err := db.Exec(query, args...)
 	return err
 }
+
+const UPDATE_PLAY_METADATA_QUERY = `
+	update plays set album = ?, artist = ?, title = ? where id = ?;
+`
+
+// saves a play's album, artist and title after the rules changed them
+func UpdatePlayMetadata(db *sql.DB, play Play) error {
+	_, err := db.Exec(UPDATE_PLAY_METADATA_QUERY, play.Album, play.Artist, play.Title, play.ID)
+	return err
+}
+
+const SET_PLAY_IGNORED_QUERY = `
+	update play_targets set ignored_code = ?, ignored_message = ? where target = ? and play_id = ?;
+`
+
+// ignored plays aren't unfulfilled anymore, retrying them won't help
+func SetPlaysIgnored(db *sql.DB, target string, plays []IgnoredPlay) error {
+	if len(plays) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	for _, play := range plays {
+		if _, err := tx.Exec(SET_PLAY_IGNORED_QUERY, play.Code, play.Message, target, play.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func nullIfEmpty(value string) any {
+	if value == "" {
+		return nil
+	}
+
+	return value
+}
+
+const GET_PLAY_COUNTS_QUERY = `
+	select lower(artist), lower(title), count(*) from plays where scrobbable = true group by lower(artist), lower(title);
+`
+
+// play counts keyed by the lowercase artist and title joined with a null byte
+func GetPlayCounts(db *sql.DB) (map[string]int, error) {
+	rows, err := db.Query(GET_PLAY_COUNTS_QUERY)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	counts := make(map[string]int)
+
+	for rows.Next() {
+		var artist, title string
+		var count int
+
+		if err := rows.Scan(&artist, &title, &count); err != nil {
+			return nil, err
+		}
+
+		counts[artist+"\x00"+title] = count
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// a full row of the plays table, columns older rows don't have are 0
+type PlayRecord struct {
+	ID             int64
+	Scrobbable     bool
+	Album          string
+	Artist         string
+	Title          string
+	Duration       int
+	ListenTime     int
+	WallTime       int
+	MaxPosition    int
+	UniqueCoverage int
+	SeekCount      int
+	StartTime      time.Time
+	Source         string
+}
+
+// old rows don't know their unique coverage, the listen time is the closest
+// thing to it
+const GET_PLAYS_QUERY = `
+	select id, scrobbable, coalesce(album, ''), artist, title, duration, listen_time,
+	coalesce(wall_time, 0), coalesce(max_position, 0), coalesce(unique_coverage, listen_time), coalesce(seek_count, 0),
+	started_at, coalesce(source, '')
+	from plays order by started_at;
+`
+
+func GetPlays(db *sql.DB) ([]PlayRecord, error) {
+	rows, err := db.Query(GET_PLAYS_QUERY)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var plays []PlayRecord
+
+	for rows.Next() {
+		var play PlayRecord
+
+		if err := rows.Scan(&play.ID, &play.Scrobbable, &play.Album, &play.Artist, &play.Title, &play.Duration, &play.ListenTime, &play.WallTime, &play.MaxPosition, &play.UniqueCoverage, &play.SeekCount, &play.StartTime, &play.Source); err != nil {
+			return nil, err
+		}
+
+		plays = append(plays, play)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return plays, nil
+}
+
+// unix timestamps, see migration 8
+type SyncHistoryState struct {
+	Username string
+	SyncedTo int64
+	PassFrom int64
+	PassTo   int64
+	NextPage int
+}
+
+const GET_SYNC_HISTORY_STATE_QUERY = `
+	select synced_to, pass_from, pass_to, next_page from sync_history where username = ?;
+`
+
+// a user that was never synced gets an empty state
+func GetSyncHistoryState(db *sql.DB, username string) (SyncHistoryState, error) {
+	state := SyncHistoryState{Username: username}
+	err := db.QueryRow(GET_SYNC_HISTORY_STATE_QUERY, username).Scan(&state.SyncedTo, &state.PassFrom, &state.PassTo, &state.NextPage)
+
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+
+	return state, err
+}
+
+const SAVE_SYNC_HISTORY_STATE_QUERY = `
+	insert into sync_history (username, synced_to, pass_from, pass_to, next_page) values (?, ?, ?, ?, ?)
+	on conflict (username) do update set synced_to = excluded.synced_to, pass_from = excluded.pass_from,
+	pass_to = excluded.pass_to, next_page = excluded.next_page;
+`
+
+func SaveSyncHistoryState(db *sql.DB, state SyncHistoryState) error {
+	_, err := db.Exec(SAVE_SYNC_HISTORY_STATE_QUERY, state.Username, state.SyncedTo, state.PassFrom, state.PassTo, state.NextPage)
+	return err
+}
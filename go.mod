@@ -3,19 +3,20 @@ module github.com/kitesi/music
 go 1.21
 
 require (
+	github.com/adrg/strutil v0.3.1
+	github.com/dhowden/tag v0.0.0-20240417053706-3d75831295e8
 	github.com/djherbis/times v1.5.0
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510
+	github.com/mattn/go-sqlite3 v1.14.33
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.6.0
 	golang.org/x/term v0.1.0
+	golang.org/x/text v0.16.0
 )
 
 require (
-	github.com/adrg/strutil v0.3.1 // indirect
-	github.com/dhowden/tag v0.0.0-20240417053706-3d75831295e8 // indirect
 	github.com/inconshreveable/mousetrap v1.0.1 // indirect
-	github.com/mattn/go-sqlite3 v1.14.33 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
-	golang.org/x/text v0.16.0 // indirect
 )
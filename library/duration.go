@@ -0,0 +1,331 @@
+package library
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errUnknownDuration = errors.New("could not determine duration")
+
+// readAudioInfo returns the length of an audio file in seconds and its
+// bitrate in kbps by reading its headers, which is a lot cheaper than decoding
+// it. Only the formats the rest of the program cares about (mp3, flac, m4a and
+// ogg) are supported. The bitrate is 0 when the headers don't give it.
+func readAudioInfo(file *os.File, size int64) (float64, int, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+
+	switch strings.ToLower(filepath.Ext(file.Name())) {
+	case ".mp3":
+		return readMp3Info(file, size)
+	case ".flac":
+		return readFlacInfo(file, size)
+	case ".m4a", ".mp4", ".m4b", ".aac":
+		return readMp4Info(file, size)
+	case ".ogg", ".opus", ".oga":
+		duration, err := readOggDuration(file, size)
+		return duration, 0, err
+	}
+
+	return 0, 0, errUnknownDuration
+}
+
+// the bitrate of audioSize bytes played over duration seconds
+func averageBitrate(audioSize int64, duration float64) int {
+	if audioSize <= 0 || duration <= 0 {
+		return 0
+	}
+
+	return int(float64(audioSize) * 8 / duration / 1000)
+}
+
+// indexed by [version][layer][bitrate index], version 0 is MPEG1 and 1 is
+// MPEG2/2.5, layer 0 is layer 1
+var mp3Bitrates = [2][3][16]int{
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	},
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	},
+}
+
+var mp3SampleRates = map[byte][3]int{
+	3: {44100, 48000, 32000}, // MPEG1
+	2: {22050, 24000, 16000}, // MPEG2
+	0: {11025, 12000, 8000},  // MPEG2.5
+}
+
+// the bitrate only counts the audio frames, not the id3 tag and its cover art
+func readMp3Info(file *os.File, size int64) (float64, int, error) {
+	audioStart := int64(0)
+	header := make([]byte, 10)
+
+	if _, err := io.ReadFull(file, header); err != nil {
+		return 0, 0, err
+	}
+
+	// skip the id3v2 tag, its size is a syncsafe integer
+	if string(header[0:3]) == "ID3" {
+		audioStart = 10 + (int64(header[6])<<21 | int64(header[7])<<14 | int64(header[8])<<7 | int64(header[9]))
+
+		if header[5]&0x10 != 0 {
+			audioStart += 10
+		}
+	}
+
+	// the first frame isn't always right after the tag, so search a bit
+	buf := make([]byte, 64*1024)
+	n, err := file.ReadAt(buf, audioStart)
+
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xFF || buf[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+
+		version := (buf[i+1] >> 3) & 0x03
+		layer := (buf[i+1] >> 1) & 0x03
+		bitrateIndex := buf[i+2] >> 4
+		sampleRateIndex := (buf[i+2] >> 2) & 0x03
+
+		if version == 1 || layer == 0 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+			continue
+		}
+
+		versionIndex := 1
+		if version == 3 {
+			versionIndex = 0
+		}
+
+		layerIndex := 3 - int(layer)
+		bitrate := mp3Bitrates[versionIndex][layerIndex][bitrateIndex]
+		sampleRate := mp3SampleRates[version][sampleRateIndex]
+		isMono := buf[i+3]>>6 == 3
+
+		samplesPerFrame := 1152
+		if layerIndex == 0 {
+			samplesPerFrame = 384
+		} else if layerIndex == 2 && versionIndex == 1 {
+			samplesPerFrame = 576
+		}
+
+		// vbr files store the frame count in a xing/info or vbri header
+		// inside the first frame
+		xingOffset := 32
+		if versionIndex == 0 && isMono {
+			xingOffset = 17
+		} else if versionIndex == 1 && !isMono {
+			xingOffset = 17
+		} else if versionIndex == 1 {
+			xingOffset = 9
+		}
+
+		frames := uint32(0)
+		xing := i + 4 + xingOffset
+
+		if xing+12 <= len(buf) && (string(buf[xing:xing+4]) == "Xing" || string(buf[xing:xing+4]) == "Info") {
+			if binary.BigEndian.Uint32(buf[xing+4:xing+8])&0x01 != 0 {
+				frames = binary.BigEndian.Uint32(buf[xing+8 : xing+12])
+			}
+		} else if vbri := i + 4 + 32; vbri+18 <= len(buf) && string(buf[vbri:vbri+4]) == "VBRI" {
+			frames = binary.BigEndian.Uint32(buf[vbri+14 : vbri+18])
+		}
+
+		audioSize := size - audioStart - int64(i)
+
+		if frames > 0 {
+			duration := float64(frames) * float64(samplesPerFrame) / float64(sampleRate)
+			return duration, averageBitrate(audioSize, duration), nil
+		}
+
+		// constant bitrate, so the size of the audio gives the duration
+		return float64(audioSize) * 8 / float64(bitrate*1000), bitrate, nil
+	}
+
+	return 0, 0, errUnknownDuration
+}
+
+func readFlacInfo(file *os.File, size int64) (float64, int, error) {
+	// "fLaC", the metadata block header and the 34 byte STREAMINFO block,
+	// which is always the first block
+	header := make([]byte, 4+4+34)
+
+	if _, err := io.ReadFull(file, header); err != nil {
+		return 0, 0, err
+	}
+
+	if string(header[0:4]) != "fLaC" || header[4]&0x7F != 0 {
+		return 0, 0, errUnknownDuration
+	}
+
+	info := header[8:]
+	sampleRate := int64(info[10])<<12 | int64(info[11])<<4 | int64(info[12])>>4
+	totalSamples := int64(info[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(info[14:18]))
+
+	if sampleRate == 0 || totalSamples == 0 {
+		return 0, 0, errUnknownDuration
+	}
+
+	duration := float64(totalSamples) / float64(sampleRate)
+
+	// the frames start after the last metadata block, which is where
+	// pictures live
+	blockHeader := make([]byte, 4)
+	audioStart := int64(4)
+
+	for audioStart+4 <= size {
+		if _, err := file.ReadAt(blockHeader, audioStart); err != nil {
+			return duration, 0, nil
+		}
+
+		audioStart += 4 + (int64(blockHeader[1])<<16 | int64(blockHeader[2])<<8 | int64(blockHeader[3]))
+
+		if blockHeader[0]&0x80 != 0 {
+			return duration, averageBitrate(size-audioStart, duration), nil
+		}
+	}
+
+	return duration, 0, nil
+}
+
+// finds the atom with the given name between start and end, returning the
+// offset and size of its body
+func findMp4Atom(file *os.File, start int64, end int64, name string) (int64, int64, error) {
+	header := make([]byte, 16)
+
+	for start+8 <= end {
+		if _, err := file.ReadAt(header[:8], start); err != nil {
+			return 0, 0, err
+		}
+
+		atomSize := int64(binary.BigEndian.Uint32(header[0:4]))
+		headerSize := int64(8)
+
+		if atomSize == 1 {
+			if _, err := file.ReadAt(header[8:16], start+8); err != nil {
+				return 0, 0, err
+			}
+
+			atomSize = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		} else if atomSize == 0 {
+			atomSize = end - start
+		}
+
+		if atomSize < headerSize {
+			break
+		}
+
+		if string(header[4:8]) == name {
+			return start + headerSize, atomSize - headerSize, nil
+		}
+
+		start += atomSize
+	}
+
+	return 0, 0, errUnknownDuration
+}
+
+// the bitrate only counts the mdat atom, the cover art is in moov
+func readMp4Info(file *os.File, size int64) (float64, int, error) {
+	moovStart, moovSize, err := findMp4Atom(file, 0, size, "moov")
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	mvhdStart, _, err := findMp4Atom(file, moovStart, moovStart+moovSize, "mvhd")
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	mvhd := make([]byte, 32)
+
+	if _, err := file.ReadAt(mvhd, mvhdStart); err != nil {
+		return 0, 0, err
+	}
+
+	var timescale, duration uint64
+
+	// version 1 uses 64 bit creation/modification times and duration
+	if mvhd[0] == 1 {
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:24]))
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	}
+
+	if timescale == 0 {
+		return 0, 0, errUnknownDuration
+	}
+
+	seconds := float64(duration) / float64(timescale)
+	bitrate := 0
+
+	if _, mdatSize, err := findMp4Atom(file, 0, size, "mdat"); err == nil {
+		bitrate = averageBitrate(mdatSize, seconds)
+	}
+
+	return seconds, bitrate, nil
+}
+
+func readOggDuration(file *os.File, size int64) (float64, error) {
+	// the identification header is in the first page, the sample rate lives
+	// there for vorbis while opus always uses 48khz granules
+	firstPage := make([]byte, 128)
+	n, err := file.ReadAt(firstPage, 0)
+
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	firstPage = firstPage[:n]
+	sampleRate := 0.0
+	preSkip := 0.0
+
+	if i := bytes.Index(firstPage, []byte("\x01vorbis")); i != -1 && i+16 <= len(firstPage) {
+		sampleRate = float64(binary.LittleEndian.Uint32(firstPage[i+12 : i+16]))
+	} else if i := bytes.Index(firstPage, []byte("OpusHead")); i != -1 && i+12 <= len(firstPage) {
+		sampleRate = 48000
+		preSkip = float64(binary.LittleEndian.Uint16(firstPage[i+10 : i+12]))
+	}
+
+	if sampleRate == 0 {
+		return 0, errUnknownDuration
+	}
+
+	// the granule position of the last page is the total amount of samples
+	tailSize := min(size, 64*1024)
+	tail := make([]byte, tailSize)
+
+	if _, err := file.ReadAt(tail, size-tailSize); err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	lastPage := bytes.LastIndex(tail, []byte("OggS"))
+
+	if lastPage == -1 || lastPage+14 > len(tail) {
+		return 0, errUnknownDuration
+	}
+
+	granule := float64(binary.LittleEndian.Uint64(tail[lastPage+6 : lastPage+14]))
+	return (granule - preSkip) / sampleRate, nil
+}
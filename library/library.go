@@ -0,0 +1,313 @@
+// persistent index of the music path so queries don't have to walk the disk
+package library
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dhowden/tag"
+	"github.com/djherbis/times"
+	"github.com/pkg/errors"
+
+	dbUtils "github.com/kitesi/music/db"
+	"github.com/kitesi/music/utils"
+)
+
+type Song = dbUtils.LibrarySong
+
+type Library struct {
+	db              *sql.DB
+	refreshInterval time.Duration
+}
+
+type RefreshStats struct {
+	Added     int
+	Updated   int
+	Removed   int
+	Unchanged int
+}
+
+func GetDbPath(config utils.Config) (string, error) {
+	if config.Library.DbFile != "" {
+		return config.Library.DbFile, nil
+	}
+
+	cacheDir, err := os.UserCacheDir()
+
+	if err != nil {
+		return "", errors.Wrap(err, "could not find cache directory")
+	}
+
+	return filepath.Join(cacheDir, "go-music-kitesi", "library.db"), nil
+}
+
+func Open(config utils.Config) (*Library, error) {
+	dbPath, err := GetDbPath(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dbPath), os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not create parent directories for library db (%s)", dbPath))
+	}
+
+	db, err := dbUtils.OpenDB(dbPath)
+
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not open library db (%s)", dbPath))
+	}
+
+	if err := dbUtils.RunLibraryMigrations(db); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "could not run migrations on library db")
+	}
+
+	return &Library{db: db, refreshInterval: time.Duration(config.Library.RefreshInterval) * time.Second}, nil
+}
+
+func (l *Library) Close() error {
+	return l.db.Close()
+}
+
+// the playlists, tags and .thumbnails directories are never considered songs,
+// relativePath is the path minus the music path (with a leading slash)
+func isIgnoredPath(relativePath string) bool {
+	return strings.Contains(relativePath, "/playlists") || strings.Contains(relativePath, "/tags") || strings.Contains(relativePath, "/.thumbnails")
+}
+
+func readSong(fileName string, info fs.FileInfo) Song {
+	stat := times.Get(info)
+
+	song := Song{
+		Path:       fileName,
+		Size:       info.Size(),
+		ModTime:    stat.ModTime(),
+		AccessTime: stat.AccessTime(),
+		ChangeTime: stat.ModTime(),
+	}
+
+	if stat.HasChangeTime() {
+		song.ChangeTime = stat.ChangeTime()
+	}
+
+	file, err := os.Open(fileName)
+
+	if err != nil {
+		return song
+	}
+
+	defer file.Close()
+
+	if duration, bitrate, err := readAudioInfo(file, info.Size()); err == nil && duration > 0 {
+		song.Duration = duration
+		song.Bitrate = bitrate
+
+		// the file size includes tags and cover art, so it's only a guess
+		if bitrate == 0 {
+			song.Bitrate = averageBitrate(info.Size(), duration)
+		}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return song
+	}
+
+	metadata, err := tag.ReadFrom(file)
+
+	// not every file in the music path has tags (or is even audio), those are
+	// still indexed so that path queries keep working
+	if err != nil {
+		return song
+	}
+
+	song.Title = metadata.Title()
+	song.Artist = metadata.Artist()
+	song.Album = metadata.Album()
+	song.AlbumArtist = metadata.AlbumArtist()
+	song.Genre = metadata.Genre()
+	song.Year = metadata.Year()
+	song.Track, _ = metadata.Track()
+
+	return song
+}
+
+// Refresh walks the music path and re-reads any file whose size or
+// modification time changed since it was last indexed. With full set, every
+// file is re-read.
+func (l *Library) Refresh(musicPath string, full bool) (RefreshStats, error) {
+	stats := RefreshStats{}
+	absMusicPath, err := filepath.Abs(musicPath)
+
+	if err != nil {
+		return stats, err
+	}
+
+	existingSongs, err := dbUtils.GetLibrarySongs(l.db, absMusicPath)
+
+	if err != nil {
+		return stats, errors.Wrap(err, "could not read library db")
+	}
+
+	knownSongs := make(map[string]Song, len(existingSongs))
+
+	for _, song := range existingSongs {
+		knownSongs[song.Path] = song
+	}
+
+	seen := make(map[string]bool, len(existingSongs))
+	now := time.Now()
+	tx, err := l.db.Begin()
+
+	if err != nil {
+		return stats, err
+	}
+
+	var walk = func(fileName string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if isIgnoredPath(strings.TrimPrefix(fileName, absMusicPath)) {
+			if dirEntry.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if dirEntry.IsDir() {
+			return nil
+		}
+
+		info, err := dirEntry.Info()
+
+		if err != nil {
+			return err
+		}
+
+		seen[fileName] = true
+		knownSong, isKnown := knownSongs[fileName]
+
+		if isKnown && !full && knownSong.Size == info.Size() && knownSong.ModTime.Equal(info.ModTime()) {
+			stats.Unchanged++
+			return nil
+		}
+
+		song := readSong(fileName, info)
+		song.MusicPath = absMusicPath
+		song.IndexedAt = now
+
+		if err := dbUtils.UpsertLibrarySong(tx, song); err != nil {
+			return err
+		}
+
+		if isKnown {
+			stats.Updated++
+		} else {
+			stats.Added++
+		}
+
+		return nil
+	}
+
+	if err := filepath.WalkDir(absMusicPath, walk); err != nil {
+		tx.Rollback()
+		return stats, err
+	}
+
+	for songPath := range knownSongs {
+		if seen[songPath] {
+			continue
+		}
+
+		if err := dbUtils.DeleteLibrarySong(tx, songPath); err != nil {
+			tx.Rollback()
+			return stats, err
+		}
+
+		stats.Removed++
+	}
+
+	if err := dbUtils.SetLibraryRefreshTime(tx, absMusicPath, now); err != nil {
+		tx.Rollback()
+		return stats, err
+	}
+
+	return stats, tx.Commit()
+}
+
+// RefreshIfStale refreshes the index for the music path if it has never been
+// indexed or is older than the configured refresh interval. A negative
+// interval disables automatic refreshes.
+func (l *Library) RefreshIfStale(musicPath string) error {
+	absMusicPath, err := filepath.Abs(musicPath)
+
+	if err != nil {
+		return err
+	}
+
+	refreshedAt, err := dbUtils.GetLibraryRefreshTime(l.db, absMusicPath)
+
+	if err != nil {
+		return errors.Wrap(err, "could not read library db")
+	}
+
+	if refreshedAt.IsZero() {
+		fmt.Fprintf(os.Stderr, "indexing %s, this may take a while the first time...\n", absMusicPath)
+	} else if l.refreshInterval < 0 || time.Since(refreshedAt) < l.refreshInterval {
+		return nil
+	}
+
+	_, err = l.Refresh(musicPath, false)
+	return err
+}
+
+// Songs returns every indexed file under the music path sorted by path, with
+// paths rooted at musicPath as given (so relative music paths stay relative)
+func (l *Library) Songs(musicPath string) ([]Song, error) {
+	if err := l.RefreshIfStale(musicPath); err != nil {
+		return nil, err
+	}
+
+	absMusicPath, err := filepath.Abs(musicPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	songs, err := dbUtils.GetLibrarySongs(l.db, absMusicPath)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read library db")
+	}
+
+	if absMusicPath != musicPath {
+		for i := range songs {
+			songs[i].Path = filepath.Join(musicPath, strings.TrimPrefix(songs[i].Path, absMusicPath))
+		}
+	}
+
+	return songs, nil
+}
+
+// GetSongs opens the library from the user's config, returns the songs under
+// the music path and closes it again
+func GetSongs(musicPath string) ([]Song, error) {
+	// ignore error and use default
+	config, _ := utils.GetConfig()
+	lib, err := Open(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer lib.Close()
+	return lib.Songs(musicPath)
+}
@@ -0,0 +1,166 @@
+package mpris
+
+import (
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+type EventKind int
+
+const (
+	EVENT_METADATA EventKind = iota
+	EVENT_PLAYBACK_STATUS
+	EVENT_SEEKED
+	EVENT_PLAYER_APPEARED
+	EVENT_PLAYER_VANISHED
+)
+
+type Event struct {
+	Kind   EventKind
+	Player string
+	Time   time.Time
+	// EVENT_METADATA
+	Metadata Metadata
+	// EVENT_PLAYBACK_STATUS
+	PlaybackStatus string
+	// EVENT_SEEKED, in seconds
+	Position float64
+}
+
+// listens for PropertiesChanged and Seeked signals from every player, and for
+// players starting and quitting. The channel is closed when the client is.
+func (c *Client) Subscribe() (<-chan Event, error) {
+	matches := [][]dbus.MatchOption{
+		{
+			dbus.WithMatchObjectPath(OBJECT_PATH),
+			dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+			dbus.WithMatchMember("PropertiesChanged"),
+		},
+		{
+			dbus.WithMatchObjectPath(OBJECT_PATH),
+			dbus.WithMatchInterface(PLAYER_INTERFACE),
+			dbus.WithMatchMember("Seeked"),
+		},
+		{
+			dbus.WithMatchSender("org.freedesktop.DBus"),
+			dbus.WithMatchInterface("org.freedesktop.DBus"),
+			dbus.WithMatchMember("NameOwnerChanged"),
+			dbus.WithMatchArg0Namespace(strings.TrimSuffix(BUS_NAME_PREFIX, ".")),
+		},
+	}
+
+	for _, match := range matches {
+		if err := c.conn.AddMatchSignal(match...); err != nil {
+			return nil, err
+		}
+	}
+
+	players, err := c.Players()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, player := range players {
+		var owner string
+
+		if err := c.conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, BUS_NAME_PREFIX+player).Store(&owner); err == nil {
+			c.owners[owner] = player
+		}
+	}
+
+	signals := make(chan *dbus.Signal, 32)
+	events := make(chan Event, 32)
+	c.conn.Signal(signals)
+
+	go func() {
+		defer close(events)
+
+		for signal := range signals {
+			for _, event := range c.toEvents(signal) {
+				events <- event
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+func (c *Client) toEvents(signal *dbus.Signal) []Event {
+	now := time.Now()
+
+	switch signal.Name {
+	case "org.freedesktop.DBus.NameOwnerChanged":
+		var name, oldOwner, newOwner string
+
+		if dbus.Store(signal.Body, &name, &oldOwner, &newOwner) != nil {
+			return nil
+		}
+
+		player, ok := strings.CutPrefix(name, BUS_NAME_PREFIX)
+
+		if !ok {
+			return nil
+		}
+
+		if oldOwner != "" {
+			delete(c.owners, oldOwner)
+		}
+
+		if newOwner == "" {
+			return []Event{{Kind: EVENT_PLAYER_VANISHED, Player: player, Time: now}}
+		}
+
+		c.owners[newOwner] = player
+		return []Event{{Kind: EVENT_PLAYER_APPEARED, Player: player, Time: now}}
+	case PLAYER_INTERFACE + ".Seeked":
+		player, ok := c.owners[signal.Sender]
+		var microseconds int64
+
+		if !ok || dbus.Store(signal.Body, &microseconds) != nil {
+			return nil
+		}
+
+		return []Event{{Kind: EVENT_SEEKED, Player: player, Time: now, Position: float64(microseconds) / 1e6}}
+	case "org.freedesktop.DBus.Properties.PropertiesChanged":
+		player, ok := c.owners[signal.Sender]
+		var iface string
+		var changed map[string]dbus.Variant
+		var invalidated []string
+
+		if !ok || dbus.Store(signal.Body, &iface, &changed, &invalidated) != nil || iface != PLAYER_INTERFACE {
+			return nil
+		}
+
+		events := []Event{}
+
+		if value, ok := changed["Metadata"]; ok {
+			if fields, ok := value.Value().(map[string]dbus.Variant); ok {
+				events = append(events, Event{Kind: EVENT_METADATA, Player: player, Time: now, Metadata: parseMetadata(fields)})
+			}
+		} else {
+			// some players only say the metadata changed without sending it
+			for _, property := range invalidated {
+				if property != "Metadata" {
+					continue
+				}
+
+				if metadata, err := c.Metadata(player); err == nil {
+					events = append(events, Event{Kind: EVENT_METADATA, Player: player, Time: now, Metadata: metadata})
+				}
+			}
+		}
+
+		if value, ok := changed["PlaybackStatus"]; ok {
+			if status, ok := value.Value().(string); ok {
+				events = append(events, Event{Kind: EVENT_PLAYBACK_STATUS, Player: player, Time: now, PlaybackStatus: status})
+			}
+		}
+
+		return events
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package mpris
+
+import (
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+type Metadata struct {
+	TrackId      string
+	Title        string
+	Artists      []string
+	Album        string
+	AlbumArtists []string
+	Url          string
+	Length       float64 // seconds, 0 if unknown
+}
+
+// artists joined the way most players show them
+func (m Metadata) Artist() string {
+	return strings.Join(m.Artists, ", ")
+}
+
+func toInt64(value any) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	}
+
+	return 0, false
+}
+
+func toString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case dbus.ObjectPath:
+		return string(v)
+	}
+
+	return ""
+}
+
+// the spec says artists are lists, but some players send a single string
+func toStrings(value any) []string {
+	switch v := value.(type) {
+	case []string:
+		return v
+	case string:
+		if v == "" {
+			return nil
+		}
+
+		return []string{v}
+	}
+
+	return nil
+}
+
+func parseMetadata(fields map[string]dbus.Variant) Metadata {
+	get := func(key string) any {
+		if value, ok := fields[key]; ok {
+			return value.Value()
+		}
+
+		return nil
+	}
+
+	metadata := Metadata{
+		TrackId:      toString(get("mpris:trackid")),
+		Title:        toString(get("xesam:title")),
+		Artists:      toStrings(get("xesam:artist")),
+		Album:        toString(get("xesam:album")),
+		AlbumArtists: toStrings(get("xesam:albumArtist")),
+		Url:          toString(get("xesam:url")),
+	}
+
+	if length, ok := toInt64(get("mpris:length")); ok {
+		metadata.Length = float64(length) / 1e6
+	}
+
+	return metadata
+}
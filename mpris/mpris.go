@@ -0,0 +1,143 @@
+// a small MPRIS client over the session bus, see
+// https://specifications.freedesktop.org/mpris-spec/latest/
+package mpris
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	BUS_NAME_PREFIX  = "org.mpris.MediaPlayer2."
+	OBJECT_PATH      = "/org/mpris/MediaPlayer2"
+	PLAYER_INTERFACE = "org.mpris.MediaPlayer2.Player"
+
+	STATUS_PLAYING = "Playing"
+	STATUS_PAUSED  = "Paused"
+	STATUS_STOPPED = "Stopped"
+)
+
+var ErrPlayerNotFound = errors.New("mpris - player is not running")
+
+type Client struct {
+	conn *dbus.Conn
+	// unique bus name (":1.42") to player name, signals only carry the
+	// unique name of their sender
+	owners map[string]string
+}
+
+func Connect() (*Client, error) {
+	// a private connection so closing it doesn't affect anything else using
+	// the shared session bus connection
+	conn, err := dbus.SessionBusPrivate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Auth(nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := conn.Hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Client{conn: conn, owners: map[string]string{}}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// the running players, without the org.mpris.MediaPlayer2. prefix (e.g. "vlc"
+// or "chromium.instance1234")
+func (c *Client) Players() ([]string, error) {
+	var names []string
+
+	if err := c.conn.BusObject().Call("org.freedesktop.DBus.ListNames", 0).Store(&names); err != nil {
+		return nil, err
+	}
+
+	players := []string{}
+
+	for _, name := range names {
+		if player, ok := strings.CutPrefix(name, BUS_NAME_PREFIX); ok {
+			players = append(players, player)
+		}
+	}
+
+	sort.Strings(players)
+	return players, nil
+}
+
+func (c *Client) getProperty(player string, property string) (dbus.Variant, error) {
+	value, err := c.conn.Object(BUS_NAME_PREFIX+player, OBJECT_PATH).GetProperty(PLAYER_INTERFACE + "." + property)
+
+	if err != nil {
+		var dbusErr dbus.Error
+
+		if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.ServiceUnknown" {
+			return value, ErrPlayerNotFound
+		}
+
+		return value, err
+	}
+
+	return value, nil
+}
+
+func (c *Client) Metadata(player string) (Metadata, error) {
+	value, err := c.getProperty(player, "Metadata")
+
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	fields, ok := value.Value().(map[string]dbus.Variant)
+
+	if !ok {
+		return Metadata{}, errors.New("mpris - metadata is not a dictionary")
+	}
+
+	return parseMetadata(fields), nil
+}
+
+// in seconds
+func (c *Client) Position(player string) (float64, error) {
+	value, err := c.getProperty(player, "Position")
+
+	if err != nil {
+		return 0, err
+	}
+
+	microseconds, ok := toInt64(value.Value())
+
+	if !ok {
+		return 0, errors.New("mpris - position is not a number")
+	}
+
+	return float64(microseconds) / 1e6, nil
+}
+
+// one of STATUS_PLAYING, STATUS_PAUSED or STATUS_STOPPED
+func (c *Client) PlaybackStatus(player string) (string, error) {
+	value, err := c.getProperty(player, "PlaybackStatus")
+
+	if err != nil {
+		return "", err
+	}
+
+	status, ok := value.Value().(string)
+
+	if !ok {
+		return "", errors.New("mpris - playback status is not a string")
+	}
+
+	return status, nil
+}
@@ -0,0 +1,271 @@
+package mpris
+
+import (
+	"bufio"
+	"errors"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const TEST_EVENT_TIMEOUT = 5 * time.Second
+
+// starts a private session bus for the test and points the client at it
+func startSessionBus(t *testing.T) string {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+
+	if err != nil {
+		t.Skip("dbus-daemon is not installed")
+	}
+
+	cmd := exec.Command(daemon, "--session", "--print-address", "--nofork")
+	stdout, err := cmd.StdoutPipe()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		t.Skipf("could not start dbus-daemon: %s", err)
+	}
+
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	addressLine := make(chan string, 1)
+
+	go func() {
+		line, _ := bufio.NewReader(stdout).ReadString('\n')
+		addressLine <- strings.TrimSpace(line)
+	}()
+
+	select {
+	case address := <-addressLine:
+		if address == "" {
+			t.Skip("dbus-daemon did not print an address")
+		}
+
+		t.Setenv("DBUS_SESSION_BUS_ADDRESS", address)
+		return address
+	case <-time.After(TEST_EVENT_TIMEOUT):
+		t.Skip("dbus-daemon did not start")
+	}
+
+	return ""
+}
+
+// a player on the bus that only has the properties the client reads
+type fakePlayer struct {
+	conn  *dbus.Conn
+	props *prop.Properties
+}
+
+func testMetadata(title string) map[string]dbus.Variant {
+	return map[string]dbus.Variant{
+		"mpris:trackid":     dbus.MakeVariant(dbus.ObjectPath("/org/mpris/MediaPlayer2/track/1")),
+		"mpris:length":      dbus.MakeVariant(int64(215_000_000)),
+		"xesam:title":       dbus.MakeVariant(title),
+		"xesam:artist":      dbus.MakeVariant([]string{"Nujabes", "Shing02"}),
+		"xesam:album":       dbus.MakeVariant("Modal Soul"),
+		"xesam:albumArtist": dbus.MakeVariant("Nujabes"),
+		"xesam:url":         dbus.MakeVariant("file:///music/nujabes/luv.mp3"),
+	}
+}
+
+func startFakePlayer(t *testing.T, address string, name string) *fakePlayer {
+	t.Helper()
+	conn, err := dbus.Connect(address)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	props, err := prop.Export(conn, OBJECT_PATH, prop.Map{
+		PLAYER_INTERFACE: {
+			"Metadata":       {Value: testMetadata("Luv(sic)"), Emit: prop.EmitTrue},
+			"Position":       {Value: int64(42_500_000), Emit: prop.EmitFalse},
+			"PlaybackStatus": {Value: STATUS_PLAYING, Emit: prop.EmitTrue},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := conn.RequestName(BUS_NAME_PREFIX+name, dbus.NameFlagDoNotQueue)
+
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("could not take the bus name for %s: %v", name, err)
+	}
+
+	return &fakePlayer{conn: conn, props: props}
+}
+
+func connectClient(t *testing.T) *Client {
+	t.Helper()
+	client, err := Connect()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// the next event of the given kind, other events are skipped
+func waitForEvent(t *testing.T, events <-chan Event, kind EventKind) Event {
+	t.Helper()
+	timeout := time.After(TEST_EVENT_TIMEOUT)
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("events closed while waiting for event %d", kind)
+			}
+
+			if event.Kind == kind {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for event %d", kind)
+		}
+	}
+}
+
+func TestProperties(t *testing.T) {
+	address := startSessionBus(t)
+	startFakePlayer(t, address, "fake")
+	client := connectClient(t)
+
+	players, err := client.Players()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(players, []string{"fake"}) {
+		t.Errorf("Players() = %q, want [fake]", players)
+	}
+
+	metadata, err := client.Metadata("fake")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Metadata{
+		TrackId:      "/org/mpris/MediaPlayer2/track/1",
+		Title:        "Luv(sic)",
+		Artists:      []string{"Nujabes", "Shing02"},
+		Album:        "Modal Soul",
+		AlbumArtists: []string{"Nujabes"},
+		Url:          "file:///music/nujabes/luv.mp3",
+		Length:       215,
+	}
+
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("Metadata() = %+v, want %+v", metadata, want)
+	}
+
+	if metadata.Artist() != "Nujabes, Shing02" {
+		t.Errorf("Artist() = %q", metadata.Artist())
+	}
+
+	position, err := client.Position("fake")
+
+	if err != nil || position != 42.5 {
+		t.Errorf("Position() = %v, %v, want 42.5", position, err)
+	}
+
+	status, err := client.PlaybackStatus("fake")
+
+	if err != nil || status != STATUS_PLAYING {
+		t.Errorf("PlaybackStatus() = %q, %v, want %s", status, err, STATUS_PLAYING)
+	}
+
+	if _, err := client.Metadata("missing"); !errors.Is(err, ErrPlayerNotFound) {
+		t.Errorf("Metadata of a missing player returned %v, want ErrPlayerNotFound", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	address := startSessionBus(t)
+	// a player that was already running has to be known by its unique name
+	// too, or its signals would be dropped
+	before := startFakePlayer(t, address, "before")
+	client := connectClient(t)
+	events, err := client.Subscribe()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before.props.SetMust(PLAYER_INTERFACE, "PlaybackStatus", STATUS_PAUSED)
+	event := waitForEvent(t, events, EVENT_PLAYBACK_STATUS)
+
+	if event.Player != "before" || event.PlaybackStatus != STATUS_PAUSED {
+		t.Errorf("got %+v, want before to be paused", event)
+	}
+
+	after := startFakePlayer(t, address, "after")
+
+	if event := waitForEvent(t, events, EVENT_PLAYER_APPEARED); event.Player != "after" {
+		t.Errorf("got %+v, want after to appear", event)
+	}
+
+	after.props.SetMust(PLAYER_INTERFACE, "Metadata", testMetadata("Feather"))
+	event = waitForEvent(t, events, EVENT_METADATA)
+
+	if event.Player != "after" || event.Metadata.Title != "Feather" || event.Metadata.Length != 215 {
+		t.Errorf("got %+v, want after's new metadata", event)
+	}
+
+	// players that only invalidate the metadata get it read back
+	after.props.SetMust(PLAYER_INTERFACE, "Metadata", testMetadata("Aruarian Dance"))
+	waitForEvent(t, events, EVENT_METADATA)
+	after.conn.Emit(OBJECT_PATH, "org.freedesktop.DBus.Properties.PropertiesChanged", PLAYER_INTERFACE, map[string]dbus.Variant{}, []string{"Metadata"})
+	event = waitForEvent(t, events, EVENT_METADATA)
+
+	if event.Player != "after" || event.Metadata.Title != "Aruarian Dance" {
+		t.Errorf("got %+v, want the invalidated metadata to be read", event)
+	}
+
+	after.conn.Emit(OBJECT_PATH, PLAYER_INTERFACE+".Seeked", int64(90_000_000))
+	event = waitForEvent(t, events, EVENT_SEEKED)
+
+	if event.Player != "after" || event.Position != 90 {
+		t.Errorf("got %+v, want after to seek to 90", event)
+	}
+
+	// signals from other interfaces are ignored
+	after.conn.Emit(OBJECT_PATH, "org.freedesktop.DBus.Properties.PropertiesChanged", "org.mpris.MediaPlayer2", map[string]dbus.Variant{"Identity": dbus.MakeVariant("x")}, []string{})
+
+	after.conn.Close()
+
+	// so the next event has to be the player quitting
+	select {
+	case event := <-events:
+		if event.Kind != EVENT_PLAYER_VANISHED || event.Player != "after" {
+			t.Errorf("got %+v, want after to vanish", event)
+		}
+	case <-time.After(TEST_EVENT_TIMEOUT):
+		t.Fatal("timed out waiting for after to vanish")
+	}
+
+	client.Close()
+
+	for range events {
+	}
+}
@@ -15,20 +15,76 @@ const (
 	MIN_LISTEN_TIME          = 4 * 60
 	DEFAULT_INTERVAL_SECONDS = 10
 	DEBUG                    = false
+
+	// how often the watcher retries scrobbles that failed to send
+	DEFAULT_FLUSH_INTERVAL_SECONDS = 5 * 60
+	// the least time between two now playing updates
+	DEFAULT_NOW_PLAYING_INTERVAL_SECONDS = 10
+
+	// how old the library index can get before a query refreshes it
+	DEFAULT_LIBRARY_REFRESH_SECONDS = 60 * 60
+
+	DEFAULT_PLAYER           = "vlc"
+	DEFAULT_VLC_HTTP_ADDRESS = "localhost:8080"
+	DEFAULT_MPD_ADDRESS      = "localhost:6600"
+
+	DEFAULT_LISTENBRAINZ_URL = "https://api.listenbrainz.org"
 )
 
 type LastfmConfig struct {
-	Interval       int
-	MinTrackLength int
-	MinListenTime  int
-	LogDbFile      string
-	Source         string
+	Interval      int
+	FlushInterval int
+	// send what's playing to last.fm (track.updateNowPlaying)
+	NowPlaying         bool
+	NowPlayingInterval int
+	MinTrackLength     int
+	MinListenTime      int
+	LogDbFile          string
+	Source             string
+	// mpris player names to watch, "any" for all of them
+	Players []string
+	// where plays are scrobbled to, any of "lastfm", "listenbrainz" and
+	// "maloja"
+	Targets      []string
+	ListenBrainz ListenBrainzConfig
+	Maloja       MalojaConfig
+	// rewrite rules applied before scrobbling, defaults to
+	// <config dir>/go-music-kitesi/scrobble-rules.json
+	RulesFile string
+}
+
+type ListenBrainzConfig struct {
+	Url   string
+	Token string
+}
+
+type MalojaConfig struct {
+	Url    string
+	ApiKey string
+}
+
+type LibraryConfig struct {
+	DbFile          string
+	RefreshInterval int
+}
+
+type PlayerConfig struct {
+	Name            string
+	VlcPath         string
+	VlcHttpAddress  string
+	VlcHttpPassword string
+	MpvPath         string
+	MpvSocket       string
+	MpdAddress      string
+	MpdPassword     string
 }
 
 type Config struct {
 	MusicPath               string
 	Debug                   bool
 	LastFm                  LastfmConfig
+	Library                 LibraryConfig
+	Player                  PlayerConfig
 	TagPlaylistAssociations map[string]string
 }
 
@@ -53,11 +109,42 @@ func DefaultConfig() Config {
 		MusicPath: musicPath,
 		Debug:     DEBUG,
 		LastFm: LastfmConfig{
-			Interval:       DEFAULT_INTERVAL_SECONDS,
-			MinTrackLength: MIN_TRACK_LEN,
-			MinListenTime:  MIN_LISTEN_TIME,
-			LogDbFile:      "",
-			Source:         "",
+			Interval:           DEFAULT_INTERVAL_SECONDS,
+			FlushInterval:      DEFAULT_FLUSH_INTERVAL_SECONDS,
+			NowPlaying:         true,
+			NowPlayingInterval: DEFAULT_NOW_PLAYING_INTERVAL_SECONDS,
+			MinTrackLength:     MIN_TRACK_LEN,
+			MinListenTime:      MIN_LISTEN_TIME,
+			LogDbFile:          "",
+			Source:             "",
+			Players:            []string{"vlc"},
+			Targets:            []string{"lastfm"},
+			ListenBrainz: ListenBrainzConfig{
+				Url:   DEFAULT_LISTENBRAINZ_URL,
+				Token: "",
+			},
+			Maloja: MalojaConfig{
+				Url:    "",
+				ApiKey: "",
+			},
+			RulesFile: "",
+		},
+		Library: LibraryConfig{
+			DbFile:          "",
+			RefreshInterval: DEFAULT_LIBRARY_REFRESH_SECONDS,
+		},
+		// no default vlc password, its http interface can be reached from
+		// the network and everyone would know it. play saves a random one
+		// the first time vlc is used.
+		Player: PlayerConfig{
+			Name:            DEFAULT_PLAYER,
+			VlcPath:         "vlc",
+			VlcHttpAddress:  DEFAULT_VLC_HTTP_ADDRESS,
+			VlcHttpPassword: "",
+			MpvPath:         "mpv",
+			MpvSocket:       "",
+			MpdAddress:      DEFAULT_MPD_ADDRESS,
+			MpdPassword:     "",
 		},
 	}
 }
@@ -92,6 +179,10 @@ func GetConfig() (Config, error) {
 	return config, nil
 }
 
+func getConfigLockPath(configPath string) string {
+	return configPath + ".lock"
+}
+
 func WriteConfig(config Config) error {
 	configPath, err := GetConfigPath()
 
@@ -99,22 +190,61 @@ func WriteConfig(config Config) error {
 		return errors.Wrap(err, "could not find config path")
 	}
 
-	err = os.MkdirAll(filepath.Dir(configPath), os.ModePerm)
+	unlock, err := LockFile(getConfigLockPath(configPath))
 
 	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("could not create parent directories for config path (%s)", configPath))
+		return errors.Wrap(err, "could not lock config file")
+	}
+
+	defer unlock()
+
+	return writeConfig(configPath, config)
+}
+
+// UpdateConfig reads the config, lets update change it and writes it back,
+// holding the config lock the whole time so nothing else's change is lost
+func UpdateConfig(update func(config *Config) error) error {
+	configPath, err := GetConfigPath()
+
+	if err != nil {
+		return errors.Wrap(err, "could not find config path")
 	}
 
-	f, err := os.Create(configPath)
+	unlock, err := LockFile(getConfigLockPath(configPath))
 
 	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("could not open config path (%s)", configPath))
+		return errors.Wrap(err, "could not lock config file")
 	}
 
-	defer f.Close()
+	defer unlock()
+
+	config, err := GetConfig()
+
+	if err != nil {
+		return err
+	}
+
+	if err := update(&config); err != nil {
+		return err
+	}
+
+	return writeConfig(configPath, config)
+}
+
+func writeConfig(configPath string, config Config) error {
+	err := os.MkdirAll(filepath.Dir(configPath), os.ModePerm)
+
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("could not create parent directories for config path (%s)", configPath))
+	}
+
+	content, err := json.Marshal(config)
+
+	if err != nil {
+		return errors.Wrap(err, "could not encode config")
+	}
 
-	encoder := json.NewEncoder(f)
-	err = encoder.Encode(config)
+	err = WriteFileAtomic(configPath, append(content, '\n'), 0666)
 
 	if err != nil {
 		return errors.Wrap(err, "could not write config file")
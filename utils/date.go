@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var ageUnits = map[byte]time.Duration{
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+	'y': 365 * 24 * time.Hour,
+}
+
+// either a date ("2024-01-31", at midnight local time) or an age ("12h",
+// "30d", "2w", "1y") which is the point in time that long before now
+func ParseDateOrAge(value string, now time.Time) (time.Time, error) {
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return date, nil
+	}
+
+	if len(value) > 1 {
+		if unit, ok := ageUnits[value[len(value)-1]]; ok {
+			amount, err := strconv.ParseFloat(value[:len(value)-1], 64)
+
+			if err == nil {
+				return now.Add(-time.Duration(amount * float64(unit))), nil
+			}
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("expected a date like 2024-01-31 or an age like 30d, got \"%s\"", value)
+}
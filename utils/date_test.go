@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDateOrAge(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)
+
+	tests := map[string]time.Time{
+		"2024-01-31": time.Date(2024, 1, 31, 0, 0, 0, 0, time.Local),
+		"12h":        now.Add(-12 * time.Hour),
+		"30d":        now.Add(-30 * 24 * time.Hour),
+		"1.5w":       now.Add(-252 * time.Hour),
+		"1y":         now.Add(-365 * 24 * time.Hour),
+	}
+
+	for value, want := range tests {
+		if got, err := ParseDateOrAge(value, now); err != nil || !got.Equal(want) {
+			t.Errorf("ParseDateOrAge(%q) = %s, %v, want %s", value, got, err, want)
+		}
+	}
+
+	for _, value := range []string{"", "d", "30", "30m", "2024-13-01", "yesterday"} {
+		if _, err := ParseDateOrAge(value, now); err == nil {
+			t.Errorf("ParseDateOrAge(%q) should fail", value)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+//go:build !unix
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LOCK_RETRY_INTERVAL = 50 * time.Millisecond
+	LOCK_TIMEOUT        = 30 * time.Second
+)
+
+// without flock the lock is the lock file existing, whoever creates it first
+// holds it. The holder writes its pid into it, so a lock left behind by a
+// process that died can be taken over while a slow holder keeps its lock.
+func lockFile(lockPath string) (func(), error) {
+	deadline := time.Now().Add(LOCK_TIMEOUT)
+
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+
+		if err == nil {
+			_, err = f.WriteString(strconv.Itoa(os.Getpid()))
+			f.Close()
+
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, err
+			}
+
+			return func() { os.Remove(lockPath) }, nil
+		}
+
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		if isStaleLock(lockPath) {
+			os.Remove(lockPath)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock \"%s\", remove it if nothing else is running", lockPath)
+		}
+
+		time.Sleep(LOCK_RETRY_INTERVAL)
+	}
+}
+
+// the process that took the lock isn't running anymore. A lock without a pid
+// is still being taken, and where processes can't be looked up (FindProcess
+// always succeeds outside windows) it's never stale.
+func isStaleLock(lockPath string) bool {
+	content, err := os.ReadFile(lockPath)
+
+	if err != nil {
+		return false
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+
+	if err != nil || pid == os.Getpid() {
+		return false
+	}
+
+	process, err := os.FindProcess(pid)
+
+	// another user's process can't be opened but is still running
+	if err != nil {
+		return !errors.Is(err, os.ErrPermission)
+	}
+
+	process.Release()
+	return false
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock locks belong to the open file, so goroutines of one process exclude
+// each other as well. The lock file is left in place, removing it would let
+// two processes lock different files.
+func lockFile(lockPath string) (func(), error) {
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0666)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+
+		if err != syscall.EINTR {
+			break
+		}
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// LockFile waits for an exclusive advisory lock on lockPath (creating it if
+// needed) and returns a function that releases it. Every writer of a file has
+// to take the same lock for it to mean anything.
+func LockFile(lockPath string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0777); err != nil {
+		return nil, err
+	}
+
+	return lockFile(lockPath)
+}
+
+// WriteFileAtomic writes to a temporary file next to path and renames it over
+// path, so readers (and syncthing) only ever see the old or the new content,
+// never half of it. An existing file keeps its permissions.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	} else {
+		// the temp file skips the umask, assume the usual one
+		perm &^= 0022
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+
+	if err != nil {
+		return err
+	}
+
+	// a no-op once the rename went through
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(temp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
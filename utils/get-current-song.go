@@ -1,62 +1,59 @@
 package utils
 
 import (
-	"os/exec"
-	"strings"
+	"github.com/kitesi/music/mpris"
 )
 
 type SongMetadata struct {
 	Album  string
 	Artist string
 	Track  string
-	Length string
+	Length float64 // seconds
+	// the player's id for the playlist entry, empty if it doesn't have one
+	TrackId string
 }
 
 type SongMetadataError string
 
 const (
-	cantGetMetadata SongMetadataError = "playerctl - could not get metadata"
-	missingFields   SongMetadataError = "playerctl - could get metadata but not the necessary fields"
+	cantGetMetadata SongMetadataError = "mpris - could not get metadata"
+	missingFields   SongMetadataError = "mpris - could get metadata but not the necessary fields"
 )
 
 func (e SongMetadataError) Error() string {
 	return string(e)
 }
 
-func GetCurrentPlayingSong() (SongMetadata, error) {
-	metadataCmd := exec.Command("playerctl", "-p", "vlc", "metadata")
-	metadataOutput, err := metadataCmd.Output()
+// the song playing in player (e.g. "vlc"), meant for one off lookups. Anything
+// polling should keep its own mpris.Client around instead.
+func GetCurrentPlayingSong(player string) (SongMetadata, error) {
+	client, err := mpris.Connect()
 
 	if err != nil {
 		return SongMetadata{}, cantGetMetadata
 	}
 
-	metadata := make(map[string]string)
+	defer client.Close()
+	metadata, err := client.Metadata(player)
 
-	for _, line := range strings.Split(string(metadataOutput), "\n") {
-		if strings.TrimSpace(line) == "" {
-			continue
-		}
-
-		// split by whitespace
-		sections := strings.Fields(line)
-
-		if len(sections) < 3 {
-			continue
-		}
-
-		_, key, value := sections[0], sections[1], strings.Join(sections[2:], " ")
-		metadata[key] = value
+	if err != nil {
+		return SongMetadata{}, cantGetMetadata
 	}
 
-	if metadata["xesam:artist"] == "" || metadata["xesam:title"] == "" || metadata["vlc:length"] == "" {
+	return ToSongMetadata(metadata)
+}
+
+// the fields scrobbling needs, missingFields if any of them are empty
+func ToSongMetadata(metadata mpris.Metadata) (SongMetadata, error) {
+	if metadata.Artist() == "" || metadata.Title == "" || metadata.Length == 0 {
 		return SongMetadata{}, missingFields
 	}
 
 	return SongMetadata{
-		Artist: metadata["xesam:artist"],
-		Album:  metadata["xesam:album"],
-		Track:  metadata["xesam:title"],
-		Length: metadata["vlc:time"],
+		Artist:  metadata.Artist(),
+		Album:   metadata.Album,
+		Track:   metadata.Title,
+		Length:  metadata.Length,
+		TrackId: metadata.TrackId,
 	}, nil
 }